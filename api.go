@@ -14,8 +14,9 @@
 package apiGatewayConfDeploy
 
 import (
-	"bytes"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -23,10 +24,12 @@ import (
 	"github.com/apigee-labs/transicator/common"
 	"github.com/gorilla/mux"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -41,10 +44,17 @@ const (
 )
 
 const (
-	configEndpoint   = "/configurations"
-	blobEndpointPath = "/blobs"
-	blobEndpoint     = blobEndpointPath + "/{blobId}"
-	configIdEndpoint = configEndpoint + "/{configId}"
+	configEndpoint    = "/configurations"
+	blobEndpointPath  = "/blobs"
+	blobEndpoint      = blobEndpointPath + "/{blobId}"
+	configIdEndpoint  = configEndpoint + "/{configId}"
+	historyEndpoint   = configIdEndpoint + "/history"
+	healthEndpoint    = "/gatewaydeploy/health"
+	metricsEndpoint   = "/gatewaydeploy/metrics"
+	bandwidthEndpoint = "/gatewaydeploy/bandwidth"
+	workersEndpoint   = "/gatewaydeploy/workers"
+	downloadsEndpoint = "/gatewaydeploy/downloads"
+	pinsEndpoint      = "/gatewaydeploy/pins"
 )
 
 const (
@@ -52,6 +62,8 @@ const (
 	API_ERR_INTERNAL
 	API_ERR_BAD_CONFIG_ID
 	API_ERR_NOT_FOUND
+	API_ERR_BLOB_NOT_READY
+	API_ERR_BAD_REQUEST
 )
 
 const (
@@ -65,11 +77,21 @@ const (
 	kindCollection = "Collection"
 )
 
+const (
+	configStatusDownloading = "DOWNLOADING"
+)
+
+const (
+	healthStatusUp       = "UP"
+	healthStatusDegraded = "DEGRADED"
+)
+
 const (
 	headerSteam           = "application/octet-stream"
 	headerJson            = "application/json"
 	apidConfigIndexPar    = "apid-config-index"
 	apidConfigIndexHeader = "x-apid-config-index"
+	apidAsOfPar           = "asOf"
 )
 
 var (
@@ -77,12 +99,6 @@ var (
 	ErrInvalidLSN = errors.New(apidConfigIndexPar + " is invalid")
 )
 
-type deploymentsResult struct {
-	deployments []Configuration
-	err         error
-	eTag        string
-}
-
 type errorResponse struct {
 	ErrorCode int    `json:"errorCode"`
 	Reason    string `json:"reason"`
@@ -100,6 +116,24 @@ type ApiConfigurationDetails struct {
 	Path            string `json:"path"`
 	Created         string `json:"created"`
 	Updated         string `json:"updated"`
+	// set only while blobs of the configuration are being downloaded
+	Status   string         `json:"status,omitempty"`
+	Progress []blobProgress `json:"progress,omitempty"`
+	// set only if a previous revision is served in place of the current one
+	Pinned *ApiConfigurationPin `json:"pinned,omitempty"`
+}
+
+type ApiConfigurationPin struct {
+	// config index the pinned revision became current at
+	ConfigIndex string `json:"configIndex,omitempty"`
+	PinnedAt    string `json:"pinnedAt"`
+	// empty if the configuration was deleted since
+	CurrentRevision string `json:"currentRevision"`
+}
+
+type pinRequest struct {
+	Revision    string `json:"revision"`
+	ConfigIndex string `json:"configIndex"`
 }
 
 type ApiConfigurationResponse struct {
@@ -108,10 +142,32 @@ type ApiConfigurationResponse struct {
 	ApiConfigurationsResponse []ApiConfigurationDetails `json:"contents"`
 }
 
+type ApiConfigurationRevision struct {
+	ApiConfigurationDetails
+	ConfigIndex         string `json:"configIndex,omitempty"`
+	SeenAt              string `json:"seenAt,omitempty"`
+	ReplacedConfigIndex string `json:"replacedConfigIndex,omitempty"`
+	ReplacedAt          string `json:"replacedAt,omitempty"`
+	Deleted             bool   `json:"deleted,omitempty"`
+}
+
+type ApiConfigurationHistoryResponse struct {
+	Kind      string                     `json:"kind"`
+	Self      string                     `json:"self"`
+	Revisions []ApiConfigurationRevision `json:"contents"`
+}
+
+type healthResponse struct {
+	Status     string        `json:"status"`
+	BlobServer breakerStatus `json:"blobServer"`
+}
+
 type confChangeNotification struct {
 	LSN   string
 	confs []Configuration
-	err   error
+	// snapshot of confs, nil if they aren't in memory
+	snapshot *configSnapshot
+	err      error
 }
 
 type apiManagerInterface interface {
@@ -122,12 +178,28 @@ type apiManagerInterface interface {
 
 type apiManager struct {
 	dbMan                   dbManagerInterface
+	bundleMan               bundleManagerInterface
 	configurationEndpoint   string
 	blobEndpoint            string
 	configurationIdEndpoint string
+	historyEndpoint         string
+	healthEndpoint          string
+	metricsEndpoint         string
+	bandwidthEndpoint       string
+	workersEndpoint         string
+	downloadsEndpoint       string
+	pinsEndpoint            string
 	addSubscriber           chan chan interface{}
 	newChangeListChan       chan interface{}
 	apiInitialized          bool
+	blobOnDemandMode        string
+	blobStallTimeout        time.Duration
+	verifyBlobs             bool
+	responseCache           *responseCache
+	gzipResponses           bool
+	cursors                 *cursorSigner
+	servedMux               sync.Mutex
+	servedAt                map[string]time.Time
 }
 
 func (a *apiManager) InitAPI() {
@@ -137,6 +209,17 @@ func (a *apiManager) InitAPI() {
 	services.API().HandleFunc(a.configurationEndpoint, a.apiGetCurrentConfigs).Methods("GET")
 	services.API().HandleFunc(a.blobEndpoint, a.apiReturnBlobData).Methods("GET")
 	services.API().HandleFunc(a.configurationIdEndpoint, a.apiHandleConfigId).Methods("GET")
+	services.API().HandleFunc(a.historyEndpoint, a.apiGetConfigHistory).Methods("GET")
+	services.API().HandleFunc(a.healthEndpoint, a.apiGetHealth).Methods("GET")
+	services.API().HandleFunc(a.metricsEndpoint, a.apiGetMetrics).Methods("GET")
+	services.API().HandleFunc(a.bandwidthEndpoint, a.apiGetBandwidth).Methods("GET")
+	services.API().HandleFunc(a.bandwidthEndpoint, a.apiSetBandwidth).Methods("PUT")
+	services.API().HandleFunc(a.workersEndpoint, a.apiGetWorkers).Methods("GET")
+	services.API().HandleFunc(a.workersEndpoint, a.apiSetWorkers).Methods("PUT")
+	services.API().HandleFunc(a.downloadsEndpoint, a.apiGetDownloads).Methods("GET")
+	services.API().HandleFunc(a.pinsEndpoint, a.apiGetPins).Methods("GET")
+	services.API().HandleFunc(a.pinsEndpoint+"/{configId}", a.apiSetPin).Methods("PUT")
+	services.API().HandleFunc(a.pinsEndpoint+"/{configId}", a.apiDeletePin).Methods("DELETE")
 	a.initDistributeEvents()
 	a.apiInitialized = true
 	log.Debug("API endpoints initialized")
@@ -147,15 +230,26 @@ func (a *apiManager) initDistributeEvents() {
 }
 
 func (a *apiManager) notifyNewChange() {
-	confs, err := a.dbMan.getAllConfigurations("")
+	confs, lsn, snapshot, err := a.currentConfigurations("")
 	if err != nil {
 		log.Errorf("Database error in getReadyConfigurations: %v", err)
 	}
 	a.newChangeListChan <- &confChangeNotification{
-		LSN:   a.dbMan.getLSN(),
-		confs: confs,
-		err:   err,
+		LSN:      lsn,
+		confs:    confs,
+		snapshot: snapshot,
+		err:      err,
+	}
+}
+
+// currentConfigurations returns the configurations, the config index they're current at,
+// and their snapshot. The snapshot is nil if they were read from the db.
+func (a *apiManager) currentConfigurations(typeFilter string) ([]Configuration, string, *configSnapshot, error) {
+	if snapshot := a.dbMan.getConfigSnapshot(); snapshot != nil {
+		return snapshot.getConfigurations(typeFilter), snapshot.index(), snapshot, nil
 	}
+	confs, err := a.dbMan.getAllConfigurations(typeFilter)
+	return confs, formatConfigIndex(a.dbMan.getEpoch(), a.dbMan.getLSN()), nil, err
 }
 
 func (a *apiManager) writeError(w http.ResponseWriter, status int, code int, reason string) {
@@ -181,9 +275,16 @@ func (a *apiManager) apiReturnBlobData(w http.ResponseWriter, r *http.Request) {
 
 	vars := mux.Vars(r)
 	blobId := vars["blobId"]
-	fs, err := a.dbMan.getLocalFSLocation(blobId)
+	meta, err := a.dbMan.getBlobMetadata(blobId)
 	if err != nil {
 		if err == sql.ErrNoRows {
+			if a.returnBlobOnDemand(w, r, blobId) {
+				return
+			}
+			// a gateway is waiting for this blob, download it next
+			if a.bundleMan != nil && a.bundleMan.prioritizeBlob(blobId) {
+				log.Debugf("blobId=%s requested before download finished, prioritized", blobId)
+			}
 			a.writeError(w, http.StatusNotFound, API_ERR_NOT_FOUND, "cannot find the blob")
 		} else {
 			log.Errorf("apiReturnBlobData error from db: %v", err)
@@ -191,36 +292,227 @@ func (a *apiManager) apiReturnBlobData(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	byte, err := ioutil.ReadFile(fs)
+	a.writeBlobFile(w, r, blobId, meta)
+}
+
+// writeBlobFile sends the blob with the headers from its metadata. Conditional and range requests are supported.
+// Blobs downloaded by older versions have no metadata, they're sent as application/octet-stream without ETag.
+func (a *apiManager) writeBlobFile(w http.ResponseWriter, r *http.Request, blobId string, meta *blobMetadata) {
+	f, err := os.Open(meta.LocalFsLocation)
+	if err != nil {
+		log.Errorf("apiReturnBlobData error read file: %v, %v", meta.LocalFsLocation, err)
+		a.writeInternalError(w, err.Error())
+		return
+	}
+	defer f.Close()
+	modTime := meta.DownloadedAt
+	if modTime.IsZero() {
+		if fi, err := f.Stat(); err == nil {
+			modTime = fi.ModTime()
+		}
+	}
+	contentType := meta.ContentType
+	if contentType == "" {
+		contentType = headerSteam
+	}
+	w.Header().Set("Content-Type", contentType)
+	if meta.Digest != "" {
+		w.Header().Set("ETag", `"`+meta.Digest+`"`)
+	}
+	http.ServeContent(w, r, "", modTime, f)
+	a.recordBlobServed(blobId, meta)
+}
+
+// the last time a blob was served is recorded with this resolution, so that gateways fetching the same blob
+// don't each cost a db write
+const blobServedInterval = 5 * time.Minute
+
+// recordBlobServed updates the last time the blob was served, at most once per blobServedInterval
+func (a *apiManager) recordBlobServed(blobId string, meta *blobMetadata) {
+	now := time.Now()
+	a.servedMux.Lock()
+	last, ok := a.servedAt[blobId]
+	if !ok {
+		last = meta.LastServedAt
+	}
+	if now.Sub(last) < blobServedInterval {
+		a.servedMux.Unlock()
+		return
+	}
+	if a.servedAt == nil {
+		a.servedAt = make(map[string]time.Time)
+	}
+	for id, t := range a.servedAt {
+		if now.Sub(t) >= blobServedInterval {
+			delete(a.servedAt, id)
+		}
+	}
+	a.servedAt[blobId] = now
+	a.servedMux.Unlock()
+
+	// not on critical path, and not worth delaying the response
+	go a.dbMan.updateBlobServed(blobId, now)
+}
+
+// returnBlobOnDemand handles a request for a blob of a configuration which isn't downloaded yet:
+// the download is started or joined, and the blob is either streamed as it arrives,
+// or the client is asked to come back when the download is expected to complete.
+// It returns false if the request is left to the caller.
+func (a *apiManager) returnBlobOnDemand(w http.ResponseWriter, r *http.Request, blobId string) bool {
+	if a.bundleMan == nil || (a.blobOnDemandMode != blobOnDemandStream && a.blobOnDemandMode != blobOnDemandRetry) {
+		return false
+	}
+	referenced, err := a.dbMan.isBlobReferenced(blobId)
 	if err != nil {
-		log.Errorf("apiReturnBlobData error read file: %v, %v", fs, err)
+		log.Errorf("apiReturnBlobData error from db: %v", err)
 		a.writeInternalError(w, err.Error())
+		return true
+	}
+	if !referenced {
+		return false
+	}
+
+	progress := a.bundleMan.fetchBlob(blobId)
+	if a.blobOnDemandMode == blobOnDemandRetry {
+		a.writeRetryLater(w, progress.estimateRemaining())
+		return true
+	}
+
+	switch err = streamBlob(w, r, progress, a.blobStallTimeout, a.verifyBlobs); err {
+	case nil:
+	case errBlobAvailable:
+		meta, err := a.dbMan.getBlobMetadata(blobId)
+		if err != nil {
+			log.Errorf("apiReturnBlobData error from db: %v", err)
+			a.writeInternalError(w, "BlobId "+blobId+" has no mapping blob file")
+			return true
+		}
+		a.writeBlobFile(w, r, blobId, meta)
+	default:
+		log.Debugf("unable to stream blobId=%s: %v", blobId, err)
+		a.writeRetryLater(w, progress.estimateRemaining())
+	}
+	return true
+}
+
+// apiGetHealth reports DEGRADED while the circuit breaker of the blob server isn't closed.
+// Configurations and downloaded blobs are still served, so the status code stays 200.
+func (a *apiManager) apiGetHealth(w http.ResponseWriter, r *http.Request) {
+	status := a.bundleMan.status()
+	h := healthResponse{
+		Status:     healthStatusUp,
+		BlobServer: status.BlobServer,
+	}
+	if status.BlobServer.State != breakerClosed {
+		h.Status = healthStatusDegraded
+	}
+	a.writeJson(w, h)
+}
+
+func (a *apiManager) apiGetMetrics(w http.ResponseWriter, r *http.Request) {
+	a.writeJson(w, a.bundleMan.status())
+}
+
+func (a *apiManager) apiGetBandwidth(w http.ResponseWriter, r *http.Request) {
+	a.writeJson(w, a.bundleMan.getBandwidthLimits())
+}
+
+// apiSetBandwidth replaces the bandwidth limits of blob downloads, until the next restart
+func (a *apiManager) apiSetBandwidth(w http.ResponseWriter, r *http.Request) {
+	limits := bandwidthLimits{}
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		a.writeError(w, http.StatusBadRequest, API_ERR_BAD_REQUEST, "invalid bandwidth limits: "+err.Error())
+		return
+	}
+	if err := a.bundleMan.setBandwidthLimits(limits); err != nil {
+		a.writeError(w, http.StatusBadRequest, API_ERR_BAD_REQUEST, err.Error())
+		return
+	}
+	a.writeJson(w, a.bundleMan.getBandwidthLimits())
+}
+
+func (a *apiManager) apiGetWorkers(w http.ResponseWriter, r *http.Request) {
+	a.writeJson(w, a.bundleMan.getWorkerPool())
+}
+
+// apiSetWorkers resizes the download worker pool or changes its mode, until the next restart.
+// Fields missing from the request keep their current value.
+func (a *apiManager) apiSetWorkers(w http.ResponseWriter, r *http.Request) {
+	s := a.bundleMan.getWorkerPool()
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		a.writeError(w, http.StatusBadRequest, API_ERR_BAD_REQUEST, "invalid worker pool: "+err.Error())
 		return
 	}
-	_, err = io.Copy(w, bytes.NewReader(byte))
+	if err := a.bundleMan.setWorkerPool(s); err != nil {
+		a.writeError(w, http.StatusBadRequest, API_ERR_BAD_REQUEST, err.Error())
+		return
+	}
+	a.writeJson(w, a.bundleMan.getWorkerPool())
+}
+
+// apiGetDownloads reports the bytes received and expected of the active downloads
+func (a *apiManager) apiGetDownloads(w http.ResponseWriter, r *http.Request) {
+	a.writeJson(w, a.bundleMan.getProgress())
+}
+
+func (a *apiManager) writeJson(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
 	if err != nil {
-		log.Errorf("apiReturnBlobData error copy file: %v, %v", fs, err)
+		log.Errorf("unable to marshal response: %v", err)
 		a.writeInternalError(w, err.Error())
+		return
 	}
-	w.Header().Set("Content-Type", headerSteam)
+	w.Header().Set("Content-Type", headerJson)
+	w.Write(b)
+}
 
+func (a *apiManager) writeRetryLater(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int64((retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	a.writeError(w, http.StatusServiceUnavailable, API_ERR_BLOB_NOT_READY, "blob download in progress")
 }
 
 func (a *apiManager) apiHandleConfigId(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	configId := vars["configId"]
 	config, err := a.dbMan.getConfigById(configId)
+	if err != nil && err != sql.ErrNoRows {
+		log.Errorf("apiHandleConfigId: %v", err)
+		a.writeInternalError(w, err.Error())
+		return
+	}
+	var current []Configuration
+	if err == nil {
+		current = []Configuration{*config}
+	}
+	details := a.pinnedDetails(current, configId, "")
+	if len(details) == 0 {
+		a.writeError(w, http.StatusNotFound, API_ERR_NOT_FOUND, "cannot find the configuration")
+		return
+	}
+	configDetail := details[0]
+	if configDetail.Pinned == nil {
+		a.setDownloadProgress(&configDetail, config)
+	}
+	// the progress of downloads changes on every request
+	if configDetail.Status != configStatusDownloading && a.checkNotModified(w, r, configETag(&configDetail)) {
+		return
+	}
+
+	b, err := json.Marshal(configDetail)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			a.writeError(w, http.StatusNotFound, API_ERR_NOT_FOUND, "cannot find the configuration")
-		} else {
-			log.Errorf("apiHandleConfigId: %v", err)
-			a.writeInternalError(w, err.Error())
-		}
+		log.Errorf("unable to marshal config: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	configDetail := ApiConfigurationDetails{
-		Self:            getHttpHost() + a.configurationEndpoint + "/" + config.ID,
+	log.Debugf("sending configuration %s", b)
+	w.Header().Set("Content-Type", headerJson)
+	w.Write(b)
+}
+
+func newApiConfigurationDetails(configurationsUrl string, config *Configuration) ApiConfigurationDetails {
+	return ApiConfigurationDetails{
+		Self:            configurationsUrl + "/" + config.ID,
 		Name:            config.Name,
 		Type:            config.Type,
 		Revision:        config.Revision,
@@ -232,16 +524,208 @@ func (a *apiManager) apiHandleConfigId(w http.ResponseWriter, r *http.Request) {
 		Created:         convertTime(config.Created),
 		Updated:         convertTime(config.Updated),
 	}
+}
 
-	b, err := json.Marshal(configDetail)
+// pinnedDetails returns the details of the current configurations, with pinned revisions in place of the current ones.
+// Pinned configurations that were deleted since are added if they match configId and typeFilter, when given.
+func (a *apiManager) pinnedDetails(current []Configuration, configId, typeFilter string) []ApiConfigurationDetails {
+	configurationsUrl := getHttpHost() + a.configurationEndpoint
+	pinList, err := a.dbMan.getConfigPins()
 	if err != nil {
-		log.Errorf("unable to marshal config: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		log.Errorf("unable to get configuration pins: %v", err)
+	}
+	pins := make(map[string]*configPin, len(pinList))
+	for i := range pinList {
+		pins[pinList[i].ID] = &pinList[i]
+	}
+	details := make([]ApiConfigurationDetails, 0, len(current))
+	for i := range current {
+		if pin := pins[current[i].ID]; pin != nil {
+			details = append(details, a.pinDetails(configurationsUrl, pin, current[i].Revision))
+			delete(pins, pin.ID)
+		} else {
+			details = append(details, newApiConfigurationDetails(configurationsUrl, &current[i]))
+		}
+	}
+	for i := range pinList {
+		pin := &pinList[i]
+		if pins[pin.ID] != nil && (configId == "" || pin.ID == configId) && (typeFilter == "" || pin.Type == typeFilter) {
+			details = append(details, a.pinDetails(configurationsUrl, pin, ""))
+		}
+	}
+	return details
+}
+
+func (a *apiManager) pinDetails(configurationsUrl string, pin *configPin, currentRevision string) ApiConfigurationDetails {
+	log.Infof("serving configuration %s pinned to revision %q (config index %s), current revision is %q",
+		pin.ID, pin.Revision, pin.Lsn, currentRevision)
+	detail := newApiConfigurationDetails(configurationsUrl, &pin.Configuration)
+	detail.Pinned = &ApiConfigurationPin{
+		ConfigIndex:     pin.Lsn,
+		PinnedAt:        formatDbTime(pin.PinnedAt),
+		CurrentRevision: currentRevision,
+	}
+	return detail
+}
+
+// apiGetPins returns the pinned configurations
+func (a *apiManager) apiGetPins(w http.ResponseWriter, r *http.Request) {
+	pins, err := a.dbMan.getConfigPins()
+	if err != nil {
+		log.Errorf("apiGetPins: %v", err)
+		a.writeInternalError(w, err.Error())
 		return
 	}
-	log.Debugf("sending configuration %s", b)
-	w.Header().Set("Content-Type", headerJson)
-	w.Write(b)
+	configurationsUrl := getHttpHost() + a.configurationEndpoint
+	details := make([]ApiConfigurationDetails, 0, len(pins))
+	for i := range pins {
+		var currentRevision string
+		if config, err := a.dbMan.getConfigById(pins[i].ID); err == nil {
+			currentRevision = config.Revision
+		}
+		details = append(details, a.pinDetails(configurationsUrl, &pins[i], currentRevision))
+	}
+	a.writeJson(w, ApiConfigurationResponse{
+		Kind:                      kindCollection,
+		Self:                      getHttpHost() + a.pinsEndpoint,
+		ApiConfigurationsResponse: details,
+	})
+}
+
+// apiSetPin pins a configuration to the newest revision seen with the requested revision and/or config index.
+// The blobs of the revision must be available.
+func (a *apiManager) apiSetPin(w http.ResponseWriter, r *http.Request) {
+	configId := mux.Vars(r)["configId"]
+	req := pinRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Revision == "" && req.ConfigIndex == "") {
+		a.writeError(w, http.StatusBadRequest, API_ERR_BAD_REQUEST, "revision or configIndex is required")
+		return
+	}
+	if req.ConfigIndex != "" && !isValidConfigIndex(req.ConfigIndex) {
+		a.writeError(w, http.StatusBadRequest, API_ERR_BAD_REQUEST, "configIndex is invalid")
+		return
+	}
+	revisions, err := a.dbMan.getConfigHistory(configId)
+	if err != nil {
+		log.Errorf("apiSetPin: %v", err)
+		a.writeInternalError(w, err.Error())
+		return
+	}
+	var pin *configPin
+	for _, rev := range revisions {
+		if (req.Revision == "" || rev.Revision == req.Revision) && (req.ConfigIndex == "" || rev.Lsn == req.ConfigIndex) {
+			pin = &configPin{Configuration: rev.Configuration, Lsn: rev.Lsn, PinnedAt: time.Now()}
+			break
+		}
+	}
+	if pin == nil {
+		a.writeError(w, http.StatusNotFound, API_ERR_NOT_FOUND, "cannot find the revision")
+		return
+	}
+	for _, blobId := range []string{pin.BlobID, pin.BlobResourceID} {
+		if blobId == "" {
+			continue
+		}
+		if _, err := a.dbMan.getLocalFSLocation(blobId); err == sql.ErrNoRows {
+			a.writeError(w, http.StatusConflict, API_ERR_BLOB_NOT_READY, "blob of the revision is not available: "+blobId)
+			return
+		} else if err != nil {
+			log.Errorf("apiSetPin: %v", err)
+			a.writeInternalError(w, err.Error())
+			return
+		}
+	}
+	if err = a.dbMan.pinConfiguration(pin); err != nil {
+		a.writeInternalError(w, err.Error())
+		return
+	}
+	log.Warnf("configuration %s pinned to revision %q (config index %s)", configId, pin.Revision, pin.Lsn)
+	a.notifyNewChange()
+
+	var currentRevision string
+	if config, err := a.dbMan.getConfigById(configId); err == nil {
+		currentRevision = config.Revision
+	}
+	a.writeJson(w, a.pinDetails(getHttpHost()+a.configurationEndpoint, pin, currentRevision))
+}
+
+// apiDeletePin removes the pin of a configuration, the current revision is served again
+func (a *apiManager) apiDeletePin(w http.ResponseWriter, r *http.Request) {
+	configId := mux.Vars(r)["configId"]
+	pin, err := a.dbMan.unpinConfiguration(configId)
+	if err != nil {
+		log.Errorf("apiDeletePin: %v", err)
+		a.writeInternalError(w, err.Error())
+		return
+	}
+	if pin == nil {
+		a.writeError(w, http.StatusNotFound, API_ERR_NOT_FOUND, "configuration is not pinned")
+		return
+	}
+	log.Warnf("configuration %s unpinned from revision %q (config index %s)", configId, pin.Revision, pin.Lsn)
+	a.notifyNewChange()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiGetConfigHistory returns the revisions of a configuration seen by this apid, newest first
+func (a *apiManager) apiGetConfigHistory(w http.ResponseWriter, r *http.Request) {
+	configId := mux.Vars(r)["configId"]
+	revisions, err := a.dbMan.getConfigHistory(configId)
+	if err != nil {
+		log.Errorf("apiGetConfigHistory: %v", err)
+		a.writeInternalError(w, err.Error())
+		return
+	}
+	if len(revisions) == 0 {
+		a.writeError(w, http.StatusNotFound, API_ERR_NOT_FOUND, "cannot find the configuration")
+		return
+	}
+	configurationsUrl := getHttpHost() + a.configurationEndpoint
+	res := ApiConfigurationHistoryResponse{
+		Kind:      kindCollection,
+		Self:      configurationsUrl + "/" + configId + "/history",
+		Revisions: make([]ApiConfigurationRevision, 0, len(revisions)),
+	}
+	for i := range revisions {
+		rev := &revisions[i]
+		res.Revisions = append(res.Revisions, ApiConfigurationRevision{
+			ApiConfigurationDetails: newApiConfigurationDetails(configurationsUrl, &rev.Configuration),
+			ConfigIndex:             rev.Lsn,
+			SeenAt:                  formatDbTime(rev.SeenAt),
+			ReplacedConfigIndex:     rev.ReplacedLsn,
+			ReplacedAt:              formatDbTime(rev.ReplacedAt),
+			Deleted:                 rev.Deleted,
+		})
+	}
+	a.writeJson(w, res)
+}
+
+// setDownloadProgress marks the configuration as downloading if any of its blobs isn't available yet,
+// and adds the progress of the ones being downloaded
+func (a *apiManager) setDownloadProgress(detail *ApiConfigurationDetails, config *Configuration) {
+	if a.bundleMan == nil {
+		return
+	}
+	pending := make(map[string]bool)
+	for _, blobId := range []string{config.BlobID, config.BlobResourceID} {
+		if blobId == "" {
+			continue
+		}
+		if _, err := a.dbMan.getLocalFSLocation(blobId); err == sql.ErrNoRows {
+			pending[blobId] = true
+		} else if err != nil {
+			log.Errorf("apiHandleConfigId error from db: %v", err)
+		}
+	}
+	if len(pending) == 0 {
+		return
+	}
+	detail.Status = configStatusDownloading
+	for _, p := range a.bundleMan.getProgress() {
+		if pending[p.BlobId] {
+			detail.Progress = append(detail.Progress, p)
+		}
+	}
 }
 
 // If not long-polling, return configurations, status = 200
@@ -249,12 +733,16 @@ func (a *apiManager) apiHandleConfigId(w http.ResponseWriter, r *http.Request) {
 // If both "block" and "apid-config-index" are given:
 // if apid's LSN > apid-config-index in header, return immediately with status = 200
 // if apid's LSN <= apid-config-index, long polling for timeout=block secs
+// apid-config-index of another snapshot epoch is always behind, see compareConfigIndex
 func (a *apiManager) apiGetCurrentConfigs(w http.ResponseWriter, r *http.Request) {
 	blockSec := r.URL.Query().Get("block")
 	typeFilter := r.URL.Query().Get("type")
-	headerLSN := r.URL.Query().Get(apidConfigIndexPar)
+	headerLSN, err := a.configIndexFromRequest(r)
+	if err != nil {
+		a.writeError(w, http.StatusBadRequest, API_ERR_BAD_REQUEST, err.Error())
+		return
+	}
 	var timeout int
-	var err error
 	if blockSec != "" {
 		timeout, err = strconv.Atoi(blockSec)
 		if err != nil || timeout < 0 {
@@ -262,18 +750,26 @@ func (a *apiManager) apiGetCurrentConfigs(w http.ResponseWriter, r *http.Request
 			return
 		}
 	}
+	if asOf := r.URL.Query().Get(apidAsOfPar); asOf != "" {
+		if blockSec != "" || headerLSN != "" {
+			a.writeError(w, http.StatusBadRequest, API_ERR_BAD_REQUEST, apidAsOfPar+" can't be combined with long-polling")
+			return
+		}
+		a.sendConfigurationsAsOf(w, asOf, typeFilter)
+		return
+	}
 	log.Debugf("/configurations long-poll timeout: %d", timeout)
 
 	log.Debugf("Long-Poll-Index: %s", headerLSN)
 
 	// if filter by "type"
 	if typeFilter != "" {
-		a.sendReadyConfigurations(typeFilter, w, "")
+		a.sendReadyConfigurations(typeFilter, w, r)
 		return
 	}
 
 	// if no filter, check for long polling
-	cmpRes, apidLSN, err := a.compareLSN(headerLSN)
+	cmpRes, err := a.compareConfigIndex(headerLSN)
 	switch {
 	case err != nil:
 		if err == ErrInvalidLSN {
@@ -287,16 +783,23 @@ func (a *apiManager) apiGetCurrentConfigs(w http.ResponseWriter, r *http.Request
 		if timeout == 0 { // no long polling
 			w.WriteHeader(http.StatusNotModified)
 		} else { // long polling
-			util.LongPolling(w, time.Duration(timeout)*time.Second, a.addSubscriber, a.LongPollSuccessHandler, a.LongPollTimeoutHandler)
+			success := func(c interface{}, w http.ResponseWriter) {
+				a.LongPollSuccessHandler(c, w, r)
+			}
+			util.LongPolling(w, time.Duration(timeout)*time.Second, a.addSubscriber, success, a.LongPollTimeoutHandler)
 		}
 		return
 	case cmpRes > 0: //APID_LSN > Header_LSN
-		a.sendReadyConfigurations("", w, apidLSN)
+		if a.isSupersededIndex(headerLSN) {
+			// the configurations were replaced by a snapshot since the client's index
+			w.Header().Set(apidConfigSupersededHeader, "true")
+		}
+		a.sendReadyConfigurations("", w, r)
 		return
 	}
 }
 
-func (a *apiManager) LongPollSuccessHandler(c interface{}, w http.ResponseWriter) {
+func (a *apiManager) LongPollSuccessHandler(c interface{}, w http.ResponseWriter, r *http.Request) {
 	// send configs and LSN
 	confChange, ok := c.(*confChangeNotification)
 	if !ok || confChange.err != nil {
@@ -304,7 +807,7 @@ func (a *apiManager) LongPollSuccessHandler(c interface{}, w http.ResponseWriter
 		a.writeInternalError(w, "Error getting configurations with long-polling")
 		return
 	}
-	a.sendDeployments(w, confChange.confs, confChange.LSN, "")
+	a.sendDeployments(w, r, confChange.snapshot, confChange.confs, confChange.LSN, "")
 }
 
 func (a *apiManager) LongPollTimeoutHandler(w http.ResponseWriter) {
@@ -312,60 +815,226 @@ func (a *apiManager) LongPollTimeoutHandler(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusNotModified)
 }
 
-func (a *apiManager) sendReadyConfigurations(typeFilter string, w http.ResponseWriter, apidLSN string) {
-	configurations, err := a.dbMan.getAllConfigurations(typeFilter)
+func (a *apiManager) sendReadyConfigurations(typeFilter string, w http.ResponseWriter, r *http.Request) {
+	configurations, lsn, snapshot, err := a.currentConfigurations(typeFilter)
 	if err != nil {
 		log.Errorf("Database error: %v", err)
 		a.writeInternalError(w, fmt.Sprintf("Database error: %s", err.Error()))
 		return
 	}
-	a.sendDeployments(w, configurations, apidLSN, typeFilter)
+	a.sendDeployments(w, r, snapshot, configurations, lsn, typeFilter)
 }
 
-func (a *apiManager) sendDeployments(w http.ResponseWriter, dataConfs []Configuration, apidLSN string, typeFilter string) {
+// sendConfigurationsAsOf sends the configurations that were current at the config index asOf
+func (a *apiManager) sendConfigurationsAsOf(w http.ResponseWriter, asOf string, typeFilter string) {
+	if !isValidConfigIndex(asOf) {
+		a.writeError(w, http.StatusBadRequest, API_ERR_BAD_REQUEST, apidAsOfPar+" is invalid")
+		return
+	}
+	if cmpRes, err := compareConfigIndexes(asOf, formatConfigIndex(a.dbMan.getEpoch(), a.dbMan.getLSN())); err != nil {
+		log.Errorf("Error in compareConfigIndexes: %v", err)
+		a.writeInternalError(w, err.Error())
+		return
+	} else if cmpRes > 0 {
+		a.writeError(w, http.StatusBadRequest, API_ERR_BAD_REQUEST, apidAsOfPar+" is ahead of apid's config index")
+		return
+	}
+	configurations, err := a.dbMan.getConfigurationsAsOf(asOf, typeFilter)
+	if err == errHistoryUnavailable {
+		a.writeError(w, http.StatusGone, API_ERR_NOT_FOUND, err.Error())
+		return
+	} else if err != nil {
+		log.Errorf("Database error: %v", err)
+		a.writeInternalError(w, fmt.Sprintf("Database error: %s", err.Error()))
+		return
+	}
+	query := "?" + apidAsOfPar + "=" + asOf
+	if typeFilter != "" {
+		query += "&type=" + typeFilter
+	}
+	// the history isn't affected by pins
+	configurationsUrl := getHttpHost() + a.configurationEndpoint
+	details := make([]ApiConfigurationDetails, 0, len(configurations))
+	for i := range configurations {
+		details = append(details, newApiConfigurationDetails(configurationsUrl, &configurations[i]))
+	}
+	a.writeConfigurations(w, details, "", query)
+}
 
-	apiConfs := ApiConfigurationResponse{}
-	apiConfDetails := make([]ApiConfigurationDetails, 0)
+// sendDeployments sends the configurations of the snapshot at the config index lsn, gzip compressed if enabled
+// and accepted by the client. The response is cached per snapshot, unless snapshot is nil.
+// The config index header is only sent for unfiltered listings, which support long-polling.
+func (a *apiManager) sendDeployments(w http.ResponseWriter, r *http.Request, snapshot *configSnapshot, dataConfs []Configuration, lsn string, typeFilter string) {
+	query := ""
+	apidLSN := lsn
+	if typeFilter != "" {
+		query = "?type=" + typeFilter
+		apidLSN = ""
+	}
+	encoding := ""
+	if a.gzipResponses {
+		w.Header().Set("Vary", "Accept-Encoding")
+		if acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			encoding = encodingGzip
+		}
+	}
+	generate := func() ([]byte, error) {
+		b, err := a.marshalConfigurations(a.pinnedDetails(dataConfs, "", typeFilter), query)
+		if err == nil && encoding == encodingGzip {
+			b, err = gzipBytes(b)
+		}
+		return b, err
+	}
 
-	apiConfs.Kind = kindCollection
-	apiConfs.Self = getHttpHost() + a.configurationEndpoint
-
-	for _, d := range dataConfs {
-		apiConfDetails = append(apiConfDetails, ApiConfigurationDetails{
-			Self:            apiConfs.Self + "/" + d.ID,
-			Name:            d.Name,
-			Type:            d.Type,
-			Revision:        d.Revision,
-			BeanBlobUrl:     getBlobUrl(d.BlobID),
-			Org:             d.OrgID,
-			Env:             d.EnvID,
-			ResourceBlobUrl: getBlobUrl(d.BlobResourceID),
-			Path:            d.Path,
-			Created:         convertTime(d.Created),
-			Updated:         convertTime(d.Updated),
-		})
+	var body []byte
+	var err error
+	// responses depend on pins, which change without the snapshot
+	if pins, pinsErr := a.dbMan.getConfigPins(); pinsErr != nil {
+		// served without pins, neither identified nor cached
+		body, err = generate()
+	} else {
+		key := responseCacheKey(typeFilter, encoding, pins)
+		if a.checkNotModified(w, r, contentETag(lsn, key)) {
+			return
+		}
+		if snapshot != nil && a.responseCache != nil {
+			body, err = a.responseCache.get(snapshot, key, generate)
+		} else {
+			body, err = generate()
+		}
 	}
-	apiConfs.ApiConfigurationsResponse = apiConfDetails
+	if err != nil {
+		log.Errorf("unable to marshal deployments: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	a.writeConfigurationsBody(w, body, apidLSN)
+}
 
-	if typeFilter != "" {
-		apiConfs.Self += "?type=" + typeFilter
+// configETag identifies a configuration by its revision and blobs, and the pin serving it if any
+func configETag(detail *ApiConfigurationDetails) string {
+	values := []string{detail.Self, detail.Revision, detail.BeanBlobUrl, detail.ResourceBlobUrl}
+	if p := detail.Pinned; p != nil {
+		values = append(values, p.ConfigIndex, p.PinnedAt, p.CurrentRevision)
 	}
+	return contentETag(values...)
+}
 
-	b, err := json.Marshal(apiConfs)
+// contentETag returns a strong ETag of the values identifying the content of a response
+func contentETag(values ...string) string {
+	h := sha256.New()
+	for _, v := range values {
+		io.WriteString(h, v)
+		h.Write([]byte{0})
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// checkNotModified sets the ETag of the response, and sends 304 if the request's If-None-Match matches it
+func (a *apiManager) checkNotModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	if !etagMatches(r.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+	log.Debugf("%s not modified, ETag %s", r.URL.Path, etag)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches compares the ETags of If-None-Match to etag, with the weak comparison of RFC 7232
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || (tag != "" && tag == strings.TrimPrefix(etag, "W/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeConfigurations sends the configuration details, selfQuery is the query string of the listing's self url
+func (a *apiManager) writeConfigurations(w http.ResponseWriter, apiConfDetails []ApiConfigurationDetails, apidLSN string, selfQuery string) {
+	b, err := a.marshalConfigurations(apiConfDetails, selfQuery)
 	if err != nil {
 		log.Errorf("unable to marshal deployments: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	a.writeConfigurationsBody(w, b, apidLSN)
+}
+
+func (a *apiManager) marshalConfigurations(apiConfDetails []ApiConfigurationDetails, selfQuery string) ([]byte, error) {
+	apiConfs := ApiConfigurationResponse{}
+	apiConfs.Kind = kindCollection
+	apiConfs.Self = getHttpHost() + a.configurationEndpoint + selfQuery
+	apiConfs.ApiConfigurationsResponse = apiConfDetails
+	return json.Marshal(apiConfs)
+}
 
+func (a *apiManager) writeConfigurationsBody(w http.ResponseWriter, b []byte, apidLSN string) {
 	if apidLSN != "" {
 		w.Header().Set(apidConfigIndexHeader, apidLSN)
+		if a.cursors != nil {
+			w.Header().Set(apidConfigCursorHeader, a.cursors.encode(apidLSN))
+		}
 	}
 	w.Header().Set("Content-Type", headerJson)
 	log.Debugf("sending deployments %s", apidLSN)
 	w.Write(b)
 }
 
+// configIndexFromRequest returns the config index of the request, from the query parameter,
+// or from the x-apid-config-index header if the parameter isn't given.
+// Cursors are verified, and replaced by their config index. ErrInvalidCursor is returned for a cursor
+// that fails verification, e.g. one forged, or signed before a restart with a random key.
+func (a *apiManager) configIndexFromRequest(r *http.Request) (string, error) {
+	index := r.URL.Query().Get(apidConfigIndexPar)
+	if index == "" {
+		index = r.Header.Get(apidConfigIndexHeader)
+	}
+	if !isCursor(index) {
+		return index, nil
+	}
+	if a.cursors == nil {
+		return "", ErrInvalidCursor
+	}
+	cursor, err := a.cursors.decode(index)
+	if err != nil {
+		log.Debugf("invalid cursor %s: %v", index, err)
+		return "", err
+	}
+	return cursor.Index, nil
+}
+
+// isSupersededIndex tells if the client's config index is of another snapshot epoch than apid's,
+// or has none once apid has one
+func (a *apiManager) isSupersededIndex(index string) bool {
+	epoch, _, err := parseConfigIndex(index)
+	return err == nil && index != "" && epoch != a.dbMan.getEpoch()
+}
+
+// compareConfigIndex compares apid's config index to the client's index.
+// An index of another snapshot epoch, or without epoch once apid has one, is always behind apid's.
+func (a *apiManager) compareConfigIndex(index string) (int, error) {
+	epoch, lsn, err := parseConfigIndex(index)
+	if err != nil {
+		log.Debugf("Error when Parse config index: %v", err)
+		return 0, err
+	}
+	if index != "" && epoch != a.dbMan.getEpoch() {
+		if _, err = common.ParseSequence(lsn); err != nil {
+			return 0, ErrInvalidLSN
+		}
+		log.Debugf("config index %s is of another snapshot epoch", index)
+		return 1, nil
+	}
+	res, _, err := a.compareLSN(lsn)
+	return res, err
+}
+
 func (a *apiManager) compareLSN(headerLSN string) (res int, apidLSN string, err error) {
 	apidLSN = a.dbMan.getLSN()
 	log.Debugf("apidLSN: %v", apidLSN)
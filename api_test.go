@@ -14,16 +14,19 @@
 package apiGatewayConfDeploy
 
 import (
+	"compress/gzip"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"github.com/apid/apid-core/util"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"io"
 	"io/ioutil"
 	mathrand "math/rand"
 	"net/http"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -49,6 +52,13 @@ var _ = Describe("api", func() {
 			configurationEndpoint:   configEndpoint + strconv.Itoa(testCount),
 			blobEndpoint:            blobEndpointPath + strconv.Itoa(testCount) + "/{blobId}",
 			configurationIdEndpoint: configEndpoint + strconv.Itoa(testCount) + "/{configId}",
+			historyEndpoint:         configEndpoint + strconv.Itoa(testCount) + "/{configId}/history",
+			healthEndpoint:          healthEndpoint + strconv.Itoa(testCount),
+			metricsEndpoint:         metricsEndpoint + strconv.Itoa(testCount),
+			bandwidthEndpoint:       bandwidthEndpoint + strconv.Itoa(testCount),
+			workersEndpoint:         workersEndpoint + strconv.Itoa(testCount),
+			downloadsEndpoint:       downloadsEndpoint + strconv.Itoa(testCount),
+			pinsEndpoint:            pinsEndpoint + strconv.Itoa(testCount),
 			newChangeListChan:       make(chan interface{}, 5),
 			addSubscriber:           make(chan chan interface{}),
 		}
@@ -223,6 +233,99 @@ var _ = Describe("api", func() {
 			Expect(res.StatusCode).To(Equal(http.StatusNotModified))
 		})
 
+		It("should accept the config index as a header, the query parameter first", func() {
+			path := apiTestUrl + configEndpoint + strconv.Itoa(testCount)
+			setTestDeployments(dummyDbMan, path)
+			get := func(query, header string) int {
+				req, err := http.NewRequest("GET", path+query, nil)
+				Expect(err).Should(Succeed())
+				if header != "" {
+					req.Header.Set(apidConfigIndexHeader, header)
+				}
+				res, err := http.DefaultClient.Do(req)
+				Expect(err).Should(Succeed())
+				res.Body.Close()
+				return res.StatusCode
+			}
+			Expect(get("", dummyDbMan.lsn)).Should(Equal(http.StatusNotModified))
+			Expect(get("", "0.0.1")).Should(Equal(http.StatusOK))
+			Expect(get("", "invalid")).Should(Equal(http.StatusBadRequest))
+			Expect(get("?"+apidConfigIndexPar+"=0.0.1", dummyDbMan.lsn)).Should(Equal(http.StatusOK))
+			Expect(get("?"+apidConfigIndexPar+"="+dummyDbMan.lsn, "0.0.1")).Should(Equal(http.StatusNotModified))
+		})
+
+		It("should qualify the config index with the snapshot epoch", func() {
+			path := apiTestUrl + configEndpoint + strconv.Itoa(testCount)
+			setTestDeployments(dummyDbMan, path)
+			dummyDbMan.epoch = 5
+			get := func(query string) *http.Response {
+				res, err := http.Get(path + query)
+				Expect(err).Should(Succeed())
+				res.Body.Close()
+				return res
+			}
+			res := get("")
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			index := res.Header.Get(apidConfigIndexHeader)
+			Expect(index).Should(Equal("5-" + dummyDbMan.lsn))
+			Expect(res.Header.Get(apidConfigSupersededHeader)).Should(BeEmpty())
+			Expect(get("?" + apidConfigIndexPar + "=" + index).StatusCode).Should(Equal(http.StatusNotModified))
+			res = get("?" + apidConfigIndexPar + "=5-0.0.1")
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			Expect(res.Header.Get(apidConfigSupersededHeader)).Should(BeEmpty())
+
+			// indexes of other epochs, or without epoch, are behind whatever their LSN, and marked superseded
+			for _, query := range []string{"=4-100.0.0&block=10", "=6-" + dummyDbMan.lsn, "=100.0.0"} {
+				res = get("?" + apidConfigIndexPar + query)
+				Expect(res.StatusCode).Should(Equal(http.StatusOK), query)
+				Expect(res.Header.Get(apidConfigSupersededHeader)).Should(Equal("true"), query)
+			}
+			Expect(get("?" + apidConfigIndexPar + "=x-" + dummyDbMan.lsn).StatusCode).Should(Equal(http.StatusBadRequest))
+			Expect(get("?" + apidConfigIndexPar + "=4-invalid").StatusCode).Should(Equal(http.StatusBadRequest))
+		})
+
+		It("should accept signed cursors of the same snapshot epoch", func() {
+			path := apiTestUrl + configEndpoint + strconv.Itoa(testCount)
+			setTestDeployments(dummyDbMan, path)
+			dummyDbMan.epoch = 5
+			var err error
+			testApiMan.cursors, err = newCursorSigner("secret")
+			Expect(err).Should(Succeed())
+			defer func() {
+				testApiMan.cursors = nil
+			}()
+
+			res, err := http.Get(path)
+			Expect(err).Should(Succeed())
+			res.Body.Close()
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			cursor := res.Header.Get(apidConfigCursorHeader)
+			Expect(isCursor(cursor)).Should(BeTrue())
+
+			get := func(index string) *http.Response {
+				req, err := http.NewRequest("GET", path, nil)
+				Expect(err).Should(Succeed())
+				req.Header.Set(apidConfigIndexHeader, index)
+				res, err := http.DefaultClient.Do(req)
+				Expect(err).Should(Succeed())
+				res.Body.Close()
+				return res
+			}
+			Expect(get(cursor).StatusCode).Should(Equal(http.StatusNotModified))
+			// cursors failing verification, tampered or signed with another secret, are rejected
+			Expect(get(cursor + "x").StatusCode).Should(Equal(http.StatusBadRequest))
+			other, err := newCursorSigner("other")
+			Expect(err).Should(Succeed())
+			Expect(get(other.encode(formatConfigIndex(5, dummyDbMan.lsn))).StatusCode).Should(Equal(http.StatusBadRequest))
+
+			// cursors of a previous snapshot epoch are behind, and marked superseded
+			dummyDbMan.startSnapshotEpoch()
+			res = get(cursor)
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			Expect(res.Header.Get(apidConfigSupersededHeader)).Should(Equal("true"))
+			Expect(res.Header.Get(apidConfigCursorHeader)).ShouldNot(Equal(cursor))
+		})
+
 		// block is not enabled now
 		It("should do long-polling if Gateway_LSN>=APID_LSN, should get 304 for timeout", func() {
 
@@ -366,6 +469,61 @@ var _ = Describe("api", func() {
 			}
 		})
 
+
+		It("should get configs as of a config index", func() {
+			uri, err := url.Parse(apiTestUrl)
+			Expect(err).Should(Succeed())
+			uri.Path = configEndpoint + strconv.Itoa(testCount)
+			details := setTestDeployments(dummyDbMan, uri.String())
+			uri.RawQuery = "asOf=0.0.5&type=ORGANIZATION"
+
+			res, err := http.Get(uri.String())
+			Expect(err).Should(Succeed())
+			defer res.Body.Close()
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			Expect(res.Header.Get(apidConfigIndexHeader)).Should(BeEmpty())
+			var depRes ApiConfigurationResponse
+			Expect(json.NewDecoder(res.Body).Decode(&depRes)).Should(Succeed())
+			Expect(depRes.Self).Should(Equal(uri.String()))
+			Expect(depRes.ApiConfigurationsResponse).Should(Equal(details))
+			Expect(dummyDbMan.asOf).Should(Equal("0.0.5"))
+
+			// config indexes are taken as sent in the header
+			dummyDbMan.epoch = 5
+			uri.RawQuery = "asOf=5-0.0.5"
+			res, err = http.Get(uri.String())
+			Expect(err).Should(Succeed())
+			res.Body.Close()
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			Expect(dummyDbMan.asOf).Should(Equal("5-0.0.5"))
+		})
+
+		It("should get error responses for invalid asOf", func() {
+			uri, err := url.Parse(apiTestUrl)
+			Expect(err).Should(Succeed())
+			uri.Path = configEndpoint + strconv.Itoa(testCount)
+			for _, query := range []string{
+				"asOf=invalid",
+				"asOf=x-0.0.5",
+				"asOf=0.2.0",
+				"asOf=1-0.0.5",
+				"asOf=0.0.5&block=1",
+				"asOf=0.0.5&" + apidConfigIndexPar + "=0.0.5",
+			} {
+				uri.RawQuery = query
+				res, err := http.Get(uri.String())
+				Expect(err).Should(Succeed())
+				res.Body.Close()
+				Expect(res.StatusCode).Should(Equal(http.StatusBadRequest), query)
+			}
+
+			dummyDbMan.err = errHistoryUnavailable
+			uri.RawQuery = "asOf=0.0.5"
+			res, err := http.Get(uri.String())
+			Expect(err).Should(Succeed())
+			res.Body.Close()
+			Expect(res.StatusCode).Should(Equal(http.StatusGone))
+		})
 	})
 
 	Context("GET /blobs", func() {
@@ -397,6 +555,56 @@ var _ = Describe("api", func() {
 			Expect(string(body)).Should(Equal(randString))
 		})
 
+		It("should send the headers from the blob metadata", func() {
+			uri, err := url.Parse(apiTestUrl)
+			Expect(err).Should(Succeed())
+			uri.Path = blobEndpointPath + strconv.Itoa(testCount) + "/test"
+			testFile, err := ioutil.TempFile(bundlePath, "test")
+			Expect(err).Should(Succeed())
+			content := util.GenerateUUID()
+			testFile.Write([]byte(content))
+			Expect(testFile.Close()).Should(Succeed())
+			downloadedAt := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+			dummyDbMan.localFSLocation = testFile.Name()
+			dummyDbMan.servedBlobs = make(chan string)
+			testApiMan.servedAt = nil
+			dummyDbMan.blobMeta = &blobMetadata{
+				Size:         int64(len(content)),
+				ContentType:  "application/zip",
+				Digest:       "0123abcd",
+				DownloadedAt: downloadedAt,
+			}
+
+			res, err := http.Get(uri.String())
+			Expect(err).Should(Succeed())
+			body, err := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			Expect(err).Should(Succeed())
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			Expect(string(body)).Should(Equal(content))
+			Expect(res.Header.Get("Content-Type")).Should(Equal("application/zip"))
+			Expect(res.Header.Get("Content-Length")).Should(Equal(strconv.Itoa(len(content))))
+			Expect(res.Header.Get("ETag")).Should(Equal(`"0123abcd"`))
+			Expect(res.Header.Get("Last-Modified")).Should(Equal(downloadedAt.Format(http.TimeFormat)))
+			Eventually(dummyDbMan.servedBlobs).Should(Receive(Equal("test")))
+
+			// recorded once per blobServedInterval
+			res, err = http.Get(uri.String())
+			Expect(err).Should(Succeed())
+			res.Body.Close()
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			Consistently(dummyDbMan.servedBlobs, 100*time.Millisecond).ShouldNot(Receive())
+
+			// cached by the client
+			req, err := http.NewRequest("GET", uri.String(), nil)
+			Expect(err).Should(Succeed())
+			req.Header.Set("If-None-Match", `"0123abcd"`)
+			res, err = http.DefaultClient.Do(req)
+			Expect(err).Should(Succeed())
+			res.Body.Close()
+			Expect(res.StatusCode).Should(Equal(http.StatusNotModified))
+		})
+
 		It("should get error response", func() {
 			// setup http client
 			uri, err := url.Parse(apiTestUrl)
@@ -425,6 +633,608 @@ var _ = Describe("api", func() {
 		})
 	})
 
+	Context("GET /blobs on demand", func() {
+		var dummyBundleMan *dummyBundleManager
+		var uri *url.URL
+
+		var _ = BeforeEach(func() {
+			var err error
+			uri, err = url.Parse(apiTestUrl)
+			Expect(err).Should(Succeed())
+			uri.Path = blobEndpointPath + strconv.Itoa(testCount) + "/" + util.GenerateUUID()
+			dummyDbMan.err = sql.ErrNoRows
+			dummyDbMan.blobReferenced = true
+			dummyBundleMan = &dummyBundleManager{
+				progress: newDownloadProgress(util.GenerateUUID()),
+			}
+			testApiMan.bundleMan = dummyBundleMan
+			testApiMan.blobStallTimeout = time.Second
+		})
+
+		It("should get 404 for unreferenced blobs", func() {
+			testApiMan.blobOnDemandMode = blobOnDemandRetry
+			dummyDbMan.blobReferenced = false
+			res, err := http.Get(uri.String())
+			Expect(err).Should(Succeed())
+			res.Body.Close()
+			Expect(res.StatusCode).Should(Equal(http.StatusNotFound))
+		})
+
+		It("should get 503 with Retry-After", func() {
+			testApiMan.blobOnDemandMode = blobOnDemandRetry
+			res, err := http.Get(uri.String())
+			Expect(err).Should(Succeed())
+			res.Body.Close()
+			Expect(res.StatusCode).Should(Equal(http.StatusServiceUnavailable))
+			Expect(res.Header.Get("Retry-After")).Should(Equal(strconv.Itoa(int(defaultRetryAfter.Seconds()))))
+		})
+
+		It("should stream the blob as it's downloaded", func() {
+			testApiMan.blobOnDemandMode = blobOnDemandStream
+			content := []byte(strings.Repeat(util.GenerateUUID(), 1000))
+			testFile, err := ioutil.TempFile(bundlePath, "test")
+			Expect(err).Should(Succeed())
+			defer os.Remove(testFile.Name())
+
+			// simulate download
+			go func() {
+				defer GinkgoRecover()
+				p := dummyBundleMan.progress
+				p.start(testFile.Name(), 0, int64(len(content)))
+				pw := &progressWriter{w: testFile, p: p}
+				for i := 0; i < len(content); i += 1000 {
+					time.Sleep(10 * time.Millisecond)
+					_, err := pw.Write(content[i : i+1000])
+					Expect(err).Should(Succeed())
+				}
+				p.finish(nil)
+			}()
+
+			res, err := http.Get(uri.String())
+			Expect(err).Should(Succeed())
+			defer res.Body.Close()
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			// complete only once the download is
+			Expect(res.ContentLength).Should(Equal(int64(-1)))
+			body, err := ioutil.ReadAll(res.Body)
+			Expect(err).Should(Succeed())
+			Expect(body).Should(Equal(content))
+		}, 3)
+
+		It("should abort the stream if the download fails after it's received", func() {
+			testApiMan.blobOnDemandMode = blobOnDemandStream
+			content := []byte(util.GenerateUUID())
+			testFile, err := ioutil.TempFile(bundlePath, "test")
+			Expect(err).Should(Succeed())
+			defer os.Remove(testFile.Name())
+
+			p := dummyBundleMan.progress
+			p.start(testFile.Name(), 0, int64(len(content)))
+			pw := &progressWriter{w: testFile, p: p}
+			_, err = pw.Write(content)
+			Expect(err).Should(Succeed())
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				p.finish(ErrInvalidSignature)
+			}()
+
+			res, err := http.Get(uri.String())
+			Expect(err).Should(Succeed())
+			defer res.Body.Close()
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			_, err = ioutil.ReadAll(res.Body)
+			Expect(err).Should(HaveOccurred())
+		}, 3)
+
+		It("should hold back blobs to verify until they're available", func() {
+			testApiMan.blobOnDemandMode = blobOnDemandStream
+			testApiMan.verifyBlobs = true
+			defer func() {
+				testApiMan.verifyBlobs = false
+			}()
+			content := []byte(util.GenerateUUID())
+			testFile, err := ioutil.TempFile(bundlePath, "test")
+			Expect(err).Should(Succeed())
+			defer os.Remove(testFile.Name())
+
+			p := dummyBundleMan.progress
+			p.start(testFile.Name(), 0, int64(len(content)))
+			pw := &progressWriter{w: testFile, p: p}
+			_, err = pw.Write(content)
+			Expect(err).Should(Succeed())
+			responded := make(chan *http.Response, 1)
+			go func() {
+				defer GinkgoRecover()
+				res, err := http.Get(uri.String())
+				Expect(err).Should(Succeed())
+				res.Body.Close()
+				responded <- res
+			}()
+			Consistently(responded, 200*time.Millisecond).ShouldNot(Receive())
+
+			// failing verification
+			p.finish(ErrInvalidSignature)
+			var res *http.Response
+			Eventually(responded).Should(Receive(&res))
+			Expect(res.StatusCode).ShouldNot(Equal(http.StatusOK))
+		}, 3)
+
+		It("should get 503 if the download doesn't progress", func() {
+			testApiMan.blobOnDemandMode = blobOnDemandStream
+			testApiMan.blobStallTimeout = 100 * time.Millisecond
+			res, err := http.Get(uri.String())
+			Expect(err).Should(Succeed())
+			res.Body.Close()
+			Expect(res.StatusCode).Should(Equal(http.StatusServiceUnavailable))
+		})
+	})
+
+	Context("GET /gatewaydeploy/health", func() {
+		var dummyBundleMan *dummyBundleManager
+		var uri *url.URL
+
+		var _ = BeforeEach(func() {
+			var err error
+			uri, err = url.Parse(apiTestUrl)
+			Expect(err).Should(Succeed())
+			dummyBundleMan = &dummyBundleManager{
+				breaker: breakerStatus{
+					State: breakerClosed,
+				},
+			}
+			testApiMan.bundleMan = dummyBundleMan
+		})
+
+		getHealth := func() *healthResponse {
+			uri.Path = healthEndpoint + strconv.Itoa(testCount)
+			res, err := http.Get(uri.String())
+			Expect(err).Should(Succeed())
+			defer res.Body.Close()
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			h := &healthResponse{}
+			Expect(json.NewDecoder(res.Body).Decode(h)).Should(Succeed())
+			return h
+		}
+
+		It("should be UP while the circuit breaker is closed", func() {
+			h := getHealth()
+			Expect(h.Status).Should(Equal(healthStatusUp))
+			Expect(h.BlobServer.State).Should(Equal(breakerClosed))
+		})
+
+		It("should be DEGRADED while the circuit breaker is open", func() {
+			dummyBundleMan.breaker = breakerStatus{
+				State:               breakerOpen,
+				ConsecutiveFailures: 5,
+				Opened:              1,
+			}
+			h := getHealth()
+			Expect(h.Status).Should(Equal(healthStatusDegraded))
+			Expect(h.BlobServer).Should(Equal(dummyBundleMan.breaker))
+		})
+
+		It("should expose download metrics", func() {
+			dummyBundleMan.breaker.Opened = 3
+			uri.Path = metricsEndpoint + strconv.Itoa(testCount)
+			res, err := http.Get(uri.String())
+			Expect(err).Should(Succeed())
+			defer res.Body.Close()
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			Expect(res.Header.Get("Content-Type")).Should(Equal(headerJson))
+			status := &downloadStatus{}
+			Expect(json.NewDecoder(res.Body).Decode(status)).Should(Succeed())
+			Expect(status.BlobServer.Opened).Should(Equal(int64(3)))
+		})
+	})
+
+	Context("/gatewaydeploy/bandwidth", func() {
+		var dummyBundleMan *dummyBundleManager
+		var uri *url.URL
+
+		var _ = BeforeEach(func() {
+			var err error
+			uri, err = url.Parse(apiTestUrl)
+			Expect(err).Should(Succeed())
+			uri.Path = bandwidthEndpoint + strconv.Itoa(testCount)
+			dummyBundleMan = &dummyBundleManager{
+				bandwidth: newBandwidthLimiter(bandwidthLimits{
+					GlobalBytesPerSec: 1000,
+				}),
+			}
+			testApiMan.bundleMan = dummyBundleMan
+		})
+
+		put := func(body string) *http.Response {
+			req, err := http.NewRequest("PUT", uri.String(), strings.NewReader(body))
+			Expect(err).Should(Succeed())
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).Should(Succeed())
+			return res
+		}
+
+		It("should get the bandwidth limits", func() {
+			res, err := http.Get(uri.String())
+			Expect(err).Should(Succeed())
+			defer res.Body.Close()
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			limits := bandwidthLimits{}
+			Expect(json.NewDecoder(res.Body).Decode(&limits)).Should(Succeed())
+			Expect(limits.GlobalBytesPerSec).Should(Equal(int64(1000)))
+		})
+
+		It("should set the bandwidth limits", func() {
+			res := put(`{"globalBytesPerSec": 2000, "workerBytesPerSec": 500, "schedules": [{"start": "22:00", "end": "06:00"}]}`)
+			defer res.Body.Close()
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			limits := dummyBundleMan.getBandwidthLimits()
+			Expect(limits.GlobalBytesPerSec).Should(Equal(int64(2000)))
+			Expect(limits.WorkerBytesPerSec).Should(Equal(int64(500)))
+			Expect(limits.Schedules).Should(Equal([]bandwidthSchedule{{Start: "22:00", End: "06:00"}}))
+		})
+
+		It("should reject invalid bandwidth limits", func() {
+			for _, body := range []string{
+				`not json`,
+				`{"globalBytesPerSec": -1}`,
+				`{"schedules": [{"start": "25:00", "end": "06:00"}]}`,
+			} {
+				res := put(body)
+				res.Body.Close()
+				Expect(res.StatusCode).Should(Equal(http.StatusBadRequest), body)
+			}
+			Expect(dummyBundleMan.getBandwidthLimits().GlobalBytesPerSec).Should(Equal(int64(1000)))
+		})
+	})
+
+	Context("/gatewaydeploy/workers", func() {
+		var dummyBundleMan *dummyBundleManager
+		var uri *url.URL
+
+		var _ = BeforeEach(func() {
+			var err error
+			uri, err = url.Parse(apiTestUrl)
+			Expect(err).Should(Succeed())
+			uri.Path = workersEndpoint + strconv.Itoa(testCount)
+			dummyBundleMan = &dummyBundleManager{
+				pool: workerPoolStatus{Size: 5, Active: 5, Min: 1, Max: 10},
+			}
+			testApiMan.bundleMan = dummyBundleMan
+		})
+
+		put := func(body string) *http.Response {
+			req, err := http.NewRequest("PUT", uri.String(), strings.NewReader(body))
+			Expect(err).Should(Succeed())
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).Should(Succeed())
+			return res
+		}
+
+		It("should get the worker pool", func() {
+			res, err := http.Get(uri.String())
+			Expect(err).Should(Succeed())
+			defer res.Body.Close()
+			s := workerPoolStatus{}
+			Expect(json.NewDecoder(res.Body).Decode(&s)).Should(Succeed())
+			Expect(s).Should(Equal(dummyBundleMan.pool))
+		})
+
+		It("should change only the given fields", func() {
+			res := put(`{"size": 8}`)
+			res.Body.Close()
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			Expect(dummyBundleMan.pool).Should(Equal(workerPoolStatus{Size: 8, Active: 5, Min: 1, Max: 10}))
+			res = put(`{"adaptive": true, "max": 20}`)
+			res.Body.Close()
+			Expect(dummyBundleMan.pool).Should(Equal(workerPoolStatus{Size: 8, Active: 5, Adaptive: true, Min: 1, Max: 20}))
+		})
+
+		It("should reject invalid worker pools", func() {
+			for _, body := range []string{`not json`, `{"min": 0}`, `{"min": 5, "max": 2}`} {
+				res := put(body)
+				res.Body.Close()
+				Expect(res.StatusCode).Should(Equal(http.StatusBadRequest), body)
+			}
+		})
+	})
+
+	Context("GET /gatewaydeploy/downloads", func() {
+		It("should get the progress of active downloads", func() {
+			p := newDownloadProgress(util.GenerateUUID())
+			p.start("blob", 10, 100)
+			p.add(5)
+			testApiMan.bundleMan = &dummyBundleManager{
+				progress: p,
+			}
+			uri, err := url.Parse(apiTestUrl)
+			Expect(err).Should(Succeed())
+			uri.Path = downloadsEndpoint + strconv.Itoa(testCount)
+			res, err := http.Get(uri.String())
+			Expect(err).Should(Succeed())
+			defer res.Body.Close()
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			var progress []blobProgress
+			Expect(json.NewDecoder(res.Body).Decode(&progress)).Should(Succeed())
+			Expect(progress).Should(HaveLen(1))
+			Expect(progress[0].BlobId).Should(Equal(p.blobId))
+			Expect(progress[0].Received).Should(Equal(int64(15)))
+			Expect(progress[0].Expected).Should(Equal(int64(100)))
+			Expect(progress[0].Started).ShouldNot(BeEmpty())
+		})
+	})
+
+	Context("GET /configurations response cache", func() {
+		var self string
+		var details []ApiConfigurationDetails
+		// a client that doesn't decompress responses transparently
+		client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+		var _ = BeforeEach(func() {
+			self = apiTestUrl + configEndpoint + strconv.Itoa(testCount)
+			details = setTestDeployments(dummyDbMan, self)
+			dummyDbMan.snapshot = newConfigSnapshot("0.1.1", dummyDbMan.readyDeployments)
+			testApiMan.responseCache = newResponseCache()
+			testApiMan.gzipResponses = true
+		})
+
+		get := func(acceptEncoding string) (*http.Response, []ApiConfigurationDetails) {
+			req, err := http.NewRequest("GET", self, nil)
+			Expect(err).Should(Succeed())
+			if acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", acceptEncoding)
+			}
+			res, err := client.Do(req)
+			Expect(err).Should(Succeed())
+			defer res.Body.Close()
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			var body io.Reader = res.Body
+			if res.Header.Get("Content-Encoding") == encodingGzip {
+				body, err = gzip.NewReader(res.Body)
+				Expect(err).Should(Succeed())
+			}
+			var depRes ApiConfigurationResponse
+			Expect(json.NewDecoder(body).Decode(&depRes)).Should(Succeed())
+			return res, depRes.ApiConfigurationsResponse
+		}
+
+		It("should serve the configurations of the snapshot, gzip compressed if accepted", func() {
+			res, confs := get("gzip, deflate")
+			Expect(confs).Should(Equal(details))
+			Expect(res.Header.Get("Content-Encoding")).Should(Equal(encodingGzip))
+			Expect(res.Header.Get("Vary")).Should(Equal("Accept-Encoding"))
+			Expect(res.Header.Get(apidConfigIndexHeader)).Should(Equal("0.1.1"))
+
+			res, confs = get("")
+			Expect(confs).Should(Equal(details))
+			Expect(res.Header.Get("Content-Encoding")).Should(BeEmpty())
+			res, _ = get("gzip;q=0")
+			Expect(res.Header.Get("Content-Encoding")).Should(BeEmpty())
+
+			testApiMan.gzipResponses = false
+			res, confs = get("gzip")
+			Expect(confs).Should(Equal(details))
+			Expect(res.Header.Get("Content-Encoding")).Should(BeEmpty())
+		})
+
+		It("should serve the cached response until the snapshot or pins change", func() {
+			_, confs := get("")
+			Expect(confs).Should(Equal(details))
+
+			// the cached response is of the same snapshot
+			dummyDbMan.readyDeployments = nil
+			_, confs = get("")
+			Expect(confs).Should(Equal(details))
+
+			pinned := dummyDbMan.snapshot.getConfigurations("")[0]
+			pinned.Revision = "0"
+			dummyDbMan.pins = []configPin{{Configuration: pinned, Lsn: "0.0.1", PinnedAt: time.Now()}}
+			_, confs = get("")
+			Expect(confs).Should(HaveLen(len(details)))
+			Expect(confs[0].Revision).Should(Equal("0"))
+			Expect(confs[0].Pinned).ShouldNot(BeNil())
+
+			dummyDbMan.pins = nil
+			dummyDbMan.snapshot = dummyDbMan.snapshot.withChanges("0.2.0", nil, []*Configuration{&pinned})
+			res, confs := get("")
+			Expect(confs).Should(Equal(details[1:]))
+			Expect(res.Header.Get(apidConfigIndexHeader)).Should(Equal("0.2.0"))
+		})
+	})
+
+	Context("ETags", func() {
+		getWithETag := func(path string, ifNoneMatch string) *http.Response {
+			req, err := http.NewRequest("GET", apiTestUrl+path, nil)
+			Expect(err).Should(Succeed())
+			if ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", ifNoneMatch)
+			}
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).Should(Succeed())
+			res.Body.Close()
+			return res
+		}
+
+		It("should identify listings by config index, filter and pins", func() {
+			path := configEndpoint + strconv.Itoa(testCount)
+			setTestDeployments(dummyDbMan, apiTestUrl+path)
+			dummyDbMan.configurations = map[string]*Configuration{"ORGANIZATION": makeTestDeployment()}
+			res := getWithETag(path, "")
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			etag := res.Header.Get("ETag")
+			Expect(etag).Should(HavePrefix(`"`))
+
+			res = getWithETag(path, etag)
+			Expect(res.StatusCode).Should(Equal(http.StatusNotModified))
+			Expect(res.Header.Get("ETag")).Should(Equal(etag))
+			Expect(getWithETag(path, `"other", W/`+etag).StatusCode).Should(Equal(http.StatusNotModified))
+			Expect(getWithETag(path, "*").StatusCode).Should(Equal(http.StatusNotModified))
+			Expect(getWithETag(path, `"other"`).StatusCode).Should(Equal(http.StatusOK))
+
+			filtered := getWithETag(path+"?type=ORGANIZATION", etag)
+			Expect(filtered.StatusCode).Should(Equal(http.StatusOK))
+			Expect(filtered.Header.Get("ETag")).ShouldNot(Equal(etag))
+
+			dummyDbMan.pins = []configPin{{Configuration: dummyDbMan.readyDeployments[0], Lsn: "0.0.1"}}
+			res = getWithETag(path, etag)
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			Expect(res.Header.Get("ETag")).ShouldNot(Equal(etag))
+
+			dummyDbMan.pins = nil
+			dummyDbMan.lsn = "0.2.0"
+			res = getWithETag(path, etag)
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			Expect(res.Header.Get("ETag")).ShouldNot(Equal(etag))
+		})
+
+		It("should identify configurations by revision and blobs", func() {
+			config := makeTestDeployment()
+			dummyDbMan.configurations = map[string]*Configuration{config.ID: config}
+			path := configEndpoint + strconv.Itoa(testCount) + "/" + config.ID
+			res := getWithETag(path, "")
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			etag := res.Header.Get("ETag")
+			Expect(etag).ShouldNot(BeEmpty())
+			Expect(getWithETag(path, etag).StatusCode).Should(Equal(http.StatusNotModified))
+
+			updated := *config
+			updated.BlobID = util.GenerateUUID()
+			dummyDbMan.configurations = map[string]*Configuration{config.ID: &updated}
+			res = getWithETag(path, etag)
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			Expect(res.Header.Get("ETag")).ShouldNot(Equal(etag))
+
+			// the progress of downloads isn't cacheable
+			dummyDbMan.unreadyBlobIds = []string{updated.BlobID}
+			testApiMan.bundleMan = &dummyBundleManager{progress: newDownloadProgress(updated.BlobID)}
+			res = getWithETag(path, "*")
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			Expect(res.Header.Get("ETag")).Should(BeEmpty())
+		})
+	})
+
+	Context("/gatewaydeploy/pins", func() {
+		var current, previous *Configuration
+		var self string
+
+		var _ = BeforeEach(func() {
+			self = apiTestUrl + configEndpoint + strconv.Itoa(testCount)
+			current = makeTestDeployment()
+			current.Revision = "3"
+			previous = makeTestDeployment()
+			previous.ID = current.ID
+			previous.Revision = "2"
+			other := makeTestDeployment()
+			dummyDbMan.readyDeployments = []Configuration{*current, *other}
+			dummyDbMan.configurations = map[string]*Configuration{current.ID: current}
+			dummyDbMan.history = []configRevision{
+				{Configuration: *previous, Lsn: "0.1.0"},
+				{Configuration: *current, Lsn: "5-0.2.0"},
+			}
+		})
+
+		request := func(method, path, body string) *http.Response {
+			req, err := http.NewRequest(method, apiTestUrl+path, strings.NewReader(body))
+			Expect(err).Should(Succeed())
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).Should(Succeed())
+			return res
+		}
+
+		getConfigs := func() []ApiConfigurationDetails {
+			res := request("GET", configEndpoint+strconv.Itoa(testCount), "")
+			defer res.Body.Close()
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			var depRes ApiConfigurationResponse
+			Expect(json.NewDecoder(res.Body).Decode(&depRes)).Should(Succeed())
+			return depRes.ApiConfigurationsResponse
+		}
+
+		It("should serve the pinned revision until unpinned", func() {
+			pinPath := pinsEndpoint + strconv.Itoa(testCount) + "/" + current.ID
+			res := request("PUT", pinPath, `{"revision": "2"}`)
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			detail := ApiConfigurationDetails{}
+			Expect(json.NewDecoder(res.Body).Decode(&detail)).Should(Succeed())
+			res.Body.Close()
+			Expect(detail.Revision).Should(Equal("2"))
+			Expect(detail.Pinned.ConfigIndex).Should(Equal("0.1.0"))
+			Expect(detail.Pinned.CurrentRevision).Should(Equal("3"))
+			Expect(detail.Pinned.PinnedAt).ShouldNot(BeEmpty())
+
+			// listing, single configuration and pins
+			confs := getConfigs()
+			Expect(confs).Should(HaveLen(2))
+			Expect(confs[0].Self).Should(Equal(self + "/" + current.ID))
+			Expect(confs[0].Revision).Should(Equal("2"))
+			Expect(confs[0].BeanBlobUrl).Should(Equal(getBlobUrl(previous.BlobID)))
+			Expect(confs[0].Pinned).Should(Equal(detail.Pinned))
+			Expect(confs[1].Pinned).Should(BeNil())
+
+			res = request("GET", configEndpoint+strconv.Itoa(testCount)+"/"+current.ID, "")
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			Expect(json.NewDecoder(res.Body).Decode(&detail)).Should(Succeed())
+			res.Body.Close()
+			Expect(detail.Revision).Should(Equal("2"))
+			Expect(detail.Pinned).ShouldNot(BeNil())
+
+			res = request("GET", pinsEndpoint+strconv.Itoa(testCount), "")
+			var pins ApiConfigurationResponse
+			Expect(json.NewDecoder(res.Body).Decode(&pins)).Should(Succeed())
+			res.Body.Close()
+			Expect(pins.ApiConfigurationsResponse).Should(Equal([]ApiConfigurationDetails{detail}))
+
+			// a deleted configuration stays pinned
+			dummyDbMan.readyDeployments = dummyDbMan.readyDeployments[1:]
+			confs = getConfigs()
+			Expect(confs).Should(HaveLen(2))
+			Expect(confs[1].Revision).Should(Equal("2"))
+			Expect(confs[1].Pinned.CurrentRevision).Should(BeEmpty())
+
+			res = request("DELETE", pinPath, "")
+			res.Body.Close()
+			Expect(res.StatusCode).Should(Equal(http.StatusNoContent))
+			confs = getConfigs()
+			Expect(confs).Should(HaveLen(1))
+			Expect(confs[0].Pinned).Should(BeNil())
+			res = request("DELETE", pinPath, "")
+			res.Body.Close()
+			Expect(res.StatusCode).Should(Equal(http.StatusNotFound))
+		})
+
+		It("should pin by config index", func() {
+			res := request("PUT", pinsEndpoint+strconv.Itoa(testCount)+"/"+current.ID, `{"configIndex": "5-0.2.0"}`)
+			defer res.Body.Close()
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			Expect(dummyDbMan.pins).Should(HaveLen(1))
+			Expect(dummyDbMan.pins[0].Configuration).Should(Equal(*current))
+			Expect(dummyDbMan.pins[0].Lsn).Should(Equal("5-0.2.0"))
+			var detail ApiConfigurationDetails
+			Expect(json.NewDecoder(res.Body).Decode(&detail)).Should(Succeed())
+			Expect(detail.Pinned.ConfigIndex).Should(Equal("5-0.2.0"))
+		})
+
+		It("should reject invalid pins", func() {
+			dummyDbMan.unreadyBlobIds = []string{previous.BlobResourceID}
+			pinPath := pinsEndpoint + strconv.Itoa(testCount) + "/" + current.ID
+			for _, c := range []struct {
+				body   string
+				status int
+			}{
+				{`not json`, http.StatusBadRequest},
+				{`{}`, http.StatusBadRequest},
+				{`{"revision": "1"}`, http.StatusNotFound},
+				{`{"revision": "3", "configIndex": "0.1.0"}`, http.StatusNotFound},
+				{`{"revision": "3", "configIndex": "0.2.0"}`, http.StatusNotFound},
+				{`{"configIndex": "x-0.2.0"}`, http.StatusBadRequest},
+				{`{"revision": "2"}`, http.StatusConflict},
+			} {
+				res := request("PUT", pinPath, c.body)
+				res.Body.Close()
+				Expect(res.StatusCode).Should(Equal(c.status), c.body)
+			}
+			Expect(dummyDbMan.pins).Should(BeEmpty())
+		})
+	})
+
 	Context("GET /configurations/{configId}", func() {
 		It("should get configuration according to {configId}", func() {
 			// setup http client
@@ -475,6 +1285,45 @@ var _ = Describe("api", func() {
 			Expect(depRes.Path).Should(Equal(expectedConfig.Path))
 			Expect(depRes.Created).Should(Equal(convertTime(expectedConfig.Created)))
 			Expect(depRes.Updated).Should(Equal(convertTime(expectedConfig.Updated)))
+			Expect(depRes.Status).Should(BeEmpty())
+			Expect(depRes.Progress).Should(BeEmpty())
+		})
+
+		It("should report the progress of blobs still downloading", func() {
+			config := makeTestDeployment()
+			dummyDbMan.configurations = map[string]*Configuration{config.ID: config}
+			dummyDbMan.unreadyBlobIds = []string{config.BlobID}
+			p := newDownloadProgress(config.BlobID)
+			p.start("blob", 0, 100)
+			p.add(40)
+			testApiMan.bundleMan = &dummyBundleManager{
+				progress: p,
+			}
+			getConfig := func() *ApiConfigurationDetails {
+				uri, err := url.Parse(apiTestUrl)
+				Expect(err).Should(Succeed())
+				uri.Path = configEndpoint + strconv.Itoa(testCount) + "/" + config.ID
+				res, err := http.Get(uri.String())
+				Expect(err).Should(Succeed())
+				defer res.Body.Close()
+				Expect(res.StatusCode).Should(Equal(http.StatusOK))
+				detail := &ApiConfigurationDetails{}
+				Expect(json.NewDecoder(res.Body).Decode(detail)).Should(Succeed())
+				return detail
+			}
+
+			detail := getConfig()
+			Expect(detail.Status).Should(Equal(configStatusDownloading))
+			Expect(detail.Progress).Should(HaveLen(1))
+			Expect(detail.Progress[0].BlobId).Should(Equal(config.BlobID))
+			Expect(detail.Progress[0].Received).Should(Equal(int64(40)))
+			Expect(detail.Progress[0].Expected).Should(Equal(int64(100)))
+
+			// downloaded
+			dummyDbMan.unreadyBlobIds = nil
+			detail = getConfig()
+			Expect(detail.Status).Should(BeEmpty())
+			Expect(detail.Progress).Should(BeEmpty())
 		})
 
 		It("should get error responses", func() {
@@ -508,6 +1357,64 @@ var _ = Describe("api", func() {
 		})
 	})
 
+	Context("GET /configurations/{configId}/history", func() {
+		It("should get the revisions of a configuration, newest first", func() {
+			uri, err := url.Parse(apiTestUrl)
+			Expect(err).Should(Succeed())
+			old := makeTestDeployment()
+			updated := *old
+			updated.Revision = "2"
+			seenAt := time.Now().UTC().Truncate(time.Second)
+			replacedAt := seenAt.Add(time.Hour)
+			dummyDbMan.history = []configRevision{
+				{Configuration: *old, Lsn: "1.0.0", SeenAt: seenAt, ReplacedLsn: "2.0.0", ReplacedAt: replacedAt},
+				{Configuration: updated, Lsn: "2.0.0", SeenAt: replacedAt},
+				{Configuration: *makeTestDeployment(), Lsn: "2.0.0", SeenAt: replacedAt},
+			}
+
+			uri.Path = configEndpoint + strconv.Itoa(testCount) + "/" + old.ID + "/history"
+			res, err := http.Get(uri.String())
+			Expect(err).Should(Succeed())
+			defer res.Body.Close()
+			Expect(res.StatusCode).Should(Equal(http.StatusOK))
+			history := ApiConfigurationHistoryResponse{}
+			Expect(json.NewDecoder(res.Body).Decode(&history)).Should(Succeed())
+			Expect(history.Kind).Should(Equal(kindCollection))
+			Expect(history.Self).Should(Equal(apiTestUrl + uri.Path))
+			self := apiTestUrl + configEndpoint + strconv.Itoa(testCount)
+			Expect(history.Revisions).Should(Equal([]ApiConfigurationRevision{
+				{
+					ApiConfigurationDetails: *makeExpectedDetail(&updated, self),
+					ConfigIndex:             "2.0.0",
+					SeenAt:                  replacedAt.Format(time.RFC3339),
+				},
+				{
+					ApiConfigurationDetails: *makeExpectedDetail(old, self),
+					ConfigIndex:             "1.0.0",
+					SeenAt:                  seenAt.Format(time.RFC3339),
+					ReplacedConfigIndex:     "2.0.0",
+					ReplacedAt:              replacedAt.Format(time.RFC3339),
+				},
+			}))
+		})
+
+		It("should get error responses", func() {
+			uri, err := url.Parse(apiTestUrl)
+			Expect(err).Should(Succeed())
+			uri.Path = configEndpoint + strconv.Itoa(testCount) + "/" + util.GenerateUUID() + "/history"
+			res, err := http.Get(uri.String())
+			Expect(err).Should(Succeed())
+			res.Body.Close()
+			Expect(res.StatusCode).Should(Equal(http.StatusNotFound))
+
+			dummyDbMan.err = fmt.Errorf("test error")
+			res, err = http.Get(uri.String())
+			Expect(err).Should(Succeed())
+			res.Body.Close()
+			Expect(res.StatusCode).Should(Equal(http.StatusInternalServerError))
+		})
+	})
+
 })
 
 func setTestDeployments(dummyDbMan *dummyDbManager, self string) []ApiConfigurationDetails {
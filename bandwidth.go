@@ -0,0 +1,252 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package apiGatewayConfDeploy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// reads are split so that the limits are applied smoothly
+	bandwidthChunkSize = 16 * 1024
+	scheduleTimeFormat = "15:04"
+)
+
+// bandwidthLimits are in bytes per second, 0 means unlimited.
+// A schedule replaces the limits during its time of day window.
+type bandwidthLimits struct {
+	GlobalBytesPerSec int64               `json:"globalBytesPerSec"`
+	WorkerBytesPerSec int64               `json:"workerBytesPerSec"`
+	Schedules         []bandwidthSchedule `json:"schedules,omitempty"`
+}
+
+// bandwidthSchedule applies from Start to End, local time "HH:MM". The window may span midnight.
+type bandwidthSchedule struct {
+	Start             string `json:"start"`
+	End               string `json:"end"`
+	GlobalBytesPerSec int64  `json:"globalBytesPerSec"`
+	WorkerBytesPerSec int64  `json:"workerBytesPerSec"`
+}
+
+func (l *bandwidthLimits) validate() error {
+	if l.GlobalBytesPerSec < 0 || l.WorkerBytesPerSec < 0 {
+		return fmt.Errorf("bandwidth limits can't be negative")
+	}
+	for _, s := range l.Schedules {
+		if _, _, err := s.window(); err != nil {
+			return err
+		}
+		if s.GlobalBytesPerSec < 0 || s.WorkerBytesPerSec < 0 {
+			return fmt.Errorf("bandwidth limits can't be negative")
+		}
+	}
+	return nil
+}
+
+// window returns the start and end of the schedule in minutes since midnight
+func (s *bandwidthSchedule) window() (start int, end int, err error) {
+	t, err := time.Parse(scheduleTimeFormat, s.Start)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid schedule start %q, must be HH:MM", s.Start)
+	}
+	start = t.Hour()*60 + t.Minute()
+	t, err = time.Parse(scheduleTimeFormat, s.End)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid schedule end %q, must be HH:MM", s.End)
+	}
+	end = t.Hour()*60 + t.Minute()
+	return start, end, nil
+}
+
+func (s *bandwidthSchedule) contains(now time.Time) bool {
+	start, end, err := s.window()
+	if err != nil {
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// rates returns the global and per-worker limits at the given time
+func (l *bandwidthLimits) rates(now time.Time) (global int64, worker int64) {
+	for _, s := range l.Schedules {
+		if s.contains(now) {
+			return s.GlobalBytesPerSec, s.WorkerBytesPerSec
+		}
+	}
+	return l.GlobalBytesPerSec, l.WorkerBytesPerSec
+}
+
+// parseBandwidthSchedules parses a list of "HH:MM-HH:MM=global/worker" separated by commas
+func parseBandwidthSchedules(s string) ([]bandwidthSchedule, error) {
+	var schedules []bandwidthSchedule
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		invalid := fmt.Errorf("invalid bandwidth schedule %q, must be HH:MM-HH:MM=global/worker", item)
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, invalid
+		}
+		times := strings.SplitN(parts[0], "-", 2)
+		rates := strings.SplitN(parts[1], "/", 2)
+		if len(times) != 2 || len(rates) != 2 {
+			return nil, invalid
+		}
+		global, err := strconv.ParseInt(strings.TrimSpace(rates[0]), 10, 64)
+		if err != nil {
+			return nil, invalid
+		}
+		worker, err := strconv.ParseInt(strings.TrimSpace(rates[1]), 10, 64)
+		if err != nil {
+			return nil, invalid
+		}
+		schedules = append(schedules, bandwidthSchedule{
+			Start:             strings.TrimSpace(times[0]),
+			End:               strings.TrimSpace(times[1]),
+			GlobalBytesPerSec: global,
+			WorkerBytesPerSec: worker,
+		})
+	}
+	return schedules, nil
+}
+
+// tokenBucket allows bursts of up to one second of its rate
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+// take reserves n bytes at the given rate, and returns how long to wait before using them
+func (b *tokenBucket) take(n int, rate int64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if rate <= 0 {
+		b.rate = 0
+		return 0
+	}
+	if rate != b.rate {
+		// start with a full bucket at the new rate
+		b.rate = rate
+		b.tokens = float64(rate)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+		if b.tokens > float64(rate) {
+			b.tokens = float64(rate)
+		}
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(rate) * float64(time.Second))
+}
+
+// bandwidthLimiter applies the global limit shared by all workers, and the per-worker limits
+type bandwidthLimiter struct {
+	mu     sync.Mutex
+	limits bandwidthLimits
+	global tokenBucket
+}
+
+func newBandwidthLimiter(limits bandwidthLimits) *bandwidthLimiter {
+	return &bandwidthLimiter{
+		limits: limits,
+	}
+}
+
+func (l *bandwidthLimiter) getLimits() bandwidthLimits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limits := l.limits
+	limits.Schedules = append([]bandwidthSchedule(nil), l.limits.Schedules...)
+	return limits
+}
+
+func (l *bandwidthLimiter) setLimits(limits bandwidthLimits) error {
+	if err := limits.validate(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits
+	log.Infof("bandwidth limits set to %d bytes/s global, %d bytes/s per worker, %d schedules",
+		limits.GlobalBytesPerSec, limits.WorkerBytesPerSec, len(limits.Schedules))
+	return nil
+}
+
+func (l *bandwidthLimiter) rates(now time.Time) (int64, int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limits.rates(now)
+}
+
+// reader limits reads from r, worker is the bucket of the downloading worker.
+// Waits for the limits are interrupted when ctx is done.
+func (l *bandwidthLimiter) reader(ctx context.Context, r io.Reader, worker *tokenBucket) io.Reader {
+	return &limitedReader{
+		ctx:     ctx,
+		r:       r,
+		limiter: l,
+		worker:  worker,
+	}
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *bandwidthLimiter
+	worker  *tokenBucket
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > bandwidthChunkSize {
+		p = p[:bandwidthChunkSize]
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		global, worker := lr.limiter.rates(time.Now())
+		wait := lr.limiter.global.take(n, global)
+		if lr.worker != nil {
+			if w := lr.worker.take(n, worker); w > wait {
+				wait = w
+			}
+		}
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-lr.ctx.Done():
+				timer.Stop()
+				return n, lr.ctx.Err()
+			}
+		}
+	}
+	return n, err
+}
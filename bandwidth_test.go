@@ -0,0 +1,128 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayConfDeploy
+
+import (
+	"bytes"
+	"context"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+var _ = Describe("bandwidth limits", func() {
+
+	at := func(clock string) time.Time {
+		t, err := time.Parse(scheduleTimeFormat, clock)
+		Expect(err).Should(Succeed())
+		return t
+	}
+
+	It("should apply schedules by time of day", func() {
+		limits := bandwidthLimits{
+			GlobalBytesPerSec: 100,
+			WorkerBytesPerSec: 10,
+			Schedules: []bandwidthSchedule{
+				{Start: "09:00", End: "17:00", GlobalBytesPerSec: 50, WorkerBytesPerSec: 5},
+				{Start: "22:00", End: "06:00"},
+			},
+		}
+		for clock, expected := range map[string][2]int64{
+			"08:59": {100, 10},
+			"09:00": {50, 5},
+			"16:59": {50, 5},
+			"17:00": {100, 10},
+			"23:30": {0, 0},
+			"05:59": {0, 0},
+			"06:00": {100, 10},
+		} {
+			global, worker := limits.rates(at(clock))
+			Expect([2]int64{global, worker}).Should(Equal(expected), clock)
+		}
+	})
+
+	It("should parse schedules", func() {
+		schedules, err := parseBandwidthSchedules("09:00-17:00=1048576/131072, 22:00-06:00=0/0,")
+		Expect(err).Should(Succeed())
+		Expect(schedules).Should(Equal([]bandwidthSchedule{
+			{Start: "09:00", End: "17:00", GlobalBytesPerSec: 1048576, WorkerBytesPerSec: 131072},
+			{Start: "22:00", End: "06:00"},
+		}))
+		schedules, err = parseBandwidthSchedules("")
+		Expect(err).Should(Succeed())
+		Expect(schedules).Should(BeEmpty())
+		for _, invalid := range []string{"09:00-17:00", "09:00=1/1", "09:00-17:00=1", "09:00-17:00=a/1"} {
+			_, err = parseBandwidthSchedules(invalid)
+			Expect(err).ShouldNot(Succeed(), invalid)
+		}
+		limits := bandwidthLimits{Schedules: []bandwidthSchedule{{Start: "9am", End: "17:00"}}}
+		Expect(limits.validate()).ShouldNot(Succeed())
+	})
+
+	It("should allow bursts of one second", func() {
+		b := &tokenBucket{}
+		Expect(b.take(1000, 1000)).Should(BeZero())
+		Expect(b.take(500, 1000)).Should(BeNumerically("~", 500*time.Millisecond, 10*time.Millisecond))
+		// unlimited
+		Expect(b.take(1000000, 0)).Should(BeZero())
+	})
+
+	It("should limit the download rate", func() {
+		l := newBandwidthLimiter(bandwidthLimits{GlobalBytesPerSec: 64 * 1024})
+		start := time.Now()
+		n, err := io.Copy(ioutil.Discard, l.reader(context.Background(), bytes.NewReader(make([]byte, 128*1024)), &tokenBucket{}))
+		Expect(err).Should(Succeed())
+		Expect(n).Should(Equal(int64(128 * 1024)))
+		// the first second is a burst
+		Expect(time.Since(start)).Should(BeNumerically("~", time.Second, 200*time.Millisecond))
+	})
+
+	It("should share the global limit between workers", func() {
+		l := newBandwidthLimiter(bandwidthLimits{GlobalBytesPerSec: 64 * 1024, WorkerBytesPerSec: 1024 * 1024})
+		start := time.Now()
+		wg := sync.WaitGroup{}
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				io.Copy(ioutil.Discard, l.reader(context.Background(), bytes.NewReader(make([]byte, 64*1024)), &tokenBucket{}))
+			}()
+		}
+		wg.Wait()
+		Expect(time.Since(start)).Should(BeNumerically("~", time.Second, 200*time.Millisecond))
+	})
+
+	It("should apply new limits at runtime", func() {
+		l := newBandwidthLimiter(bandwidthLimits{})
+		Expect(l.setLimits(bandwidthLimits{WorkerBytesPerSec: -1})).ShouldNot(Succeed())
+		Expect(l.setLimits(bandwidthLimits{WorkerBytesPerSec: 32 * 1024})).Should(Succeed())
+		start := time.Now()
+		io.Copy(ioutil.Discard, l.reader(context.Background(), bytes.NewReader(make([]byte, 64*1024)), &tokenBucket{}))
+		Expect(time.Since(start)).Should(BeNumerically("~", time.Second, 200*time.Millisecond))
+	})
+
+	It("should interrupt waits when the download is cancelled", func() {
+		l := newBandwidthLimiter(bandwidthLimits{WorkerBytesPerSec: 1024})
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+		start := time.Now()
+		_, err := io.Copy(ioutil.Discard, l.reader(ctx, bytes.NewReader(make([]byte, 64*1024)), &tokenBucket{}))
+		Expect(err).Should(Equal(context.Canceled))
+		Expect(time.Since(start)).Should(BeNumerically("<", time.Second))
+	})
+})
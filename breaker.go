@@ -0,0 +1,183 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package apiGatewayConfDeploy
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// circuitBreaker is shared by the download workers.
+// It opens after consecutive failures to reach the blob server, which pauses the workers.
+// Once the probe interval has passed, a single worker is let through to probe the server:
+// the breaker closes if the probe succeeds, and opens again otherwise.
+type circuitBreaker struct {
+	mu            sync.Mutex
+	changed       *sync.Cond
+	state         string
+	failures      int
+	threshold     int
+	probeInterval time.Duration
+	since         time.Time
+	probing       bool
+	opened        int64
+	timer         *time.Timer
+	stopped       bool
+}
+
+type breakerStatus struct {
+	State               string `json:"state"`
+	ConsecutiveFailures int    `json:"consecutiveFailures"`
+	Since               string `json:"since"`
+	Opened              int64  `json:"opened"`
+}
+
+func newCircuitBreaker(threshold int, probeInterval time.Duration) *circuitBreaker {
+	b := &circuitBreaker{
+		state:         breakerClosed,
+		threshold:     threshold,
+		probeInterval: probeInterval,
+		since:         time.Now(),
+	}
+	b.changed = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire blocks while the breaker is open. probe is true if the caller was chosen to probe the server,
+// and must report the result with probe set. It returns false if the breaker is stopped.
+func (b *circuitBreaker) acquire() (probe bool, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for !b.stopped {
+		switch b.state {
+		case breakerClosed:
+			return false, true
+		case breakerOpen:
+			if time.Since(b.since) >= b.probeInterval {
+				b.setStateLocked(breakerHalfOpen)
+				continue
+			}
+		case breakerHalfOpen:
+			if !b.probing {
+				b.probing = true
+				return true, true
+			}
+		}
+		b.changed.Wait()
+	}
+	return false, false
+}
+
+// record reports the result of a download
+func (b *circuitBreaker) record(probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	failed := isBlobServerFailure(err)
+	if probe {
+		b.probing = false
+		if failed {
+			log.Errorf("blob server probe failed, circuit breaker stays open: %v", err)
+			b.openLocked()
+		} else {
+			log.Infof("blob server probe succeeded, circuit breaker closed")
+			b.failures = 0
+			b.setStateLocked(breakerClosed)
+		}
+		return
+	}
+	if b.state != breakerClosed {
+		// in-flight downloads started before the breaker opened
+		return
+	}
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		log.Errorf("blob server failed %d consecutive times, circuit breaker opened: %v", b.failures, err)
+		b.openLocked()
+	}
+}
+
+// release gives up a probe acquired by a worker which didn't make a download
+func (b *circuitBreaker) release(probe bool) {
+	if !probe {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	b.changed.Broadcast()
+}
+
+// must be called with mu held
+func (b *circuitBreaker) openLocked() {
+	b.opened++
+	b.setStateLocked(breakerOpen)
+	// wake up the workers when it's time to probe
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.probeInterval, b.wakeUp)
+	} else {
+		b.timer.Reset(b.probeInterval)
+	}
+}
+
+// must be called with mu held
+func (b *circuitBreaker) setStateLocked(state string) {
+	b.state = state
+	b.since = time.Now()
+	b.changed.Broadcast()
+}
+
+func (b *circuitBreaker) wakeUp() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.changed.Broadcast()
+}
+
+// stop releases the blocked workers
+func (b *circuitBreaker) stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stopped = true
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.changed.Broadcast()
+}
+
+func (b *circuitBreaker) status() breakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return breakerStatus{
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+		Since:               b.since.UTC().Format(iso8601),
+		Opened:              b.opened,
+	}
+}
+
+// isBlobServerFailure tells if the error means the blob server (or the storage behind signed URLs) is unavailable.
+// Missing blobs, malformed responses and verification failures don't count.
+func isBlobServerFailure(err error) bool {
+	e, ok := err.(*downloadError)
+	return ok && !e.permanent
+}
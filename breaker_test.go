@@ -0,0 +1,122 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayConfDeploy
+
+import (
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"time"
+)
+
+var _ = Describe("circuit breaker", func() {
+	var b *circuitBreaker
+	unavailable := statusError("uri", &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}})
+	notFound := statusError("uri", &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{}})
+
+	var _ = BeforeEach(func() {
+		b = newCircuitBreaker(3, 200*time.Millisecond)
+	})
+
+	var _ = AfterEach(func() {
+		b.stop()
+	})
+
+	acquire := func() chan bool {
+		acquired := make(chan bool, 1)
+		go func() {
+			defer GinkgoRecover()
+			probe, ok := b.acquire()
+			Expect(ok).Should(BeTrue())
+			acquired <- probe
+		}()
+		return acquired
+	}
+
+	It("should open after consecutive failures", func() {
+		b.record(false, unavailable)
+		b.record(false, unavailable)
+		b.record(false, nil)
+		b.record(false, unavailable)
+		b.record(false, notFound)
+		b.record(false, fmt.Errorf("unknown"))
+		Expect(b.status().State).Should(Equal(breakerClosed))
+		b.record(false, unavailable)
+		b.record(false, networkError("uri", fmt.Errorf("connection refused")))
+		b.record(false, unavailable)
+		status := b.status()
+		Expect(status.State).Should(Equal(breakerOpen))
+		Expect(status.ConsecutiveFailures).Should(Equal(3))
+		Expect(status.Opened).Should(Equal(int64(1)))
+	})
+
+	It("should let a single probe through, and close if it succeeds", func() {
+		for i := 0; i < 3; i++ {
+			b.record(false, unavailable)
+		}
+		opened := time.Now()
+		first := acquire()
+		second := acquire()
+		// either one may be the probe
+		var waiting chan bool
+		select {
+		case probe := <-first:
+			Expect(probe).Should(BeTrue())
+			waiting = second
+		case probe := <-second:
+			Expect(probe).Should(BeTrue())
+			waiting = first
+		case <-time.After(time.Second):
+			Fail("no probe let through")
+		}
+		Expect(time.Since(opened)).Should(BeNumerically(">=", 190*time.Millisecond))
+		Expect(b.status().State).Should(Equal(breakerHalfOpen))
+		Consistently(waiting, 100*time.Millisecond).ShouldNot(Receive())
+
+		b.record(true, nil)
+		Eventually(waiting).Should(Receive(BeFalse()))
+		Expect(b.status().State).Should(Equal(breakerClosed))
+		Expect(b.status().ConsecutiveFailures).Should(BeZero())
+	})
+
+	It("should open again if the probe fails", func() {
+		for i := 0; i < 3; i++ {
+			b.record(false, unavailable)
+		}
+		Eventually(acquire()).Should(Receive(BeTrue()))
+		b.record(true, unavailable)
+		Expect(b.status().State).Should(Equal(breakerOpen))
+		Expect(b.status().Opened).Should(Equal(int64(2)))
+		// late results of downloads started before don't count
+		b.record(false, nil)
+		Expect(b.status().State).Should(Equal(breakerOpen))
+		Eventually(acquire()).Should(Receive(BeTrue()))
+	})
+
+	It("should release blocked workers when stopped", func() {
+		for i := 0; i < 3; i++ {
+			b.record(false, unavailable)
+		}
+		stopped := make(chan bool)
+		go func() {
+			_, ok := b.acquire()
+			stopped <- ok
+		}()
+		Consistently(stopped, 100*time.Millisecond).ShouldNot(Receive())
+		b.stop()
+		Eventually(stopped).Should(Receive(BeFalse()))
+	})
+})
@@ -14,16 +14,22 @@
 package apiGatewayConfDeploy
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -32,25 +38,48 @@ const (
 	blobStoreUri = "/blobs/{blobId}"
 )
 
+var errDownloadCancelled = errors.New("download cancelled, the blob is no longer referenced")
+
 type bundleManagerInterface interface {
 	initializeBundleDownloading()
-	downloadBlobsWithCallback(blobs []string, callback func())
+	downloadBlobsWithCallback(blobs []string, priorities map[string]int, callback func())
+	prioritizeBlob(blobId string) bool
+	getBandwidthLimits() bandwidthLimits
+	setBandwidthLimits(limits bandwidthLimits) error
+	getWorkerPool() workerPoolStatus
+	setWorkerPool(s workerPoolStatus) error
+	fetchBlob(blobId string) *downloadProgress
+	getProgress() []blobProgress
 	deleteBlobs(blobIds []string)
+	purgePartialBlobs()
+	status() *downloadStatus
 	Close()
 }
 
 type bundleManager struct {
-	blobServerUrl         string
+	mirrors               *mirrorSet
 	dbMan                 dbManagerInterface
 	apiMan                apiManagerInterface
 	concurrentDownloads   int
 	markConfigFailedAfter time.Duration
 	bundleRetryDelay      time.Duration
 	bundleCleanupDelay    time.Duration
-	downloadQueue         chan *DownloadRequest
+	downloadQueue         *downloadQueue
+	breaker               *circuitBreaker
 	isClosed              *int32
-	workers               []*BundleDownloader
+	pool                  *workerPool
+	shutdownTimeout       time.Duration
+	ctx                   context.Context
+	cancel                context.CancelFunc
 	client                *http.Client
+	verifier              *blobVerifier
+	bandwidth             *bandwidthLimiter
+	progressMux           sync.Mutex
+	progress              map[string]*downloadProgress
+	retainRevisions       int
+	retainRevisionsByType map[string]int
+	historyMaxAge         time.Duration
+	purgeMux              sync.Mutex
 }
 
 type blobServerResponse struct {
@@ -59,83 +88,243 @@ type blobServerResponse struct {
 	Self                     string `json:"self"`
 	SignedUrl                string `json:"signedurl"`
 	SignedUrlExpiryTimestamp string `json:"signedurlexpirytimestamp"`
+	Signature                string `json:"signature"`
+}
+
+type downloadStatus struct {
+	Queued     int            `json:"queued"`
+	Delayed    int            `json:"delayed"`
+	BlobServer breakerStatus  `json:"blobServer"`
+	Mirrors    []mirrorStatus `json:"mirrors"`
+	Workers    int            `json:"workers"`
 }
 
 func (bm *bundleManager) initializeBundleDownloading() {
 	atomic.StoreInt32(bm.isClosed, 0)
-	bm.workers = make([]*BundleDownloader, bm.concurrentDownloads)
-
-	// create workers
-	for i := 0; i < bm.concurrentDownloads; i++ {
-		worker := BundleDownloader{
-			id:       i + 1,
-			workChan: make(chan *DownloadRequest),
-			bm:       bm,
-		}
-		bm.workers[i] = &worker
-		worker.Start()
+	bm.ctx, bm.cancel = context.WithCancel(context.Background())
+	if bm.pool == nil {
+		bm.pool = newWorkerPool(bm, 1, bm.concurrentDownloads, false)
 	}
+	// create workers
+	bm.pool.start(bm.concurrentDownloads, workerPoolInterval)
 }
 
-func (bm *bundleManager) makeDownloadRequest(blobId string, b *BunchDownloadRequest) *DownloadRequest {
+func (bm *bundleManager) makeDownloadRequest(blobId string, priority int, b *BunchDownloadRequest) *DownloadRequest {
 	if blobId == "" {
 		return nil
 	}
 	markFailedAt := time.Now().Add(bm.markConfigFailedAfter)
 	retryIn := bm.bundleRetryDelay
-	maxBackOff := 5 * time.Minute
+	parent := bm.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
 
 	return &DownloadRequest{
-		blobServerURL: bm.blobServerUrl,
-		bm:            bm,
-		blobId:        blobId,
-		backoffFunc:   createBackoff(retryIn, maxBackOff),
-		markFailedAt:  markFailedAt,
-		client:        bm.client,
-		bunchRequest:  b,
+		mirrors:      bm.mirrors,
+		bm:           bm,
+		blobId:       blobId,
+		backoffFunc:  createBackoff(retryIn, maxDownloadBackOff),
+		markFailedAt: markFailedAt,
+		client:       bm.client,
+		bunchRequest: b,
+		priority:     priority,
+		index:        -1,
+		ctx:          ctx,
+		cancel:       cancel,
 	}
 }
 
-// a blocking method to enqueue download requests
+// enqueue download requests, backfill requests block while the download queue is full
 func (bm *bundleManager) enqueueRequest(r *DownloadRequest) {
 	if atomic.LoadInt32(bm.isClosed) == 1 {
 		return
 	}
 	if r != nil {
-		bm.downloadQueue <- r
+		bm.downloadQueue.push(r)
 	}
 }
 
-func (bm *bundleManager) downloadBlobsWithCallback(blobs []string, callback func()) {
+// download blobs, with priorities by blob id. Blobs without priority have priorityBackfill.
+// It blocks while the download queue is full, unless all blobs have a priority above the backfill.
+func (bm *bundleManager) downloadBlobsWithCallback(blobs []string, priorities map[string]int, callback func()) {
 
 	c := &BunchDownloadRequest{
 		bm:             bm,
 		blobs:          blobs,
+		priorities:     priorities,
 		attemptCounter: new(int32),
 		callback:       callback,
 	}
 	c.download()
 }
 
+// prioritizeBlob moves pending downloads of the blob to the front of the queue.
+// It returns false if the blob isn't being downloaded.
+func (bm *bundleManager) prioritizeBlob(blobId string) bool {
+	return bm.downloadQueue.bump(blobId)
+}
+
+func (bm *bundleManager) getBandwidthLimits() bandwidthLimits {
+	if bm.bandwidth == nil {
+		return bandwidthLimits{}
+	}
+	return bm.bandwidth.getLimits()
+}
+
+func (bm *bundleManager) setBandwidthLimits(limits bandwidthLimits) error {
+	if bm.bandwidth == nil {
+		return fmt.Errorf("bandwidth limiting is not enabled")
+	}
+	return bm.bandwidth.setLimits(limits)
+}
+
+func (bm *bundleManager) getWorkerPool() workerPoolStatus {
+	return bm.pool.getStatus()
+}
+
+func (bm *bundleManager) setWorkerPool(s workerPoolStatus) error {
+	return bm.pool.set(s)
+}
+
+func (bm *bundleManager) status() *downloadStatus {
+	return &downloadStatus{
+		Queued:     bm.downloadQueue.len(),
+		Delayed:    bm.downloadQueue.delayedLen(),
+		BlobServer: bm.breaker.status(),
+		Mirrors:    bm.mirrors.status(),
+		Workers:    bm.pool.getStatus().Active,
+	}
+}
+
+// Close cancels the downloads in progress and waits for the workers until shutdownTimeout.
+// The blobs still to be downloaded are persisted with their priority, so that they resume in order after restart.
 func (bm *bundleManager) Close() {
-	atomic.StoreInt32(bm.isClosed, 1)
-	close(bm.downloadQueue)
+	if !atomic.CompareAndSwapInt32(bm.isClosed, 0, 1) {
+		return
+	}
+	bm.downloadQueue.close()
+	bm.breaker.stop()
+	if bm.pool == nil {
+		return
+	}
+	bm.pool.close()
+	bm.cancel()
+	timeout := bm.shutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	if !bm.pool.wait(timeout) {
+		log.Warnf("download workers didn't stop within %s", timeout)
+	}
+	pending := bm.downloadQueue.pendingPriorities()
+	if err := bm.dbMan.savePendingDownloads(pending); err != nil {
+		log.Errorf("unable to persist %d pending downloads: %v", len(pending), err)
+	} else {
+		log.Debugf("persisted %d pending downloads", len(pending))
+	}
+	if n := removeTempFiles(); n > 0 {
+		log.Debugf("removed %d temp files of unfinished downloads", n)
+	}
 }
 
+// deleteBlobs cancels the downloads of blobs no longer referenced, and purges the files of old revisions after bundleCleanupDelay
 func (bm *bundleManager) deleteBlobs(blobs []string) {
 	for _, id := range blobs {
 		go bm.deleteBlobById(id)
 	}
+	time.AfterFunc(bm.bundleCleanupDelay, bm.purgeBlobs)
 }
 
-// TODO add delete support
+// deleteBlobById cancels the downloads of the blob if no configuration references it anymore.
+// Its file is deleted by purgeBlobs.
 func (bm *bundleManager) deleteBlobById(blobId string) {
+	referenced, err := bm.dbMan.isBlobReferenced(blobId)
+	if err != nil {
+		log.Errorf("unable to check references of blobId=%s: %v", blobId, err)
+		return
+	}
+	if !referenced {
+		bm.cancelDownloads(blobId)
+	}
+}
+
+// purgeBlobs deletes the files of blobs that neither a configuration nor a pin references,
+// except those of the last retainRevisions revisions of each configuration, and old quarantined files.
+// Revisions replaced more than historyMaxAge ago are pruned from the history, unless their blobs are retained.
+func (bm *bundleManager) purgeBlobs() {
+	bm.purgeMux.Lock()
+	defer bm.purgeMux.Unlock()
+	if atomic.LoadInt32(bm.isClosed) == 1 {
+		return
+	}
+	if n := purgeQuarantine(maxQuarantinedFiles); n > 0 {
+		log.Debugf("removed %d old quarantined files", n)
+	}
+	bm.purgePartialBlobs()
+	if bm.historyMaxAge > 0 {
+		if n, err := bm.dbMan.pruneConfigHistory(time.Now().Add(-bm.historyMaxAge), bm.retainRevisionsByType, bm.retainRevisions); err != nil {
+			log.Errorf("unable to prune configuration history: %v", err)
+		} else if n > 0 {
+			log.Debugf("pruned %d configuration revisions older than %v", n, bm.historyMaxAge)
+		}
+	}
+	unreferenced, err := bm.dbMan.getUnreferencedBlobs()
+	if err != nil {
+		log.Errorf("unable to get unreferenced blobs: %v", err)
+		return
+	}
+	if len(unreferenced) == 0 {
+		return
+	}
+	retained, err := bm.dbMan.getRetainedBlobs(bm.retainRevisionsByType, bm.retainRevisions)
+	if err != nil {
+		log.Errorf("unable to get blobs of retained revisions: %v", err)
+		return
+	}
+	purged := 0
+	for blobId, location := range unreferenced {
+		if retained[blobId] {
+			continue
+		}
+		// a configuration may have referenced it again meanwhile
+		if referenced, err := bm.dbMan.isBlobReferenced(blobId); err != nil || referenced {
+			continue
+		}
+		if err := bm.dbMan.deleteBlobAvailability(blobId); err != nil {
+			continue
+		}
+		safeDelete(location)
+		purged++
+		log.Debugf("purged blob of an old revision: blobId=%s file=%s", blobId, location)
+	}
+	log.Debugf("purged %d blobs, retained %d of old revisions", purged, len(unreferenced)-purged)
+}
 
+// cancelDownloads removes the blob from the download queue, and interrupts the downloads in progress.
+// Their workers finish them, the others are finished here.
+// The partial file of the blob is removed even if it isn't queued, e.g. after its download failed for good.
+func (bm *bundleManager) cancelDownloads(blobId string) {
+	waiting, inFlight := bm.downloadQueue.cancel(blobId)
+	if len(waiting)+len(inFlight) == 0 {
+		removePartialBlob(blobId)
+		return
+	}
+	log.Debugf("cancelled downloads of unreferenced blobId=%s: %d waiting, %d in progress", blobId, len(waiting), len(inFlight))
+	for _, r := range waiting {
+		r.markAttempted()
+	}
+	if len(inFlight) == 0 {
+		removePartialBlob(blobId)
+		bm.finishProgress(blobId, errDownloadCancelled)
+	}
 }
 
 type BunchDownloadRequest struct {
 	bm             *bundleManager
 	blobs          []string
+	priorities     map[string]int
 	attemptCounter *int32
 	callback       func()
 }
@@ -158,8 +347,7 @@ func (b *BunchDownloadRequest) download() {
 
 	*b.attemptCounter = int32(len(b.blobs))
 	for _, id := range b.blobs {
-		req := b.bm.makeDownloadRequest(id, b)
-		go b.bm.enqueueRequest(req)
+		b.bm.enqueueRequest(b.bm.makeDownloadRequest(id, b.priorities[id], b))
 	}
 }
 
@@ -170,21 +358,31 @@ func (b *BunchDownloadRequest) downloadAttempted() {
 }
 
 type DownloadRequest struct {
-	bm            *bundleManager
-	blobId        string
-	backoffFunc   func()
-	markFailedAt  time.Time
-	blobServerURL string
-	client        *http.Client
-	bunchRequest  *BunchDownloadRequest
-	attempted     bool
+	bm           *bundleManager
+	blobId       string
+	backoffFunc  func() time.Duration
+	markFailedAt time.Time
+	mirrors      *mirrorSet
+	client       *http.Client
+	bunchRequest *BunchDownloadRequest
+	attempted    bool
+	// ctx is cancelled on Close, or when the blob is no longer referenced
+	ctx    context.Context
+	cancel context.CancelFunc
+	// fields below are guarded by the downloadQueue
+	priority  int
+	seq       uint64
+	index     int
+	pending   bool
+	cancelled bool
+	due       time.Time
 }
 
-func (r *DownloadRequest) downloadBlob() error {
+// downloadBlob downloads the blob, limited by the bandwidth bucket of the worker
+func (r *DownloadRequest) downloadBlob(bucket *tokenBucket) error {
 
 	log.Debugf("starting bundle download attempt for blobId=%s", r.blobId)
-	var err error
-	defer r.markAttempted(&err)
+	defer r.markAttempted()
 	if r.checkTimeout() {
 		return &timeoutError{
 			markFailedAt: r.markFailedAt,
@@ -197,7 +395,15 @@ func (r *DownloadRequest) downloadBlob() error {
 		}
 	}
 
-	downloadedFile, err := downloadFromURI(r.client, r.blobServerURL, r.blobId)
+	var limit func(io.Reader) io.Reader
+	if r.bm.bandwidth != nil {
+		limit = func(reader io.Reader) io.Reader {
+			return r.bm.bandwidth.reader(r.ctx, reader, bucket)
+		}
+	}
+	downloadedFile, signature, meta, err := downloadFromURI(r.ctx, r.client, r.mirrors, r.blobId, r.bm.trackProgress(r.blobId), limit)
+	// the file is either committed or removed below
+	defer untrackTempFile(downloadedFile)
 
 	if err != nil {
 		log.Errorf("Unable to download blob file blobId=%s err:%v", r.blobId, err)
@@ -207,7 +413,27 @@ func (r *DownloadRequest) downloadBlob() error {
 		return err
 	}
 
-	err = r.bm.dbMan.updateLocalFsLocation(r.blobId, downloadedFile)
+	if r.bm.verifier != nil {
+		// the digest was computed by downloadFromURI, a malformed one fails verification
+		digest, _ := hex.DecodeString(meta.Digest)
+		if verr := r.bm.verifier.verify(digest, signature); verr != nil {
+			log.Errorf("Blob failed signature verification, quarantined: blobId=%s err:%v", r.blobId, verr)
+			r.quarantine(downloadedFile, verr)
+			err = &verificationError{
+				blobId: r.blobId,
+				err:    verr,
+			}
+			return err
+		}
+	}
+
+	// don't commit a file that may be removed by Close, or of a cancelled download
+	if err = r.ctx.Err(); err != nil {
+		go cleanTempFile(downloadedFile)
+		return err
+	}
+
+	err = r.bm.dbMan.updateLocalFsLocation(r.blobId, downloadedFile, meta)
 	if err != nil {
 		log.Errorf("updateLocalFsLocation failed: blobId=%s", r.blobId)
 		if downloadedFile != "" {
@@ -221,6 +447,23 @@ func (r *DownloadRequest) downloadBlob() error {
 	return nil
 }
 
+func (r *DownloadRequest) quarantine(file string, reason error) {
+	dest, err := quarantineFile(file)
+	if err != nil {
+		log.Errorf("Unable to move blob file to quarantine: blobId=%s err:%v", r.blobId, err)
+		if os.Remove(file) != nil {
+			log.Warnf("Unable to remove temp file %s", file)
+		}
+		dest = ""
+	}
+	if err = r.bm.dbMan.quarantineBlob(r.blobId, dest, reason.Error()); err != nil {
+		log.Errorf("quarantineBlob failed: blobId=%s err:%v", r.blobId, err)
+	}
+	if n := purgeQuarantine(maxQuarantinedFiles); n > 0 {
+		log.Debugf("removed %d old quarantined files", n)
+	}
+}
+
 func (r *DownloadRequest) checkTimeout() bool {
 
 	if !r.markFailedAt.IsZero() && time.Now().After(r.markFailedAt) {
@@ -232,16 +475,24 @@ func (r *DownloadRequest) checkTimeout() bool {
 	return false
 }
 
-func (r *DownloadRequest) markAttempted(errp *error) {
+// markAttempted tells the bunch request, once, that the blob had its chance to download
+func (r *DownloadRequest) markAttempted() {
 	if !r.attempted {
 		r.attempted = true
-		err := *errp
 		if r.bunchRequest != nil {
 			r.bunchRequest.downloadAttempted()
 		}
-		if err != nil {
-			//TODO: insert to DB as "attempted but unsuccessful"
-		}
+	}
+}
+
+// recordFailure persists a failed attempt, so that operators can tell why a blob isn't available
+func (r *DownloadRequest) recordFailure(err error) {
+	if _, ok := err.(*verificationError); ok {
+		// recorded by quarantine
+		return
+	}
+	if dbErr := r.bm.dbMan.updateBlobFailure(r.blobId, err.Error(), !isRetryable(err)); dbErr != nil {
+		log.Errorf("updateBlobFailure failed: blobId=%s err:%v", r.blobId, dbErr)
 	}
 }
 
@@ -249,7 +500,8 @@ func getBlobFilePath(blobId string) string {
 	return path.Join(bundlePath, base64.StdEncoding.EncodeToString([]byte(blobId)))
 }
 
-func getSignedURL(client *http.Client, blobServerURL string, blobId string) (string, error) {
+// getSignedURL returns the signed URL of the blob, and its detached signature if the blob server provides one
+func getSignedURL(ctx context.Context, client *http.Client, blobServerURL string, blobId string) (string, string, error) {
 
 	blobUri, err := url.Parse(blobServerURL)
 	if err != nil {
@@ -263,59 +515,89 @@ func getSignedURL(client *http.Client, blobServerURL string, blobId string) (str
 
 	uri := blobUri.String()
 
-	surl, err := getUriReaderWithAuth(client, uri)
+	surl, err := getUriReaderWithAuth(ctx, client, uri)
 	if err != nil {
 		log.Errorf("Unable to get signed URL from BlobServer %s: %v", uri, err)
-		return "", err
+		return "", "", err
 	}
 	defer surl.Close()
 
 	body, err := ioutil.ReadAll(surl)
 	if err != nil {
 		log.Errorf("Invalid response from BlobServer for {%s} error: {%v}", uri, err)
-		return "", err
+		return "", "", networkError(uri, err)
 	}
 	res := blobServerResponse{}
 	err = json.Unmarshal(body, &res)
 	if err != nil {
 		log.Errorf("Invalid response from BlobServer for {%s} error: {%v}", uri, err)
-		return "", err
+		return "", "", malformedError(uri, err)
+	}
+	if res.SignedUrl == "" {
+		log.Errorf("Invalid response from BlobServer for {%s}: no signed url", uri)
+		return "", "", malformedError(uri, fmt.Errorf("no signed url"))
 	}
 
-	return res.SignedUrl, nil
+	return res.SignedUrl, res.Signature, nil
 }
 
 // downloadFromURI involves retrieving the signed URL for the blob, and storing the resource locally
-// after downloading the resource from GCS (via the signed URL)
-func downloadFromURI(client *http.Client, blobServerURL string, blobId string) (tempFileName string, err error) {
-
-	var tempFile *os.File
+// after downloading the resource from GCS (via the signed URL).
+// If the transfer fails midway, the bytes received so far are kept, and the next attempt resumes from there.
+// The transfer to the partial file is reported to progress, and slowed down by limit if not nil.
+func downloadFromURI(ctx context.Context, client *http.Client, mirrors *mirrorSet, blobId string, progress *downloadProgress, limit func(io.Reader) io.Reader) (tempFileName string, signature string, meta *blobMetadata, err error) {
 
-	uri, err := getSignedURL(client, blobServerURL, blobId)
+	var uri, source string
+	uri, signature, source, err = mirrors.getSignedURL(ctx, client, blobId)
 	if err != nil {
 		log.Errorf("Unable to get signed URL for blobId {%s}, error : {%v}", blobId, err)
 		return
 	}
 
-	tempFile, err = ioutil.TempFile(bundlePath, "blob")
+	partial, err := openPartialBlob(blobId)
 	if err != nil {
 		log.Errorf("Unable to create temp file: %v", err)
 		return
 	}
-	defer tempFile.Close()
-	tempFileName = tempFile.Name()
+	defer partial.Close()
 
 	var confReader io.ReadCloser
-	confReader, err = getUriReaderWithAuth(client, uri)
+	confReader, err = partial.request(ctx, client, uri)
 	if err != nil {
 		log.Errorf("Unable to retrieve Blob %s: %v", uri, err)
 		return
 	}
 	defer confReader.Close()
 
-	_, err = io.Copy(tempFile, confReader)
+	var dst io.Writer = partial.file
+	if partial.resumable && progress != nil {
+		progress.start(partial.fileName, partial.offset, partial.expected)
+		dst = &progressWriter{w: partial.file, p: progress}
+	}
+	var src io.Reader = confReader
+	if limit != nil {
+		src = limit(confReader)
+	}
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		log.Errorf("Unable to write Blob %s: %v", partial.fileName, err)
+		return
+	}
+
+	tempFileName, err = partial.complete()
+	if err != nil {
+		log.Errorf("Unable to move Blob %s: %v", partial.fileName, err)
+		return
+	}
+
+	meta = &blobMetadata{
+		ContentType:  partial.contentType,
+		DownloadedAt: time.Now(),
+		Source:       source,
+	}
+	meta.Size, meta.Digest, err = fileDigest(tempFileName)
 	if err != nil {
-		log.Errorf("Unable to write Blob %s: %v", tempFileName, err)
+		log.Errorf("Unable to hash Blob %s: %v", tempFileName, err)
 		return
 	}
 
@@ -323,63 +605,164 @@ func downloadFromURI(client *http.Client, blobServerURL string, blobId string) (
 	return
 }
 
-// retrieveBundle retrieves bundle data from a URI
-func getUriReaderWithAuth(client *http.Client, uriString string) (io.ReadCloser, error) {
-	req, err := http.NewRequest("GET", uriString, nil)
+// fileDigest returns the size and hex encoded SHA-256 of the file
+func fileDigest(fileName string) (int64, string, error) {
+	f, err := os.Open(fileName)
 	if err != nil {
-		return nil, err
+		return 0, "", err
 	}
-	// add Auth
-	req.Header.Add("Authorization", getBearerToken())
-	res, err := client.Do(req)
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// retrieveBundle retrieves bundle data from a URI.
+// Errors are *downloadError, classified as permanent or transient.
+func getUriReaderWithAuth(ctx context.Context, client *http.Client, uriString string) (io.ReadCloser, error) {
+	res, err := doRequestWithAuth(ctx, client, uriString, nil)
 	if err != nil {
 		return nil, err
 	}
 	if res.StatusCode != 200 {
 		res.Body.Close()
-		return nil, fmt.Errorf("GET uri %s failed with status %d", uriString, res.StatusCode)
+		return nil, statusError(uriString, res)
 	}
 	return res.Body, nil
 }
 
+// doRequestWithAuth sends a GET request with the bearer token and the given extra headers.
+// If the token is rejected, the request is sent once more with a new token.
+func doRequestWithAuth(ctx context.Context, client *http.Client, uriString string, header http.Header) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest("GET", uriString, nil)
+		if err != nil {
+			return nil, malformedError(uriString, err)
+		}
+		req = req.WithContext(ctx)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		// add Auth
+		token, err := tokens.token(ctx)
+		if err != nil {
+			return nil, networkError(uriString, err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, networkError(uriString, err)
+		}
+		if res.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			log.Debugf("bearer token rejected by %s, retrying with a new token", uriString)
+			res.Body.Close()
+			tokens.invalidate(token)
+			continue
+		}
+		return res, nil
+	}
+}
+
 type BundleDownloader struct {
 	id       int
 	workChan chan *DownloadRequest
 	bm       *bundleManager
+	bucket   *tokenBucket
 }
 
 func (w *BundleDownloader) Start() {
 	go func() {
 		log.Debugf("started bundle downloader %d", w.id)
 
-		for req := range w.bm.downloadQueue {
+		for {
+			// wait while the blob server is unavailable
+			probe, ok := w.bm.breaker.acquire()
+			if !ok {
+				break
+			}
+			req, ok := w.bm.downloadQueue.pop()
+			if !ok {
+				w.bm.breaker.release(probe)
+				break
+			}
 			log.Debugf("starting download blobId=%s", req.blobId)
-			err := req.downloadBlob()
+			err := req.downloadBlob(w.bucket)
+			if w.bm.ctx.Err() != nil {
+				// shutting down, the request stays pending to be persisted
+				w.bm.breaker.release(probe)
+				break
+			}
+			if req.ctx.Err() != nil {
+				// cancelled by cancelDownloads, the blob server isn't to blame
+				w.bm.breaker.release(probe)
+				removePartialBlob(req.blobId)
+				w.bm.finishProgress(req.blobId, errDownloadCancelled)
+				continue
+			}
+			w.bm.breaker.record(probe, err)
+			w.bm.pool.observe(err)
 			if err != nil {
-				// timeout
-				if _, ok := err.(*timeoutError); ok {
+				req.recordFailure(err)
+			}
+			if err != nil && isRetryable(err) {
+				// the server may have asked to come back later
+				delay := retryAfter(err)
+				if delay > 0 {
+					log.Debugf("blobId=%s will retry in %s as requested by server", req.blobId, delay)
+				} else {
+					delay = req.backoffFunc()
+				}
+				if w.bm.downloadQueue.pushAfter(req, delay) || req.ctx.Err() == nil || w.bm.ctx.Err() != nil {
+					// retried, or shutting down and the request stays pending to be persisted
 					continue
 				}
-				go func(r *DownloadRequest, bm *bundleManager) {
-					r.backoffFunc()
-					bm.enqueueRequest(r)
-				}(req, w.bm)
+				// cancelled meanwhile
+				err = errDownloadCancelled
 			}
+			w.bm.downloadQueue.done(req)
+			req.cancel()
+			w.bm.finishProgress(req.blobId, err)
 		}
+		w.bm.pool.exited()
 		log.Debugf("bundle downloader %d stopped", w.id)
 	}()
 }
 
-// simple doubling back-off
-func createBackoff(retryIn, maxBackOff time.Duration) func() {
-	return func() {
-		log.Debugf("backoff called. will retry in %s.", retryIn)
-		time.Sleep(retryIn)
+// doubling back-off, returns the delay before the next attempt.
+// Delays are jittered between half and all of the backoff, so that failed downloads don't retry in lockstep.
+func createBackoff(retryIn, maxBackOff time.Duration) func() time.Duration {
+	return func() time.Duration {
+		delay := jitter(retryIn)
+		log.Debugf("backoff called. will retry in %s.", delay)
 		retryIn = retryIn * time.Duration(2)
 		if retryIn > maxBackOff {
 			retryIn = maxBackOff
 		}
+		return delay
+	}
+}
+
+var (
+	randMux    sync.Mutex
+	randSource = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
 	}
+	randMux.Lock()
+	defer randMux.Unlock()
+	return d/2 + time.Duration(randSource.Int63n(int64(d/2)+1))
+}
+
+func randFloat64() float64 {
+	randMux.Lock()
+	defer randMux.Unlock()
+	return randSource.Float64()
 }
 
 type timeoutError struct {
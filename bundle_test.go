@@ -15,7 +15,16 @@
 package apiGatewayConfDeploy
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path"
 
 	"github.com/apid/apid-core/util"
 
@@ -38,10 +47,32 @@ var _ = Describe("api", func() {
 	var dummyApiMan *dummyApiManager
 	var blobServer *dummyBlobServer
 
-	var _ = BeforeEach(func() {
-		// testCount += 1
+	// newTestBundleManager returns a bundle manager whose downloads aren't started yet
+	newTestBundleManager := func() *bundleManager {
 		concurrentDownloads := 5
 		downloadQueueSize := 5
+		return &bundleManager{
+			mirrors:               newMirrorSet([]string{bundleTestUrl}, mirrorPolicyFailover),
+			dbMan:                 dummyDbMan,
+			apiMan:                dummyApiMan,
+			concurrentDownloads:   concurrentDownloads,
+			markConfigFailedAfter: 5 * time.Second,
+			bundleRetryDelay:      time.Second,
+			bundleCleanupDelay:    5 * time.Second,
+			downloadQueue:         newDownloadQueue(downloadQueueSize),
+			breaker:               newCircuitBreaker(5, 500*time.Millisecond),
+			isClosed:              new(int32),
+			client: &http.Client{
+				Timeout: time.Second,
+				Transport: &http.Transport{
+					MaxIdleConnsPerHost: 10,
+				},
+			},
+		}
+	}
+
+	var _ = BeforeEach(func() {
+		// testCount += 1
 
 		// init test blob server
 		if blobServer == nil {
@@ -51,13 +82,16 @@ var _ = Describe("api", func() {
 				signedTimeout:  new(int32),
 				blobTimeout:    new(int32),
 				resetTimeout:   true,
+				signedStatus:   new(int32),
 			}
 			blobServer.start()
 		}
 
 		// init dummy db manager
 		dummyDbMan = &dummyDbManager{
-			fileResponse: make(chan string),
+			fileResponse:       make(chan string),
+			quarantineResponse: make(chan string),
+			failureResponse:    make(chan bool),
 		}
 
 		// init dummy api manager
@@ -67,28 +101,13 @@ var _ = Describe("api", func() {
 		}
 
 		// init bundle manager
-		testBundleMan = &bundleManager{
-			blobServerUrl:         bundleTestUrl,
-			dbMan:                 dummyDbMan,
-			apiMan:                dummyApiMan,
-			concurrentDownloads:   concurrentDownloads,
-			markConfigFailedAfter: 5 * time.Second,
-			bundleRetryDelay:      time.Second,
-			bundleCleanupDelay:    5 * time.Second,
-			downloadQueue:         make(chan *DownloadRequest, downloadQueueSize),
-			isClosed:              new(int32),
-			client: &http.Client{
-				Timeout: time.Second,
-				Transport: &http.Transport{
-					MaxIdleConnsPerHost: 10,
-				},
-			},
-		}
+		testBundleMan = newTestBundleManager()
 		testBundleMan.initializeBundleDownloading()
 		time.Sleep(100 * time.Millisecond)
 	})
 
 	var _ = AfterEach(func() {
+		atomic.StoreInt32(blobServer.signedStatus, 0)
 		testBundleMan.Close()
 		testBundleMan = nil
 		dummyDbMan = nil
@@ -100,9 +119,23 @@ var _ = Describe("api", func() {
 		It("should download blob according to id", func() {
 			// download blob
 			id := util.GenerateUUID()
-			testBundleMan.enqueueRequest(testBundleMan.makeDownloadRequest(id, nil))
+			testBundleMan.enqueueRequest(testBundleMan.makeDownloadRequest(id, priorityBackfill, nil))
+			received := <-dummyDbMan.fileResponse
+			Expect(received).Should(Equal(id))
+		})
+
+		It("should record the metadata of downloaded blobs", func() {
+			id := util.GenerateUUID()
+			testBundleMan.enqueueRequest(testBundleMan.makeDownloadRequest(id, priorityBackfill, nil))
 			received := <-dummyDbMan.fileResponse
 			Expect(received).Should(Equal(id))
+			meta := dummyDbMan.blobMeta
+			digest := sha256.Sum256([]byte(id))
+			Expect(meta.Size).Should(Equal(int64(len(id))))
+			Expect(meta.Digest).Should(Equal(hex.EncodeToString(digest[:])))
+			Expect(meta.Source).Should(Equal(bundleTestUrl))
+			Expect(meta.ContentType).ShouldNot(BeEmpty())
+			Expect(meta.DownloadedAt).Should(BeTemporally("~", time.Now(), time.Second))
 		})
 
 		It("should timeout connection and retry", func() {
@@ -114,7 +147,7 @@ var _ = Describe("api", func() {
 
 			// download blobs
 			id := util.GenerateUUID()
-			testBundleMan.enqueueRequest(testBundleMan.makeDownloadRequest(id, nil))
+			testBundleMan.enqueueRequest(testBundleMan.makeDownloadRequest(id, priorityBackfill, nil))
 			received := <-dummyDbMan.fileResponse
 			Expect(received).Should(Equal(id))
 
@@ -130,7 +163,7 @@ var _ = Describe("api", func() {
 
 			// download blobs
 			id := util.GenerateUUID()
-			req := testBundleMan.makeDownloadRequest(id, nil)
+			req := testBundleMan.makeDownloadRequest(id, priorityBackfill, nil)
 			Expect(req.markFailedAt.After(time.Now())).Should(BeTrue())
 			testBundleMan.enqueueRequest(req)
 
@@ -139,6 +172,255 @@ var _ = Describe("api", func() {
 			Expect(req.markFailedAt.IsZero()).Should(BeTrue())
 		}, 4)
 
+		It("should not retry permanent failures", func() {
+			atomic.StoreInt32(blobServer.signedStatus, http.StatusNotFound)
+			testBundleMan.bundleRetryDelay = 50 * time.Millisecond
+			id := util.GenerateUUID()
+			testBundleMan.enqueueRequest(testBundleMan.makeDownloadRequest(id, priorityBackfill, nil))
+			Expect(<-dummyDbMan.failureResponse).Should(BeTrue())
+			Consistently(dummyDbMan.failureResponse, 300*time.Millisecond).ShouldNot(Receive())
+		}, 2)
+
+		It("should retry transient failures after Retry-After", func() {
+			atomic.StoreInt32(blobServer.signedStatus, http.StatusTooManyRequests)
+			testBundleMan.bundleRetryDelay = 50 * time.Millisecond
+			id := util.GenerateUUID()
+			start := time.Now()
+			testBundleMan.enqueueRequest(testBundleMan.makeDownloadRequest(id, priorityBackfill, nil))
+			Expect(<-dummyDbMan.failureResponse).Should(BeFalse())
+			atomic.StoreInt32(blobServer.signedStatus, 0)
+			received := <-dummyDbMan.fileResponse
+			Expect(received).Should(Equal(id))
+			Expect(time.Since(start)).Should(BeNumerically(">=", time.Second))
+		}, 3)
+
+		It("should pause downloads while the circuit breaker is open", func() {
+			atomic.StoreInt32(blobServer.signedStatus, http.StatusServiceUnavailable)
+			// the workers read the breaker, restart them with a lower threshold.
+			// A single worker can't download while the breaker is open.
+			testBundleMan.Close()
+			testBundleMan = newTestBundleManager()
+			testBundleMan.concurrentDownloads = 1
+			testBundleMan.bundleRetryDelay = 10 * time.Millisecond
+			testBundleMan.breaker = newCircuitBreaker(2, 500*time.Millisecond)
+			testBundleMan.initializeBundleDownloading()
+			id := util.GenerateUUID()
+			testBundleMan.enqueueRequest(testBundleMan.makeDownloadRequest(id, priorityBackfill, nil))
+			Expect(<-dummyDbMan.failureResponse).Should(BeFalse())
+			Expect(<-dummyDbMan.failureResponse).Should(BeFalse())
+			Expect(testBundleMan.status().BlobServer.State).Should(Equal(breakerOpen))
+			Consistently(dummyDbMan.failureResponse, 300*time.Millisecond).ShouldNot(Receive())
+
+			// the probe succeeds once the server is back
+			atomic.StoreInt32(blobServer.signedStatus, 0)
+			received := <-dummyDbMan.fileResponse
+			Expect(received).Should(Equal(id))
+			Eventually(func() string {
+				return testBundleMan.status().BlobServer.State
+			}).Should(Equal(breakerClosed))
+		}, 3)
+
+		It("should download from the next mirror if the first is unavailable", func() {
+			testBundleMan.mirrors = newMirrorSet([]string{"http://127.0.0.1:1", bundleTestUrl}, mirrorPolicyFailover)
+			id := util.GenerateUUID()
+			testBundleMan.enqueueRequest(testBundleMan.makeDownloadRequest(id, priorityBackfill, nil))
+			received := <-dummyDbMan.fileResponse
+			Expect(received).Should(Equal(id))
+			Expect(testBundleMan.status().Mirrors[0].Healthy).Should(BeFalse())
+			Expect(testBundleMan.status().BlobServer.ConsecutiveFailures).Should(BeZero())
+		})
+
+		It("should resize the worker pool", func() {
+			Eventually(func() int {
+				return testBundleMan.getWorkerPool().Active
+			}).Should(Equal(5))
+			Expect(testBundleMan.setWorkerPool(workerPoolStatus{Size: 2, Min: 1, Max: 5})).Should(Succeed())
+			Eventually(func() int {
+				return testBundleMan.getWorkerPool().Active
+			}).Should(Equal(2))
+			Expect(testBundleMan.setWorkerPool(workerPoolStatus{Size: 3, Min: 1, Max: 5})).Should(Succeed())
+			Expect(testBundleMan.getWorkerPool().Active).Should(Equal(3))
+
+			// the remaining workers still download
+			id := util.GenerateUUID()
+			testBundleMan.enqueueRequest(testBundleMan.makeDownloadRequest(id, priorityBackfill, nil))
+			received := <-dummyDbMan.fileResponse
+			Expect(received).Should(Equal(id))
+
+			// adaptive mode keeps the size within bounds
+			Expect(testBundleMan.setWorkerPool(workerPoolStatus{Adaptive: true, Min: 4, Max: 5})).Should(Succeed())
+			Expect(testBundleMan.getWorkerPool().Size).Should(Equal(4))
+			Expect(testBundleMan.setWorkerPool(workerPoolStatus{Size: 0, Min: 1, Max: 5})).ShouldNot(Succeed())
+		})
+
+		It("should resize the worker pool when the config changes", func() {
+			oldSize := config.GetInt(configConcurrentDownloads)
+			defer config.Set(configConcurrentDownloads, oldSize)
+			testBundleMan.pool.tick()
+			Expect(testBundleMan.getWorkerPool().Size).Should(Equal(5))
+			config.Set(configConcurrentDownloads, 2)
+			testBundleMan.pool.tick()
+			Expect(testBundleMan.getWorkerPool().Size).Should(Equal(2))
+			Eventually(func() int {
+				return testBundleMan.getWorkerPool().Active
+			}).Should(Equal(2))
+		})
+
+		It("should cancel downloads and persist the queue on Close", func() {
+			Expect(testBundleMan.setWorkerPool(workerPoolStatus{Size: 1, Min: 1, Max: 5})).Should(Succeed())
+			Eventually(func() int {
+				return testBundleMan.getWorkerPool().Active
+			}).Should(Equal(1))
+			atomic.StoreInt32(blobServer.blobTimeout, 1)
+			testBundleMan.client.Timeout = 5 * time.Second
+
+			// the first download hangs, the second one waits in the queue
+			inFlight := util.GenerateUUID()
+			queued := util.GenerateUUID()
+			testBundleMan.enqueueRequest(testBundleMan.makeDownloadRequest(inFlight, priorityBackfill, nil))
+			testBundleMan.enqueueRequest(testBundleMan.makeDownloadRequest(queued, priorityChangeList, nil))
+			time.Sleep(200 * time.Millisecond)
+
+			start := time.Now()
+			testBundleMan.Close()
+			Expect(time.Since(start)).Should(BeNumerically("<", 500*time.Millisecond))
+			Expect(dummyDbMan.takePendingDownloads()).Should(Equal(map[string]int{
+				inFlight: priorityBackfill,
+				queued:   priorityChangeList,
+			}))
+			Consistently(dummyDbMan.fileResponse, 300*time.Millisecond).ShouldNot(Receive())
+
+			// closing twice is a no-op
+			testBundleMan.Close()
+		})
+
+		It("should cancel retries of blobs no longer referenced", func() {
+			atomic.StoreInt32(blobServer.signedStatus, http.StatusTooManyRequests)
+			id := util.GenerateUUID()
+			testBundleMan.enqueueRequest(testBundleMan.makeDownloadRequest(id, priorityBackfill, nil))
+			Expect(<-dummyDbMan.failureResponse).Should(BeFalse())
+			Eventually(func() int {
+				return testBundleMan.status().Delayed
+			}).Should(Equal(1))
+
+			// still referenced
+			dummyDbMan.blobReferenced = true
+			testBundleMan.deleteBlobById(id)
+			Expect(testBundleMan.status().Delayed).Should(Equal(1))
+
+			dummyDbMan.blobReferenced = false
+			testBundleMan.deleteBlobById(id)
+			Expect(testBundleMan.status().Delayed).Should(BeZero())
+			atomic.StoreInt32(blobServer.signedStatus, 0)
+			Consistently(dummyDbMan.fileResponse, 1500*time.Millisecond).ShouldNot(Receive())
+		}, 3)
+
+		It("should interrupt downloads of blobs no longer referenced", func() {
+			atomic.StoreInt32(blobServer.blobTimeout, 1)
+			testBundleMan.client.Timeout = 5 * time.Second
+			id := util.GenerateUUID()
+			p := testBundleMan.fetchBlob(id)
+			time.Sleep(200 * time.Millisecond)
+
+			start := time.Now()
+			testBundleMan.deleteBlobById(id)
+			Eventually(func() bool {
+				p.mu.Lock()
+				defer p.mu.Unlock()
+				return p.done
+			}).Should(BeTrue())
+			Expect(time.Since(start)).Should(BeNumerically("<", 500*time.Millisecond))
+			Expect(p.err).Should(Equal(errDownloadCancelled))
+			Expect(testBundleMan.getWorkerPool().Active).Should(Equal(5))
+			Consistently(dummyDbMan.fileResponse, time.Second).ShouldNot(Receive())
+			_, err := os.Stat(getPartialFilePath(id))
+			Expect(os.IsNotExist(err)).Should(BeTrue())
+		}, 3)
+
+		It("should purge blobs of old revisions after the cleanup delay", func() {
+			files := make(map[string]string)
+			for _, id := range []string{"retained", "old", "other"} {
+				f, err := ioutil.TempFile(bundlePath, id)
+				Expect(err).Should(Succeed())
+				f.Close()
+				files[id] = f.Name()
+			}
+			defer os.Remove(files["retained"])
+			dummyDbMan.unreferencedBlobs = map[string]string{"retained": files["retained"], "old": files["old"]}
+			dummyDbMan.retainedBlobs = map[string]bool{"retained": true}
+			dummyDbMan.purgedBlobs = make(chan string, len(files))
+			testBundleMan.historyMaxAge = time.Hour
+			defer func() {
+				testBundleMan.historyMaxAge = 0
+			}()
+			testBundleMan.purgeBlobs()
+			Expect(dummyDbMan.prunedBefore).Should(BeTemporally("~", time.Now().Add(-time.Hour), time.Second))
+			Expect(dummyDbMan.purgedBlobs).Should(Receive(Equal("old")))
+			Expect(dummyDbMan.purgedBlobs).ShouldNot(Receive())
+			_, err := os.Stat(files["old"])
+			Expect(os.IsNotExist(err)).Should(BeTrue())
+			_, err = os.Stat(files["retained"])
+			Expect(err).Should(Succeed())
+
+			// referenced again meanwhile
+			dummyDbMan.unreferencedBlobs = map[string]string{"other": files["other"]}
+			dummyDbMan.blobReferenced = true
+			testBundleMan.purgeBlobs()
+			Expect(dummyDbMan.purgedBlobs).ShouldNot(Receive())
+
+			dummyDbMan.blobReferenced = false
+			testBundleMan.bundleCleanupDelay = 100 * time.Millisecond
+			testBundleMan.deleteBlobs([]string{"other"})
+			Consistently(dummyDbMan.purgedBlobs, 50*time.Millisecond).ShouldNot(Receive())
+			Eventually(dummyDbMan.purgedBlobs).Should(Receive(Equal("other")))
+			_, err = os.Stat(files["other"])
+			Expect(os.IsNotExist(err)).Should(BeTrue())
+		}, 3)
+
+		It("should remove the partial files of unreferenced blobs", func() {
+			Expect(os.MkdirAll(path.Join(bundlePath, partialDir), 0700)).Should(Succeed())
+			writePartial := func(id string) string {
+				fileName := getPartialFilePath(id)
+				Expect(ioutil.WriteFile(fileName, []byte("partial"), 0600)).Should(Succeed())
+				Expect(ioutil.WriteFile(fileName+partialValidatorExt, []byte(`"etag"`), 0600)).Should(Succeed())
+				return fileName
+			}
+			exists := func(fileName string) bool {
+				_, err := os.Stat(fileName)
+				return err == nil
+			}
+			id := util.GenerateUUID()
+			fileName := writePartial(id)
+			dummyDbMan.blobReferenced = true
+			testBundleMan.purgePartialBlobs()
+			Expect(exists(fileName)).Should(BeTrue())
+
+			dummyDbMan.blobReferenced = false
+			testBundleMan.purgePartialBlobs()
+			Expect(exists(fileName)).Should(BeFalse())
+			Expect(exists(fileName + partialValidatorExt)).Should(BeFalse())
+
+			// a blob that isn't queued, e.g. after its download failed for good
+			fileName = writePartial(id)
+			testBundleMan.cancelDownloads(id)
+			Expect(exists(fileName)).Should(BeFalse())
+			Expect(exists(fileName + partialValidatorExt)).Should(BeFalse())
+		})
+
+		It("should download blobs on demand and track progress", func() {
+			id := util.GenerateUUID()
+			p := testBundleMan.fetchBlob(id)
+			received := <-dummyDbMan.fileResponse
+			Expect(received).Should(Equal(id))
+			Eventually(func() bool {
+				p.mu.Lock()
+				defer p.mu.Unlock()
+				return p.done
+			}).Should(BeTrue())
+			Expect(p.err).Should(BeNil())
+			Expect(p.received).Should(Equal(int64(len(id))))
+		})
+
 		It("should call callback func after a round of download attempts", func() {
 			// download blobs
 			var ids []string
@@ -147,7 +429,7 @@ var _ = Describe("api", func() {
 				ids = append(ids, util.GenerateUUID())
 			}
 			finishChan := make(chan int)
-			testBundleMan.downloadBlobsWithCallback(ids, func() {
+			testBundleMan.downloadBlobsWithCallback(ids, nil, func() {
 				finishChan <- 1
 			})
 			for i := 0; i < num; i++ {
@@ -155,13 +437,51 @@ var _ = Describe("api", func() {
 			}
 			<-finishChan
 			// if there's no blob
-			testBundleMan.downloadBlobsWithCallback(nil, func() {
+			testBundleMan.downloadBlobsWithCallback(nil, nil, func() {
 				finishChan <- 1
 			})
 			<-finishChan
 		}, 1)
 	})
 
+	Context("verify blobs", func() {
+		var signKey *ecdsa.PrivateKey
+
+		var _ = BeforeEach(func() {
+			var err error
+			signKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).Should(Succeed())
+			testBundleMan.verifier = &blobVerifier{
+				keys: []crypto.PublicKey{&signKey.PublicKey},
+			}
+		})
+
+		var _ = AfterEach(func() {
+			blobServer.signKey = nil
+		})
+
+		It("should make blobs with valid signature available", func() {
+			blobServer.signKey = signKey
+			id := util.GenerateUUID()
+			testBundleMan.enqueueRequest(testBundleMan.makeDownloadRequest(id, priorityBackfill, nil))
+			received := <-dummyDbMan.fileResponse
+			Expect(received).Should(Equal(id))
+		})
+
+		It("should quarantine blobs failing verification without retry", func() {
+			untrusted, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).Should(Succeed())
+			blobServer.signKey = untrusted
+			testBundleMan.bundleRetryDelay = 50 * time.Millisecond
+			id := util.GenerateUUID()
+			testBundleMan.enqueueRequest(testBundleMan.makeDownloadRequest(id, priorityBackfill, nil))
+			Expect(<-dummyDbMan.quarantineResponse).Should(Equal(id))
+			_, err = os.Stat(path.Join(bundlePath, quarantineDir))
+			Expect(err).Should(Succeed())
+			Consistently(dummyDbMan.quarantineResponse, 300*time.Millisecond).ShouldNot(Receive())
+		}, 2)
+	})
+
 	Context("download blobs for changelist", func() {
 		It("should download blobs for changelist", func() {
 			//setup test data
@@ -175,7 +495,7 @@ var _ = Describe("api", func() {
 			}
 
 			// should download blobs for changelist
-			testBundleMan.downloadBlobsWithCallback(extractBlobsToDownload(configs), dummyApiMan.notifyNewChange)
+			testBundleMan.downloadBlobsWithCallback(extractBlobsToDownload(configs), blobPriorities(configs, priorityChangeList), dummyApiMan.notifyNewChange)
 			for i := 0; i < 2*count; i++ {
 				<-dummyDbMan.fileResponse
 			}
@@ -202,7 +522,7 @@ var _ = Describe("api", func() {
 			testBundleMan.bundleRetryDelay = 50 * time.Millisecond
 
 			// should download blobs for changelist
-			testBundleMan.downloadBlobsWithCallback(extractBlobsToDownload(configs), dummyApiMan.notifyNewChange)
+			testBundleMan.downloadBlobsWithCallback(extractBlobsToDownload(configs), blobPriorities(configs, priorityChangeList), dummyApiMan.notifyNewChange)
 
 			// should notify after 1st download attempt
 			<-dummyApiMan.notifyChan
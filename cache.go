@@ -0,0 +1,127 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package apiGatewayConfDeploy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	encodingGzip = "gzip"
+	// entries of a snapshot are dropped beyond this, e.g. when pins change often
+	maxCachedResponses = 64
+)
+
+// responseCache keeps the serialized configuration listings of the current snapshot,
+// so that gateways woken up together by a change cost one serialization.
+type responseCache struct {
+	mu       sync.Mutex
+	snapshot *configSnapshot
+	entries  map[string]*cachedResponse
+}
+
+// cachedResponse is generated once, the requests that come meanwhile wait for it
+type cachedResponse struct {
+	done chan struct{}
+	body []byte
+	err  error
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{
+		entries: make(map[string]*cachedResponse),
+	}
+}
+
+// get returns the response of the snapshot with the key, generated by the first caller.
+// Responses of another snapshot are dropped, only the latest snapshot is cached.
+// Failed generations aren't cached.
+func (c *responseCache) get(snapshot *configSnapshot, key string, generate func() ([]byte, error)) ([]byte, error) {
+	c.mu.Lock()
+	if c.snapshot != snapshot || len(c.entries) >= maxCachedResponses {
+		c.snapshot = snapshot
+		c.entries = make(map[string]*cachedResponse)
+	}
+	if r, ok := c.entries[key]; ok {
+		c.mu.Unlock()
+		<-r.done
+		return r.body, r.err
+	}
+	r := &cachedResponse{done: make(chan struct{})}
+	c.entries[key] = r
+	c.mu.Unlock()
+
+	r.body, r.err = generate()
+	if r.err != nil {
+		c.mu.Lock()
+		if c.entries[key] == r {
+			delete(c.entries, key)
+		}
+		c.mu.Unlock()
+	}
+	close(r.done)
+	return r.body, r.err
+}
+
+// responseCacheKey identifies a listing of a snapshot by type filter, encoding and pins
+func responseCacheKey(typeFilter, encoding string, pins []configPin) string {
+	key := []string{typeFilter, encoding}
+	for i := range pins {
+		key = append(key, pins[i].ID+"@"+pins[i].Revision+"@"+pins[i].Lsn+"@"+formatDbTime(pins[i].PinnedAt))
+	}
+	return strings.Join(key, "\x00")
+}
+
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// acceptsGzip returns true if the Accept-Encoding header allows gzip.
+// Codings are case-insensitive, a q value of 0 (or one that can't be parsed) refuses the coding.
+func acceptsGzip(acceptEncoding string) bool {
+	anyOk := false
+	for _, enc := range strings.Split(strings.ToLower(acceptEncoding), ",") {
+		params := strings.Split(enc, ";")
+		enc = strings.TrimSpace(params[0])
+		accepted := true
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			q, err := strconv.ParseFloat(strings.TrimSpace(param[2:]), 64)
+			accepted = err == nil && q > 0
+		}
+		switch enc {
+		case encodingGzip:
+			// an explicit gzip overrides *
+			return accepted
+		case "*":
+			anyOk = accepted
+		}
+	}
+	return anyOk
+}
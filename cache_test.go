@@ -0,0 +1,106 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayConfDeploy
+
+import (
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var _ = Describe("response cache", func() {
+	var cache *responseCache
+	var snapshot *configSnapshot
+
+	var _ = BeforeEach(func() {
+		cache = newResponseCache()
+		snapshot = newConfigSnapshot("1.0.0", []Configuration{*makeTestDeployment()})
+	})
+
+	It("should generate a response once for concurrent requests", func() {
+		var generated int32
+		release := make(chan struct{})
+		generate := func() ([]byte, error) {
+			atomic.AddInt32(&generated, 1)
+			<-release
+			return []byte("body"), nil
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				body, err := cache.get(snapshot, "key", generate)
+				Expect(err).Should(Succeed())
+				Expect(string(body)).Should(Equal("body"))
+			}()
+		}
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+		wg.Wait()
+		Expect(atomic.LoadInt32(&generated)).Should(Equal(int32(1)))
+
+		// other keys and snapshots are generated
+		_, err := cache.get(snapshot, "other", generate)
+		Expect(err).Should(Succeed())
+		_, err = cache.get(snapshot.withIndex(0, "2.0.0"), "key", generate)
+		Expect(err).Should(Succeed())
+		Expect(atomic.LoadInt32(&generated)).Should(Equal(int32(3)))
+	})
+
+	It("should not cache failures", func() {
+		_, err := cache.get(snapshot, "key", func() ([]byte, error) {
+			return nil, errors.New("failed")
+		})
+		Expect(err).ShouldNot(Succeed())
+		body, err := cache.get(snapshot, "key", func() ([]byte, error) {
+			return []byte("body"), nil
+		})
+		Expect(err).Should(Succeed())
+		Expect(string(body)).Should(Equal("body"))
+	})
+
+	It("should key responses by filter, encoding and pins", func() {
+		pin := configPin{Configuration: *makeTestDeployment(), Lsn: "0.1.0", PinnedAt: time.Now()}
+		unpinned := configPin{Configuration: pin.Configuration}
+		keys := make(map[string]bool)
+		keys[responseCacheKey("", "", nil)] = true
+		keys[responseCacheKey("ORGANIZATION", "", nil)] = true
+		keys[responseCacheKey("", encodingGzip, nil)] = true
+		keys[responseCacheKey("", "", []configPin{pin})] = true
+		keys[responseCacheKey("", "", []configPin{unpinned})] = true
+		Expect(keys).Should(HaveLen(5))
+	})
+
+	It("should parse Accept-Encoding", func() {
+		Expect(acceptsGzip("gzip")).Should(BeTrue())
+		Expect(acceptsGzip("deflate, gzip;q=0.5")).Should(BeTrue())
+		Expect(acceptsGzip("*")).Should(BeTrue())
+		Expect(acceptsGzip("")).Should(BeFalse())
+		Expect(acceptsGzip("deflate")).Should(BeFalse())
+		Expect(acceptsGzip("gzip;q=0")).Should(BeFalse())
+		Expect(acceptsGzip("GZIP")).Should(BeTrue())
+		Expect(acceptsGzip("Gzip; Q=0.8")).Should(BeTrue())
+		Expect(acceptsGzip("gzip;q=0.00")).Should(BeFalse())
+		Expect(acceptsGzip("gzip; q=0.000, deflate")).Should(BeFalse())
+		Expect(acceptsGzip("gzip;q=0.001")).Should(BeTrue())
+		Expect(acceptsGzip("*;q=0")).Should(BeFalse())
+		Expect(acceptsGzip("gzip;q=0, *")).Should(BeFalse())
+	})
+})
@@ -0,0 +1,93 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package apiGatewayConfDeploy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+const (
+	apidConfigCursorHeader = "x-apid-config-cursor"
+	// cursors are told apart from raw config indexes by their prefix
+	cursorPrefix = "c1."
+)
+
+var ErrInvalidCursor = errors.New(apidConfigIndexPar + " cursor is invalid")
+
+// configCursor is an opaque, signed config index given to clients in place of the raw index
+type configCursor struct {
+	// config index with its snapshot epoch, see formatConfigIndex
+	Index string `json:"index"`
+}
+
+// cursorSigner signs and verifies cursors with HMAC-SHA256
+type cursorSigner struct {
+	key []byte
+}
+
+// newCursorSigner returns a signer with the secret, or a random one if it's empty.
+// Cursors signed with a random secret fail verification after a restart.
+func newCursorSigner(secret string) (*cursorSigner, error) {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, sha256.Size)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &cursorSigner{key: key}, nil
+}
+
+func (s *cursorSigner) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// encode returns the cursor of the config index
+func (s *cursorSigner) encode(index string) string {
+	b, _ := json.Marshal(configCursor{Index: index})
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return cursorPrefix + payload + "." + s.sign(payload)
+}
+
+// decode verifies the cursor, and returns its config index
+func (s *cursorSigner) decode(token string) (*configCursor, error) {
+	parts := strings.Split(strings.TrimPrefix(token, cursorPrefix), ".")
+	if !strings.HasPrefix(token, cursorPrefix) || len(parts) != 2 {
+		return nil, ErrInvalidCursor
+	}
+	if !hmac.Equal([]byte(parts[1]), []byte(s.sign(parts[0]))) {
+		return nil, ErrInvalidCursor
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := &configCursor{}
+	if err = json.Unmarshal(b, c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+func isCursor(index string) bool {
+	return strings.HasPrefix(index, cursorPrefix)
+}
@@ -0,0 +1,83 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayConfDeploy
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http/httptest"
+	"strings"
+)
+
+var _ = Describe("config index cursors", func() {
+
+	It("should sign and verify cursors", func() {
+		signer, err := newCursorSigner("secret")
+		Expect(err).Should(Succeed())
+		token := signer.encode("1500000000-1.2.3")
+		Expect(isCursor(token)).Should(BeTrue())
+		Expect(isCursor("1500000000-1.2.3")).Should(BeFalse())
+		cursor, err := signer.decode(token)
+		Expect(err).Should(Succeed())
+		Expect(*cursor).Should(Equal(configCursor{Index: "1500000000-1.2.3"}))
+
+		// tampered, or signed with another secret
+		parts := strings.Split(token, ".")
+		other := strings.Split(signer.encode("1500000000-9.9.9"), ".")
+		forged := strings.Join([]string{parts[0], other[1], parts[2]}, ".")
+		for _, t := range []string{forged, token[:len(token)-1], "c1.", "c1.a.b.c", "1.2.3"} {
+			_, err = signer.decode(t)
+			Expect(err).Should(Equal(ErrInvalidCursor))
+		}
+		random, err := newCursorSigner("")
+		Expect(err).Should(Succeed())
+		_, err = random.decode(token)
+		Expect(err).Should(Equal(ErrInvalidCursor))
+	})
+
+	It("should reject requests with cursors failing verification", func() {
+		signer, err := newCursorSigner("secret")
+		Expect(err).Should(Succeed())
+		a := &apiManager{cursors: signer}
+		indexOf := func(index string) (string, error) {
+			req := httptest.NewRequest("GET", "/configurations", nil)
+			req.Header.Set(apidConfigIndexHeader, index)
+			return a.configIndexFromRequest(req)
+		}
+		index, err := indexOf(signer.encode("1500000000-1.2.3"))
+		Expect(err).Should(Succeed())
+		Expect(index).Should(Equal("1500000000-1.2.3"))
+		index, err = indexOf("1500000000-1.2.3")
+		Expect(err).Should(Succeed())
+		Expect(index).Should(Equal("1500000000-1.2.3"))
+
+		// answered with 400, e.g. cursors signed before a restart with a random secret
+		random, err := newCursorSigner("")
+		Expect(err).Should(Succeed())
+		_, err = indexOf(random.encode("1500000000-1.2.3"))
+		Expect(err).Should(Equal(ErrInvalidCursor))
+		a.cursors = nil
+		_, err = indexOf(signer.encode("1500000000-1.2.3"))
+		Expect(err).Should(Equal(ErrInvalidCursor))
+	})
+
+	It("should mark indexes of another snapshot epoch as superseded", func() {
+		a := &apiManager{dbMan: &dummyDbManager{epoch: 1500000000}}
+		Expect(a.isSupersededIndex("1500000000-1.2.3")).Should(BeFalse())
+		Expect(a.isSupersededIndex("")).Should(BeFalse())
+		Expect(a.isSupersededIndex("1400000000-1.2.3")).Should(BeTrue())
+		Expect(a.isSupersededIndex("1.2.3")).Should(BeTrue())
+	})
+})
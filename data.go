@@ -16,6 +16,8 @@ package apiGatewayConfDeploy
 import (
 	"database/sql"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/apid/apid-core"
 	"reflect"
@@ -45,6 +47,19 @@ type Configuration struct {
 	UpdatedBy      string
 }
 
+// blobMetadata describes a downloaded blob, recorded with its availability
+type blobMetadata struct {
+	LocalFsLocation string
+	Size            int64
+	ContentType     string
+	// hex encoded SHA-256 of the content
+	Digest       string
+	DownloadedAt time.Time
+	// blob server mirror the signed URL came from
+	Source       string
+	LastServedAt time.Time
+}
+
 type SQLExec interface {
 	Exec(query string, args ...interface{}) (sql.Result, error)
 }
@@ -54,12 +69,33 @@ type dbManagerInterface interface {
 	initDb() error
 	getUnreadyBlobs() ([]string, error)
 	getAllConfigurations(typeFilter string) ([]Configuration, error)
-	updateLocalFsLocation(string, string) error
+	updateLocalFsLocation(blobId, localFsLocation string, meta *blobMetadata) error
+	quarantineBlob(blobId, localFsLocation, reason string) error
+	updateBlobFailure(blobId, reason string, permanent bool) error
 	getLocalFSLocation(string) (string, error)
+	getBlobMetadata(blobId string) (*blobMetadata, error)
+	updateBlobServed(blobId string, servedAt time.Time) error
+	isBlobReferenced(blobId string) (bool, error)
+	getUnreferencedBlobs() (map[string]string, error)
+	getRetainedBlobs(retainByType map[string]int, retain int) (map[string]bool, error)
+	pruneConfigHistory(before time.Time, retainByType map[string]int, retain int) (int, error)
+	deleteBlobAvailability(blobId string) error
+	savePendingDownloads(priorities map[string]int) error
+	takePendingDownloads() (map[string]int, error)
 	getConfigById(string) (*Configuration, error)
+	recordConfigRevisions(lsn string, at time.Time, current, replaced, deleted []*Configuration) error
+	getConfigHistory(configId string) ([]configRevision, error)
+	getConfigurationsAsOf(asOf string, typeFilter string) ([]Configuration, error)
+	pinConfiguration(pin *configPin) error
+	unpinConfiguration(configId string) (*configPin, error)
+	getConfigPins() ([]configPin, error)
+	getConfigSnapshot() *configSnapshot
+	applyConfigChanges(lsn string, current, deleted []*Configuration)
 	loadLsnFromDb() error
 	updateLSN(LSN string) error
 	getLSN() string
+	getEpoch() int64
+	startSnapshotEpoch() error
 }
 
 type dbManager struct {
@@ -68,6 +104,15 @@ type dbManager struct {
 	dbMux    sync.RWMutex
 	apidLSN  string
 	lsnMutex sync.RWMutex
+	// snapshot epoch of apidLSN, see migrateSnapshotEpoch
+	apidEpoch int64
+	// db of the previous snapshot, until its history is copied by initDb
+	prevDb apid.DB
+	// *configSnapshot of the configurations in db, loaded by initDb
+	snapshot atomic.Value
+	// []configPin cached by getConfigPins, pinsMux serializes its changes
+	pins    atomic.Value
+	pinsMux sync.Mutex
 }
 
 func (dbc *dbManager) setDbVersion(version string) {
@@ -76,6 +121,9 @@ func (dbc *dbManager) setDbVersion(version string) {
 		log.Panicf("Unable to access database: %v", err)
 	}
 	dbc.dbMux.Lock()
+	if dbc.db != nil && dbc.db != db {
+		dbc.prevDb = dbc.db
+	}
 	dbc.db = db
 	dbc.dbMux.Unlock()
 }
@@ -96,10 +144,52 @@ func (dbc *dbManager) initDb() error {
 		// not on critical path, continue in case of error
 		log.Errorf("error in addIndexes(): %v", err)
 	}
+
+	dbc.dbMux.Lock()
+	prevDb := dbc.prevDb
+	dbc.prevDb = nil
+	dbc.dbMux.Unlock()
+
+	// the LSN carried over to a snapshot received at runtime doesn't identify its configurations,
+	// they're published under a new epoch
+	epoch := dbc.getEpoch()
+	if prevDb != nil {
+		epoch = nextSnapshotEpoch(epoch, time.Now())
+		if err := dbc.storeSnapshotEpoch(epoch); err != nil {
+			log.Errorf("error in storeSnapshotEpoch(): %v", err)
+		}
+	}
+	// configurations are read from the db until the snapshot is loaded
+	if err := dbc.loadConfigSnapshot(epoch); err != nil {
+		log.Errorf("error in loadConfigSnapshot(): %v", err)
+	}
+
+	// history is not on critical path either
+	if prevDb != nil {
+		// pins hold until they're removed or their configuration changes, not until the next snapshot
+		if n, err := copyConfigPins(prevDb, dbc.getDb()); err != nil {
+			log.Errorf("error in copyConfigPins(), pins of the previous snapshot are released: %v", err)
+		} else if n > 0 {
+			log.Warnf("%d configuration pins carried over to the new snapshot", n)
+		}
+		if err := copyConfigHistory(prevDb, dbc.getDb()); err != nil {
+			log.Errorf("error in copyConfigHistory(): %v", err)
+		}
+	}
+	dbc.resetConfigPins()
+	if err := seedConfigHistory(dbc.getDb(), formatConfigIndex(epoch, dbc.getLSN()), time.Now()); err != nil {
+		log.Errorf("error in seedConfigHistory(): %v", err)
+	}
 	return nil
 }
 
 func (dbc *dbManager) getConfigById(id string) (config *Configuration, err error) {
+	if snapshot := dbc.getConfigSnapshot(); snapshot != nil {
+		if config = snapshot.getConfigById(id); config == nil {
+			return nil, sql.ErrNoRows
+		}
+		return config, nil
+	}
 	row := dbc.getDb().QueryRow(`
 	SELECT 	a.id,
 			a.organization_id,
@@ -269,7 +359,15 @@ func (dbc *dbManager) getReadyConfigurations(typeFilter string) ([]Configuration
 
 }
 */
+// getAllConfigurations returns the configurations of the snapshot. The slice is shared, and must not be modified.
 func (dbc *dbManager) getAllConfigurations(typeFilter string) ([]Configuration, error) {
+	if snapshot := dbc.getConfigSnapshot(); snapshot != nil {
+		return snapshot.getConfigurations(typeFilter), nil
+	}
+	return dbc.queryConfigurations(typeFilter)
+}
+
+func (dbc *dbManager) queryConfigurations(typeFilter string) ([]Configuration, error) {
 
 	// An alternative statement is in get_ready_deployments.sql
 	// Need testing with large data volume to determine which is better
@@ -327,7 +425,45 @@ func (dbc *dbManager) getAllConfigurations(typeFilter string) ([]Configuration,
 
 }
 
-func (dbc *dbManager) updateLocalFsLocation(blobId, localFsLocation string) error {
+// getConfigSnapshot returns the in-memory configurations, nil until initDb loaded them
+func (dbc *dbManager) getConfigSnapshot() *configSnapshot {
+	snapshot, _ := dbc.snapshot.Load().(*configSnapshot)
+	return snapshot
+}
+
+// loadConfigSnapshot replaces the in-memory configurations with the ones in db, under the snapshot epoch.
+// The epoch changes together with the configurations, so that no client sees them under the previous one.
+func (dbc *dbManager) loadConfigSnapshot(epoch int64) error {
+	confs, err := dbc.queryConfigurations("")
+	dbc.lsnMutex.Lock()
+	defer dbc.lsnMutex.Unlock()
+	dbc.apidEpoch = epoch
+	if err != nil {
+		// the configurations of the previous db aren't current anymore
+		dbc.snapshot.Store((*configSnapshot)(nil))
+		return err
+	}
+	snapshot := newConfigSnapshot(dbc.apidLSN, confs)
+	snapshot.epoch = epoch
+	dbc.snapshot.Store(snapshot)
+	log.Debugf("loaded %d configurations in memory", len(confs))
+	return nil
+}
+
+// applyConfigChanges updates the in-memory configurations with a change list already applied to db
+func (dbc *dbManager) applyConfigChanges(lsn string, current, deleted []*Configuration) {
+	dbc.lsnMutex.Lock()
+	defer dbc.lsnMutex.Unlock()
+	if snapshot := dbc.getConfigSnapshot(); snapshot != nil {
+		dbc.snapshot.Store(snapshot.withChanges(lsn, current, deleted))
+	}
+}
+
+// updateLocalFsLocation makes the blob available. meta may be nil if the metadata is unknown.
+func (dbc *dbManager) updateLocalFsLocation(blobId, localFsLocation string, meta *blobMetadata) error {
+	if meta == nil {
+		meta = &blobMetadata{}
+	}
 	txn, err := dbc.getDb().Begin()
 	if err != nil {
 		return err
@@ -336,12 +472,28 @@ func (dbc *dbManager) updateLocalFsLocation(blobId, localFsLocation string) erro
 	_, err = txn.Exec(`
 		INSERT OR IGNORE INTO APID_BLOB_AVAILABLE (
 		id,
-		local_fs_location
-		) VALUES (?, ?);`, blobId, localFsLocation)
+		local_fs_location,
+		size,
+		content_type,
+		sha256,
+		downloaded_at,
+		source
+		) VALUES (?, ?, ?, ?, ?, ?, ?);`,
+		blobId, localFsLocation, meta.Size, meta.ContentType, meta.Digest, formatDbTime(meta.DownloadedAt), meta.Source)
 	if err != nil {
 		log.Errorf("INSERT APID_BLOB_AVAILABLE id {%s} local_fs_location {%s} failed", localFsLocation, err)
 		return err
 	}
+	_, err = txn.Exec(`DELETE FROM APID_BLOB_QUARANTINE WHERE id = ?;`, blobId)
+	if err != nil {
+		log.Errorf("DELETE APID_BLOB_QUARANTINE id {%s} failed: %v", blobId, err)
+		return err
+	}
+	_, err = txn.Exec(`DELETE FROM APID_BLOB_FAILURE WHERE id = ?;`, blobId)
+	if err != nil {
+		log.Errorf("DELETE APID_BLOB_FAILURE id {%s} failed: %v", blobId, err)
+		return err
+	}
 	err = txn.Commit()
 	if err != nil {
 		log.Errorf("UPDATE APID_BLOB_AVAILABLE id {%s} local_fs_location {%s} failed", localFsLocation, err)
@@ -353,6 +505,123 @@ func (dbc *dbManager) updateLocalFsLocation(blobId, localFsLocation string) erro
 
 }
 
+// quarantineBlob records a blob that was downloaded but failed verification.
+// A quarantined blob is never inserted into APID_BLOB_AVAILABLE.
+func (dbc *dbManager) quarantineBlob(blobId, localFsLocation, reason string) error {
+	txn, err := dbc.getDb().Begin()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+	_, err = txn.Exec(`
+		INSERT OR REPLACE INTO APID_BLOB_QUARANTINE (
+		id,
+		local_fs_location,
+		reason,
+		quarantined_at
+		) VALUES (?, ?, ?, ?);`, blobId, localFsLocation, reason, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		log.Errorf("INSERT APID_BLOB_QUARANTINE id {%s} failed: %v", blobId, err)
+		return err
+	}
+	if err = txn.Commit(); err != nil {
+		log.Errorf("INSERT APID_BLOB_QUARANTINE id {%s} failed: %v", blobId, err)
+		return err
+	}
+	log.Debugf("INSERT APID_BLOB_QUARANTINE {%s} succeeded", blobId)
+	return nil
+}
+
+// updateBlobFailure records a failed download attempt of a blob.
+// permanent is true if the download was given up.
+func (dbc *dbManager) updateBlobFailure(blobId, reason string, permanent bool) error {
+	txn, err := dbc.getDb().Begin()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+	_, err = txn.Exec(`
+		INSERT OR REPLACE INTO APID_BLOB_FAILURE (
+		id,
+		reason,
+		permanent,
+		attempts,
+		last_attempt_at
+		) VALUES (?, ?, ?,
+		COALESCE((SELECT attempts FROM APID_BLOB_FAILURE WHERE id = ?), 0) + 1,
+		?);`, blobId, reason, permanent, blobId, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		log.Errorf("INSERT APID_BLOB_FAILURE id {%s} failed: %v", blobId, err)
+		return err
+	}
+	if err = txn.Commit(); err != nil {
+		log.Errorf("INSERT APID_BLOB_FAILURE id {%s} failed: %v", blobId, err)
+		return err
+	}
+	return nil
+}
+
+// savePendingDownloads replaces the blobs to download after restart, with their priority
+func (dbc *dbManager) savePendingDownloads(priorities map[string]int) error {
+	txn, err := dbc.getDb().Begin()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+	if _, err = txn.Exec(`DELETE FROM APID_BLOB_PENDING;`); err != nil {
+		log.Errorf("DELETE APID_BLOB_PENDING failed: %v", err)
+		return err
+	}
+	for blobId, priority := range priorities {
+		_, err = txn.Exec(`INSERT INTO APID_BLOB_PENDING (id, priority) VALUES (?, ?);`, blobId, priority)
+		if err != nil {
+			log.Errorf("INSERT APID_BLOB_PENDING id {%s} failed: %v", blobId, err)
+			return err
+		}
+	}
+	if err = txn.Commit(); err != nil {
+		log.Errorf("INSERT APID_BLOB_PENDING failed: %v", err)
+		return err
+	}
+	return nil
+}
+
+// takePendingDownloads returns and removes the blobs persisted by savePendingDownloads
+func (dbc *dbManager) takePendingDownloads() (map[string]int, error) {
+	txn, err := dbc.getDb().Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Rollback()
+	rows, err := txn.Query(`SELECT id, priority FROM APID_BLOB_PENDING;`)
+	if err != nil {
+		log.Errorf("SELECT APID_BLOB_PENDING failed: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	priorities := make(map[string]int)
+	for rows.Next() {
+		var blobId string
+		var priority int
+		if err = rows.Scan(&blobId, &priority); err != nil {
+			return nil, err
+		}
+		priorities[blobId] = priority
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	if _, err = txn.Exec(`DELETE FROM APID_BLOB_PENDING;`); err != nil {
+		log.Errorf("DELETE APID_BLOB_PENDING failed: %v", err)
+		return nil, err
+	}
+	if err = txn.Commit(); err != nil {
+		return nil, err
+	}
+	return priorities, nil
+}
+
 func (dbc *dbManager) getLocalFSLocation(blobId string) (string, error) {
 
 	log.Debugf("Getting the blob file for blobId {%s}", blobId)
@@ -371,12 +640,113 @@ func (dbc *dbManager) getLocalFSLocation(blobId string) (string, error) {
 	return "", nil
 }
 
+// getBlobMetadata returns the location and metadata of an available blob, or sql.ErrNoRows
+func (dbc *dbManager) getBlobMetadata(blobId string) (*blobMetadata, error) {
+	var location, contentType, digest, downloadedAt, source, lastServedAt sql.NullString
+	var size sql.NullInt64
+	err := dbc.getDb().QueryRow(`
+	SELECT local_fs_location, size, content_type, sha256, downloaded_at, source, last_served_at
+	FROM APID_BLOB_AVAILABLE WHERE id = ?;
+	`, blobId).Scan(&location, &size, &contentType, &digest, &downloadedAt, &source, &lastServedAt)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Errorf("SELECT APID_BLOB_AVAILABLE id {%s} failed %v", blobId, err)
+		}
+		return nil, err
+	}
+	return &blobMetadata{
+		LocalFsLocation: location.String,
+		Size:            size.Int64,
+		ContentType:     contentType.String,
+		Digest:          digest.String,
+		DownloadedAt:    parseDbTime(downloadedAt.String),
+		Source:          source.String,
+		LastServedAt:    parseDbTime(lastServedAt.String),
+	}, nil
+}
+
+// updateBlobServed records the last time the blob was sent to a gateway
+func (dbc *dbManager) updateBlobServed(blobId string, servedAt time.Time) error {
+	_, err := dbc.getDb().Exec(`UPDATE APID_BLOB_AVAILABLE SET last_served_at = ? WHERE id = ?;`, formatDbTime(servedAt), blobId)
+	if err != nil {
+		log.Errorf("UPDATE APID_BLOB_AVAILABLE last_served_at id {%s} failed: %v", blobId, err)
+	}
+	return err
+}
+
+// formatDbTime formats times stored by the plugin, the zero time is stored as an empty string
+func formatDbTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func parseDbTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// isBlobReferenced returns true if the blob belongs to a configuration, or to a pinned revision
+func (dbc *dbManager) isBlobReferenced(blobId string) (bool, error) {
+	var count int
+	err := dbc.getDb().QueryRow(`
+	SELECT (SELECT count(*) FROM METADATA_RUNTIME_ENTITY_METADATA
+		WHERE bean_blob_id = ? OR resource_blob_id = ?)
+	+ (SELECT count(*) FROM APID_CONFIGURATION_PIN
+		WHERE bean_blob_id = ? OR resource_blob_id = ?);
+	`, blobId, blobId, blobId, blobId).Scan(&count)
+	if err != nil {
+		log.Errorf("SELECT METADATA_RUNTIME_ENTITY_METADATA by blob id failed %v", err)
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// getUnreferencedBlobs returns the location of available blobs that no configuration or pin references, by blob id
+func (dbc *dbManager) getUnreferencedBlobs() (map[string]string, error) {
+	rows, err := dbc.getDb().Query(`
+	SELECT b.id, b.local_fs_location FROM APID_BLOB_AVAILABLE AS b
+	WHERE NOT EXISTS (SELECT 1 FROM METADATA_RUNTIME_ENTITY_METADATA AS a
+		WHERE a.bean_blob_id = b.id OR a.resource_blob_id = b.id)
+	AND NOT EXISTS (SELECT 1 FROM APID_CONFIGURATION_PIN AS p
+		WHERE p.bean_blob_id = b.id OR p.resource_blob_id = b.id);
+	`)
+	if err != nil {
+		log.Errorf("SELECT unreferenced APID_BLOB_AVAILABLE failed %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	blobs := make(map[string]string)
+	for rows.Next() {
+		var id, location string
+		if err = rows.Scan(&id, &location); err != nil {
+			return nil, err
+		}
+		blobs[id] = location
+	}
+	return blobs, rows.Err()
+}
+
+// deleteBlobAvailability forgets a blob together with its metadata, before its file is removed
+func (dbc *dbManager) deleteBlobAvailability(blobId string) error {
+	_, err := dbc.getDb().Exec("DELETE FROM APID_BLOB_AVAILABLE WHERE id = ?;", blobId)
+	if err != nil {
+		log.Errorf("DELETE APID_BLOB_AVAILABLE Failed: %v", err)
+	}
+	return err
+}
+
 func (dbc *dbManager) loadLsnFromDb() error {
 	var LSN sql.NullString
+	var epoch sql.NullInt64
 	ret := InitLSN
 
 	// If there's LSN for configuration
-	err := dbc.getDb().QueryRow("select lsn from APID_CONFIGURATION_LSN LIMIT 1").Scan(&LSN)
+	err := dbc.getDb().QueryRow("select lsn, epoch from APID_CONFIGURATION_LSN LIMIT 1").Scan(&LSN, &epoch)
 	if err != nil && err != sql.ErrNoRows {
 		log.Errorf("Failed to select lsn from APID_CONFIGURATION_LSN: %v", err)
 		return err
@@ -388,6 +758,8 @@ func (dbc *dbManager) loadLsnFromDb() error {
 	dbc.lsnMutex.Lock()
 	defer dbc.lsnMutex.Unlock()
 	dbc.apidLSN = ret
+	dbc.apidEpoch = epoch.Int64
+	dbc.setSnapshotLSN(ret)
 	return nil
 }
 
@@ -418,9 +790,48 @@ func (dbc *dbManager) updateLSN(LSN string) (err error) {
 	dbc.lsnMutex.Lock()
 	defer dbc.lsnMutex.Unlock()
 	dbc.apidLSN = LSN
+	dbc.setSnapshotLSN(LSN)
 	return
 }
 
+// getEpoch returns the snapshot epoch of the LSN, 0 until a snapshot is processed
+func (dbc *dbManager) getEpoch() int64 {
+	dbc.lsnMutex.RLock()
+	defer dbc.lsnMutex.RUnlock()
+	return dbc.apidEpoch
+}
+
+// startSnapshotEpoch starts a new snapshot epoch for the configurations of a db that has none.
+// Snapshots received at runtime get theirs from initDb.
+func (dbc *dbManager) startSnapshotEpoch() error {
+	epoch := nextSnapshotEpoch(dbc.getEpoch(), time.Now())
+	if err := dbc.storeSnapshotEpoch(epoch); err != nil {
+		return err
+	}
+	dbc.lsnMutex.Lock()
+	defer dbc.lsnMutex.Unlock()
+	dbc.apidEpoch = epoch
+	dbc.setSnapshotLSN(dbc.apidLSN)
+	return nil
+}
+
+// storeSnapshotEpoch stores the snapshot epoch in db
+func (dbc *dbManager) storeSnapshotEpoch(epoch int64) error {
+	if _, err := dbc.getDb().Exec("UPDATE APID_CONFIGURATION_LSN SET epoch=?;", epoch); err != nil {
+		log.Errorf("UPDATE APID_CONFIGURATION_LSN Failed: %v", err)
+		return err
+	}
+	log.Debugf("started snapshot epoch %d", epoch)
+	return nil
+}
+
+// setSnapshotLSN moves the in-memory configurations to the config index, with lsnMutex held
+func (dbc *dbManager) setSnapshotLSN(lsn string) {
+	if snapshot := dbc.getConfigSnapshot(); snapshot != nil {
+		dbc.snapshot.Store(snapshot.withIndex(dbc.apidEpoch, lsn))
+	}
+}
+
 func configurationsFromDbRows(rows *sql.Rows) ([]Configuration, error) {
 	tmp, err := structFromRows(reflect.TypeOf((*Configuration)(nil)).Elem(), rows)
 	if err != nil {
@@ -485,47 +896,6 @@ func structFromRow(t reflect.Type, row *sql.Row) (interface{}, error) {
 	return v.Interface(), nil
 }
 
-func initTables(db apid.DB) error {
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-	_, err = tx.Exec(`
-	CREATE TABLE IF NOT EXISTS APID_BLOB_AVAILABLE (
-		id text primary key,
-   		local_fs_location text NOT NULL
-	);
-	`)
-	if err != nil {
-		return err
-	}
-	_, err = tx.Exec(`
-	CREATE TABLE IF NOT EXISTS APID_CONFIGURATION_LSN (
-		lsn text primary key
-	);
-	`)
-	if err != nil {
-		return err
-	}
-
-	// insert a row if APID_CONFIGURATION_LSN is empty
-	_, err = tx.Exec(`
-	INSERT INTO APID_CONFIGURATION_LSN (lsn)
-	SELECT '0.0.0'
-	WHERE NOT EXISTS (SELECT * FROM APID_CONFIGURATION_LSN)
-	`)
-	if err != nil {
-		return err
-	}
-
-	if err = tx.Commit(); err != nil {
-		return err
-	}
-	log.Debug("Database table APID_BLOB_AVAILABLE, APID_CONFIGURATION_LSN created.")
-	return nil
-}
-
 func addIndexes(db apid.DB) error {
 	log.Debug("add index to sqlite")
 	tx, err := db.Begin()
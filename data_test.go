@@ -148,6 +148,22 @@ var _ = Describe("data", func() {
 			Expect(testDbMan.loadLsnFromDb()).Should(Succeed())
 			Expect(testDbMan.apidLSN).Should(Equal(testLSN))
 		})
+
+		It("should persist pending downloads until taken", func() {
+			pending := map[string]int{
+				"gcs:sha256:pending-1": priorityBackfill,
+				"gcs:sha256:pending-2": priorityChangeList,
+			}
+			Expect(testDbMan.savePendingDownloads(pending)).Should(Succeed())
+			taken, err := testDbMan.takePendingDownloads()
+			Expect(err).Should(Succeed())
+			Expect(taken).Should(Equal(pending))
+
+			// taken only once
+			taken, err = testDbMan.takePendingDownloads()
+			Expect(err).Should(Succeed())
+			Expect(taken).Should(BeEmpty())
+		})
 	})
 
 	Context("configuration tests", func() {
@@ -164,6 +180,8 @@ var _ = Describe("data", func() {
 
 		It("should get empty slice if no configurations", func() {
 			trancateTestMetadataTable(testDbMan.getDb())
+			// configurations are read from the db by initDb
+			Expect(testDbMan.initDb()).Should(Succeed())
 			confs, err := testDbMan.getAllConfigurations("")
 			Expect(err).Should(Succeed())
 			Expect(len(confs)).Should(BeZero())
@@ -179,7 +197,7 @@ var _ = Describe("data", func() {
 
 		It("should succefully update local FS location", func() {
 
-			err := testDbMan.updateLocalFsLocation(testBlobId, testBlobLocalFsPrefix+testBlobId)
+			err := testDbMan.updateLocalFsLocation(testBlobId, testBlobLocalFsPrefix+testBlobId, nil)
 			Expect(err).Should(Succeed())
 			// apid_blob_available
 			rows, err := testDbMan.getDb().Query(`
@@ -196,7 +214,7 @@ var _ = Describe("data", func() {
 
 		It("should succefully get local FS location", func() {
 
-			err := testDbMan.updateLocalFsLocation(testBlobId, testBlobLocalFsPrefix+testBlobId)
+			err := testDbMan.updateLocalFsLocation(testBlobId, testBlobLocalFsPrefix+testBlobId, nil)
 			Expect(err).Should(Succeed())
 
 			// apid_blob_available
@@ -208,6 +226,124 @@ var _ = Describe("data", func() {
 			Expect(err).Should(Equal(sql.ErrNoRows))
 		})
 
+		It("should store blob metadata", func() {
+			downloadedAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+			meta := &blobMetadata{
+				Size:         10,
+				ContentType:  "application/zip",
+				Digest:       "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+				DownloadedAt: downloadedAt,
+				Source:       "http://mirror1",
+			}
+			Expect(testDbMan.updateLocalFsLocation(testBlobId, testBlobLocalFsPrefix+testBlobId, meta)).Should(Succeed())
+			stored, err := testDbMan.getBlobMetadata(testBlobId)
+			Expect(err).Should(Succeed())
+			Expect(stored.LocalFsLocation).Should(Equal(testBlobLocalFsPrefix + testBlobId))
+			Expect(stored.Size).Should(Equal(meta.Size))
+			Expect(stored.ContentType).Should(Equal(meta.ContentType))
+			Expect(stored.Digest).Should(Equal(meta.Digest))
+			Expect(stored.DownloadedAt.Equal(downloadedAt)).Should(BeTrue())
+			Expect(stored.Source).Should(Equal(meta.Source))
+			Expect(stored.LastServedAt.IsZero()).Should(BeTrue())
+
+			servedAt := time.Now().Truncate(time.Second)
+			Expect(testDbMan.updateBlobServed(testBlobId, servedAt)).Should(Succeed())
+			stored, err = testDbMan.getBlobMetadata(testBlobId)
+			Expect(err).Should(Succeed())
+			Expect(stored.LastServedAt.Equal(servedAt)).Should(BeTrue())
+
+			_, err = testDbMan.getBlobMetadata("non-existent")
+			Expect(err).Should(Equal(sql.ErrNoRows))
+		})
+
+		It("should add metadata columns to existing blob tables", func() {
+			_, err := testDbMan.getDb().Exec(`
+				DROP TABLE APID_CONFIG_SCHEMA_VERSION;
+				DROP TABLE APID_BLOB_AVAILABLE;
+				CREATE TABLE APID_BLOB_AVAILABLE (
+					id text primary key,
+					local_fs_location text NOT NULL
+				);
+			`)
+			Expect(err).Should(Succeed())
+			_, err = testDbMan.getDb().Exec(`INSERT INTO APID_BLOB_AVAILABLE (id, local_fs_location) VALUES (?, ?);`,
+				testBlobId, testBlobLocalFsPrefix+testBlobId)
+			Expect(err).Should(Succeed())
+
+			Expect(testDbMan.initDb()).Should(Succeed())
+			stored, err := testDbMan.getBlobMetadata(testBlobId)
+			Expect(err).Should(Succeed())
+			Expect(*stored).Should(Equal(blobMetadata{LocalFsLocation: testBlobLocalFsPrefix + testBlobId}))
+		})
+
+		It("should quarantine blobs until they become available", func() {
+			err := testDbMan.quarantineBlob(testBlobId, testBlobLocalFsPrefix+testBlobId, ErrInvalidSignature.Error())
+			Expect(err).Should(Succeed())
+			var count int
+			err = testDbMan.getDb().QueryRow(`SELECT count(*) from apid_blob_quarantine;`).Scan(&count)
+			Expect(err).Should(Succeed())
+			Expect(count).Should(Equal(1))
+
+			// quarantined blob should not be available
+			_, err = testDbMan.getLocalFSLocation(testBlobId)
+			Expect(err).Should(Equal(sql.ErrNoRows))
+
+			err = testDbMan.updateLocalFsLocation(testBlobId, testBlobLocalFsPrefix+testBlobId, nil)
+			Expect(err).Should(Succeed())
+			err = testDbMan.getDb().QueryRow(`SELECT count(*) from apid_blob_quarantine;`).Scan(&count)
+			Expect(err).Should(Succeed())
+			Expect(count).Should(Equal(0))
+		})
+
+		It("should list and forget unreferenced blobs", func() {
+			const unreferencedId = "gcs:sha256:unreferenced"
+			const pinnedId = "gcs:sha256:pinned"
+			for _, id := range []string{testBlobId, unreferencedId, pinnedId} {
+				Expect(testDbMan.updateLocalFsLocation(id, testBlobLocalFsPrefix+id, nil)).Should(Succeed())
+			}
+			pin := configPin{Configuration: *makeTestDeployment(), PinnedAt: time.Now()}
+			pin.BlobID = pinnedId
+			Expect(testDbMan.pinConfiguration(&pin)).Should(Succeed())
+
+			blobs, err := testDbMan.getUnreferencedBlobs()
+			Expect(err).Should(Succeed())
+			Expect(blobs).Should(Equal(map[string]string{unreferencedId: testBlobLocalFsPrefix + unreferencedId}))
+
+			Expect(testDbMan.deleteBlobAvailability(unreferencedId)).Should(Succeed())
+			_, err = testDbMan.getLocalFSLocation(unreferencedId)
+			Expect(err).Should(Equal(sql.ErrNoRows))
+			blobs, err = testDbMan.getUnreferencedBlobs()
+			Expect(err).Should(Succeed())
+			Expect(blobs).Should(BeEmpty())
+		})
+
+		It("should serve configurations from memory", func() {
+			const configId = "3ecd351c-1173-40bf-b830-c194e5ef9038"
+			config, err := testDbMan.getConfigById(configId)
+			Expect(err).Should(Succeed())
+			trancateTestMetadataTable(testDbMan.getDb())
+			confs, err := testDbMan.getAllConfigurations("")
+			Expect(err).Should(Succeed())
+			Expect(confs).Should(HaveLen(6))
+
+			// change lists are applied by the listener, together with the LSN
+			updated := *config
+			updated.Revision = "2"
+			testDbMan.applyConfigChanges("1.0.0", []*Configuration{&updated}, nil)
+			Expect(testDbMan.getConfigSnapshot().lsn).Should(Equal("1.0.0"))
+			Expect(testDbMan.updateLSN("1.0.1")).Should(Succeed())
+			Expect(testDbMan.getConfigSnapshot().lsn).Should(Equal("1.0.1"))
+			config, err = testDbMan.getConfigById(configId)
+			Expect(err).Should(Succeed())
+			Expect(*config).Should(Equal(updated))
+			testDbMan.applyConfigChanges("2.0.0", nil, []*Configuration{&updated})
+			_, err = testDbMan.getConfigById(configId)
+			Expect(err).Should(Equal(sql.ErrNoRows))
+			confs, err = testDbMan.getAllConfigurations("")
+			Expect(err).Should(Succeed())
+			Expect(confs).Should(HaveLen(5))
+		})
+
 		It("should get configuration by Id", func() {
 			config, err := testDbMan.getConfigById("3ecd351c-1173-40bf-b830-c194e5ef9038")
 			Expect(err).Should(Succeed())
@@ -238,9 +374,9 @@ var _ = Describe("data", func() {
 		/*
 			XIt("should successfully get all ready configurations", func() {
 
-				err := testDbMan.updateLocalFsLocation(readyBlobId, testBlobLocalFsPrefix+readyBlobId)
+				err := testDbMan.updateLocalFsLocation(readyBlobId, testBlobLocalFsPrefix+readyBlobId, nil)
 				Expect(err).Should(Succeed())
-				err = testDbMan.updateLocalFsLocation(readyResourceId, testBlobLocalFsPrefix+readyResourceId)
+				err = testDbMan.updateLocalFsLocation(readyResourceId, testBlobLocalFsPrefix+readyResourceId, nil)
 				Expect(err).Should(Succeed())
 
 				confs, err := testDbMan.getReadyConfigurations("")
@@ -256,9 +392,9 @@ var _ = Describe("data", func() {
 		*/
 		It("should get all configurations by type filter", func() {
 
-			err := testDbMan.updateLocalFsLocation(readyBlobId, testBlobLocalFsPrefix+readyBlobId)
+			err := testDbMan.updateLocalFsLocation(readyBlobId, testBlobLocalFsPrefix+readyBlobId, nil)
 			Expect(err).Should(Succeed())
-			err = testDbMan.updateLocalFsLocation(readyResourceId, testBlobLocalFsPrefix+readyResourceId)
+			err = testDbMan.updateLocalFsLocation(readyResourceId, testBlobLocalFsPrefix+readyResourceId, nil)
 			Expect(err).Should(Succeed())
 
 			confs, err := testDbMan.getAllConfigurations("ORGANIZATION")
@@ -276,9 +412,9 @@ var _ = Describe("data", func() {
 
 		It("should succefully get all unready blob ids", func() {
 
-			err := testDbMan.updateLocalFsLocation(readyBlobId, testBlobLocalFsPrefix+readyBlobId)
+			err := testDbMan.updateLocalFsLocation(readyBlobId, testBlobLocalFsPrefix+readyBlobId, nil)
 			Expect(err).Should(Succeed())
-			err = testDbMan.updateLocalFsLocation(readyResourceId, testBlobLocalFsPrefix+readyResourceId)
+			err = testDbMan.updateLocalFsLocation(readyResourceId, testBlobLocalFsPrefix+readyResourceId, nil)
 			Expect(err).Should(Succeed())
 
 			ids, err := testDbMan.getUnreadyBlobs()
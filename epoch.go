@@ -0,0 +1,105 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package apiGatewayConfDeploy
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apid/apid-core"
+	"github.com/apigee-labs/transicator/common"
+)
+
+// separates the snapshot epoch from the LSN in config indexes
+const epochSeparator = "-"
+
+// set on full responses to a client index of another snapshot epoch than apid's
+const apidConfigSupersededHeader = "x-apid-config-epoch-superseded"
+
+// formatConfigIndex returns the config index given to clients, the LSN qualified by the snapshot epoch.
+// Without epoch, it's the LSN alone.
+func formatConfigIndex(epoch int64, lsn string) string {
+	if epoch == 0 || lsn == "" {
+		return lsn
+	}
+	return strconv.FormatInt(epoch, 10) + epochSeparator + lsn
+}
+
+// parseConfigIndex returns the snapshot epoch and LSN of a config index, epoch is 0 if it has none.
+// The LSN isn't validated.
+func parseConfigIndex(index string) (epoch int64, lsn string, err error) {
+	parts := strings.SplitN(index, epochSeparator, 2)
+	if len(parts) == 1 {
+		return 0, index, nil
+	}
+	epoch, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || epoch <= 0 {
+		return 0, "", ErrInvalidLSN
+	}
+	return epoch, parts[1], nil
+}
+
+// isValidConfigIndex tells if the config index has a valid epoch, if any, and LSN
+func isValidConfigIndex(index string) bool {
+	_, lsn, err := parseConfigIndex(index)
+	if err != nil {
+		return false
+	}
+	_, err = common.ParseSequence(lsn)
+	return err == nil
+}
+
+// compareConfigIndexes compares config indexes by snapshot epoch, then by LSN.
+// Epochs only increase, and indexes without epoch come before all others.
+func compareConfigIndexes(a, b string) (int, error) {
+	epochA, lsnA, err := parseConfigIndex(a)
+	if err != nil {
+		return 0, err
+	}
+	epochB, lsnB, err := parseConfigIndex(b)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case epochA < epochB:
+		return -1, nil
+	case epochA > epochB:
+		return 1, nil
+	}
+	seqA, err := common.ParseSequence(lsnA)
+	if err != nil {
+		return 0, ErrInvalidLSN
+	}
+	seqB, err := common.ParseSequence(lsnB)
+	if err != nil {
+		return 0, ErrInvalidLSN
+	}
+	return seqA.Compare(seqB), nil
+}
+
+// nextSnapshotEpoch returns the epoch following prev, the time in seconds unless the clock is behind prev
+func nextSnapshotEpoch(prev int64, now time.Time) int64 {
+	if epoch := now.Unix(); epoch > prev {
+		return epoch
+	}
+	return prev + 1
+}
+
+// migrateSnapshotEpoch adds the snapshot epoch of the config index.
+// LSNs of different snapshots aren't comparable: the LSN is carried over to snapshots received at runtime,
+// and starts over if apid starts from a new snapshot. The epoch is left NULL until a snapshot is processed.
+func migrateSnapshotEpoch(tx apid.Tx) error {
+	return addMissingColumns(tx, "APID_CONFIGURATION_LSN", [][2]string{{"epoch", "integer"}})
+}
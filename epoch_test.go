@@ -0,0 +1,145 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayConfDeploy
+
+import (
+	"github.com/apid/apid-core/data"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var _ = Describe("snapshot epochs", func() {
+
+	It("should qualify config indexes with the epoch", func() {
+		Expect(formatConfigIndex(0, "1.2.3")).Should(Equal("1.2.3"))
+		Expect(formatConfigIndex(7, "1.2.3")).Should(Equal("7-1.2.3"))
+		Expect(formatConfigIndex(7, "")).Should(BeEmpty())
+
+		epoch, lsn, err := parseConfigIndex("7-1.2.3")
+		Expect(err).Should(Succeed())
+		Expect(epoch).Should(Equal(int64(7)))
+		Expect(lsn).Should(Equal("1.2.3"))
+		epoch, lsn, err = parseConfigIndex("1.2.3")
+		Expect(err).Should(Succeed())
+		Expect(epoch).Should(BeZero())
+		Expect(lsn).Should(Equal("1.2.3"))
+		for _, index := range []string{"x-1.2.3", "0-1.2.3", "-1-1.2.3", "-1.2.3"} {
+			_, _, err := parseConfigIndex(index)
+			Expect(err).Should(Equal(ErrInvalidLSN))
+		}
+	})
+
+	It("should order config indexes by epoch, then LSN", func() {
+		for _, c := range []struct {
+			a, b string
+			res  int
+		}{
+			{"7-0.1.0", "7-0.2.0", -1},
+			{"7-0.2.0", "7-0.2.0", 0},
+			{"8-0.1.0", "7-0.2.0", 1},
+			{"0.3.0", "7-0.2.0", -1},
+			{"0.3.0", "0.2.0", 1},
+		} {
+			res, err := compareConfigIndexes(c.a, c.b)
+			Expect(err).Should(Succeed())
+			Expect(res).Should(Equal(c.res), c.a+" "+c.b)
+		}
+		for _, index := range []string{"x-0.1.0", "7-invalid"} {
+			_, err := compareConfigIndexes(index, "7-0.1.0")
+			Expect(err).Should(Equal(ErrInvalidLSN))
+			Expect(isValidConfigIndex(index)).Should(BeFalse())
+		}
+		Expect(isValidConfigIndex("")).Should(BeFalse())
+		Expect(isValidConfigIndex("7-0.1.0")).Should(BeTrue())
+	})
+
+	It("should increase epochs even if the clock doesn't", func() {
+		now := time.Unix(1000, 0)
+		Expect(nextSnapshotEpoch(0, now)).Should(Equal(int64(1000)))
+		Expect(nextSnapshotEpoch(999, now)).Should(Equal(int64(1000)))
+		Expect(nextSnapshotEpoch(1000, now)).Should(Equal(int64(1001)))
+		Expect(nextSnapshotEpoch(2000, now)).Should(Equal(int64(2001)))
+	})
+
+	Context("db", func() {
+		var testCount int
+		var testDbMan *dbManager
+
+		var _ = BeforeEach(func() {
+			testCount += 1
+			testDbMan = &dbManager{
+				data:     services.Data(),
+				dbMux:    sync.RWMutex{},
+				lsnMutex: sync.RWMutex{},
+			}
+			testDbMan.setDbVersion("testEpoch" + strconv.Itoa(testCount))
+			initTestDb(testDbMan.getDb())
+			Expect(testDbMan.initDb()).Should(Succeed())
+			Expect(testDbMan.loadLsnFromDb()).Should(Succeed())
+		})
+
+		var _ = AfterEach(func() {
+			data.Delete(data.VersionedDBID("common", "testEpoch"+strconv.Itoa(testCount)))
+			data.Delete(data.VersionedDBID("common", "testEpochNext"+strconv.Itoa(testCount)))
+		})
+
+		It("should store the epoch with the LSN", func() {
+			Expect(testDbMan.getEpoch()).Should(BeZero())
+			Expect(testDbMan.updateLSN("1.0.0")).Should(Succeed())
+			Expect(testDbMan.startSnapshotEpoch()).Should(Succeed())
+			epoch := testDbMan.getEpoch()
+			Expect(epoch).Should(BeNumerically(">=", time.Now().Unix()-1))
+			Expect(testDbMan.getConfigSnapshot().index()).Should(Equal(formatConfigIndex(epoch, "1.0.0")))
+
+			Expect(testDbMan.startSnapshotEpoch()).Should(Succeed())
+			Expect(testDbMan.getEpoch()).Should(BeNumerically(">", epoch))
+			epoch = testDbMan.getEpoch()
+
+			// kept by change lists, and loaded on restarts
+			Expect(testDbMan.updateLSN("2.0.0")).Should(Succeed())
+			testDbMan.apidEpoch = 0
+			Expect(testDbMan.loadLsnFromDb()).Should(Succeed())
+			Expect(testDbMan.getEpoch()).Should(Equal(epoch))
+			Expect(testDbMan.getConfigSnapshot().index()).Should(Equal(formatConfigIndex(epoch, "2.0.0")))
+		})
+
+		It("should publish the configurations of a snapshot received at runtime under a new epoch", func() {
+			Expect(testDbMan.updateLSN("1.0.0")).Should(Succeed())
+			Expect(testDbMan.startSnapshotEpoch()).Should(Succeed())
+			epoch := testDbMan.getEpoch()
+			old := testDbMan.getConfigSnapshot()
+
+			testDbMan.setDbVersion("testEpochNext" + strconv.Itoa(testCount))
+			initTestDb(testDbMan.getDb())
+			_, err := testDbMan.getDb().Exec("DELETE FROM METADATA_RUNTIME_ENTITY_METADATA;")
+			Expect(err).Should(Succeed())
+			Expect(testDbMan.initDb()).Should(Succeed())
+
+			// the new configurations come with the new epoch
+			Expect(testDbMan.getEpoch()).Should(BeNumerically(">", epoch))
+			snapshot := testDbMan.getConfigSnapshot()
+			Expect(snapshot).ShouldNot(BeIdenticalTo(old))
+			Expect(snapshot.getConfigurations("")).Should(BeEmpty())
+			Expect(old.getConfigurations("")).ShouldNot(BeEmpty())
+			Expect(snapshot.index()).Should(Equal(formatConfigIndex(testDbMan.getEpoch(), "1.0.0")))
+			var stored int64
+			Expect(testDbMan.getDb().QueryRow("SELECT epoch FROM APID_CONFIGURATION_LSN;").Scan(&stored)).Should(Succeed())
+			Expect(stored).Should(Equal(testDbMan.getEpoch()))
+		})
+	})
+})
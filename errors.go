@@ -0,0 +1,124 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package apiGatewayConfDeploy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// downloadError is a failure to talk to the blob server or the storage behind signed URLs.
+// Permanent errors (4xx, malformed responses) are not retried,
+// transient errors (5xx, 408, 429, network) are retried with backoff, or after retryAfter if the server asked for it.
+type downloadError struct {
+	uri        string
+	statusCode int
+	permanent  bool
+	retryAfter time.Duration
+	err        error
+}
+
+func (e *downloadError) Error() string {
+	kind := "transient"
+	if e.permanent {
+		kind = "permanent"
+	}
+	if e.statusCode != 0 {
+		return fmt.Sprintf("GET uri %s failed with status %d (%s)", e.uri, e.statusCode, kind)
+	}
+	return fmt.Sprintf("GET uri %s failed (%s): %v", e.uri, kind, e.err)
+}
+
+// statusError classifies an unexpected http response
+func statusError(uri string, res *http.Response) *downloadError {
+	e := &downloadError{
+		uri:        uri,
+		statusCode: res.StatusCode,
+	}
+	switch {
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable:
+		e.retryAfter = parseRetryAfter(res.Header.Get("Retry-After"))
+	case res.StatusCode == http.StatusRequestTimeout:
+	case res.StatusCode >= 400 && res.StatusCode < 500:
+		e.permanent = true
+	}
+	return e
+}
+
+// networkError wraps a transport failure, always transient
+func networkError(uri string, err error) *downloadError {
+	return &downloadError{
+		uri: uri,
+		err: err,
+	}
+}
+
+// malformedError is a response that can't be understood, retrying won't help
+func malformedError(uri string, err error) *downloadError {
+	return &downloadError{
+		uri:       uri,
+		permanent: true,
+		err:       err,
+	}
+}
+
+// retries are at most this far apart, whatever the backoff or the server asked for
+const maxDownloadBackOff = 5 * time.Minute
+
+// parseRetryAfter accepts delay-seconds or an HTTP-date, 0 if absent or invalid.
+// Delays are capped to maxDownloadBackOff.
+func parseRetryAfter(value string) time.Duration {
+	var d time.Duration
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		d = time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil {
+		d = time.Until(t)
+	}
+	switch {
+	case d <= 0:
+		return 0
+	case d > maxDownloadBackOff:
+		return maxDownloadBackOff
+	}
+	return d
+}
+
+func isRetryable(err error) bool {
+	switch e := err.(type) {
+	case *timeoutError:
+		return false
+	case *verificationError:
+		// quarantined, retrying won't help
+		return false
+	case *downloadError:
+		return !e.permanent
+	}
+	return true
+}
+
+// retryAfter returns the delay requested by the server before the next attempt, 0 if none
+func retryAfter(err error) time.Duration {
+	if e, ok := err.(*downloadError); ok {
+		return e.retryAfter
+	}
+	return 0
+}
@@ -0,0 +1,73 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayConfDeploy
+
+import (
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"time"
+)
+
+var _ = Describe("download errors", func() {
+
+	response := func(status int, retryAfter string) *http.Response {
+		res := &http.Response{
+			StatusCode: status,
+			Header:     http.Header{},
+		}
+		if retryAfter != "" {
+			res.Header.Set("Retry-After", retryAfter)
+		}
+		return res
+	}
+
+	It("should classify http status", func() {
+		permanent := []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusGone}
+		transient := []int{http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable}
+		for _, status := range permanent {
+			Expect(isRetryable(statusError("uri", response(status, "")))).Should(BeFalse(), fmt.Sprint(status))
+		}
+		for _, status := range transient {
+			Expect(isRetryable(statusError("uri", response(status, "")))).Should(BeTrue(), fmt.Sprint(status))
+		}
+	})
+
+	It("should classify other errors", func() {
+		Expect(isRetryable(networkError("uri", fmt.Errorf("connection refused")))).Should(BeTrue())
+		Expect(isRetryable(malformedError("uri", fmt.Errorf("bad json")))).Should(BeFalse())
+		Expect(isRetryable(&timeoutError{})).Should(BeFalse())
+		Expect(isRetryable(&verificationError{})).Should(BeFalse())
+		Expect(isRetryable(fmt.Errorf("unknown"))).Should(BeTrue())
+	})
+
+	It("should honour Retry-After", func() {
+		Expect(retryAfter(statusError("uri", response(http.StatusTooManyRequests, "120")))).Should(Equal(2 * time.Minute))
+		Expect(retryAfter(statusError("uri", response(http.StatusServiceUnavailable, "")))).Should(BeZero())
+		Expect(retryAfter(statusError("uri", response(http.StatusInternalServerError, "120")))).Should(BeZero())
+		Expect(retryAfter(fmt.Errorf("unknown"))).Should(BeZero())
+
+		date := time.Now().Add(2 * time.Minute).UTC().Format(http.TimeFormat)
+		Expect(retryAfter(statusError("uri", response(http.StatusTooManyRequests, date)))).Should(BeNumerically("~", 2*time.Minute, time.Second))
+		Expect(parseRetryAfter("-1")).Should(BeZero())
+		Expect(parseRetryAfter("soon")).Should(BeZero())
+
+		// capped to the maximum backoff
+		Expect(parseRetryAfter("86400")).Should(Equal(maxDownloadBackOff))
+		date = time.Now().Add(24 * time.Hour).UTC().Format(http.TimeFormat)
+		Expect(parseRetryAfter(date)).Should(Equal(maxDownloadBackOff))
+	})
+})
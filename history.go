@@ -0,0 +1,512 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package apiGatewayConfDeploy
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/apid/apid-core"
+)
+
+var errHistoryUnavailable = errors.New("configuration history doesn't reach back to the requested config index")
+
+// columns of METADATA_RUNTIME_ENTITY_METADATA copied to the history, in the order of the Configuration fields
+const configHistoryColumns = `id, organization_id, environment_id, bean_blob_id, resource_blob_id, type, name,
+	revision, path, created_at, created_by, updated_at, updated_by`
+
+// configRevision is a revision of a configuration, current from the change at Lsn until the one at ReplacedLsn.
+// Both are config indexes, qualified by their snapshot epoch, see formatConfigIndex.
+type configRevision struct {
+	Configuration
+	// empty for revisions that were current before history was recorded
+	Lsn    string
+	SeenAt time.Time
+	// empty while current
+	ReplacedLsn string
+	ReplacedAt  time.Time
+	// the revision was replaced by the deletion of the configuration
+	Deleted bool
+}
+
+// migrateConfigHistory creates the table of configuration revisions seen.
+// Open revisions have a NULL replaced_at.
+func migrateConfigHistory(tx apid.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE IF NOT EXISTS APID_CONFIGURATION_HISTORY (
+		seq integer primary key autoincrement,
+		id text NOT NULL,
+		organization_id text,
+		environment_id text,
+		bean_blob_id text,
+		resource_blob_id text,
+		type text,
+		name text,
+		revision text,
+		path text,
+		created_at text,
+		created_by text,
+		updated_at text,
+		updated_by text,
+		lsn text,
+		seen_at text,
+		replaced_lsn text,
+		replaced_at text,
+		deleted integer
+	);
+	CREATE INDEX IF NOT EXISTS config_history_id ON APID_CONFIGURATION_HISTORY (id);
+	`)
+	return err
+}
+
+// migrateConfigHistoryStart creates the table of the config index the history reaches back to,
+// set once revisions are pruned, see pruneConfigHistory
+func migrateConfigHistoryStart(tx apid.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE IF NOT EXISTS APID_CONFIGURATION_HISTORY_START (
+		lsn text
+	);
+	`)
+	return err
+}
+
+// recordConfigRevisions records the revisions of a change list at the config index lsn: the current ones are opened,
+// the replaced and deleted ones are closed.
+// The changes are the net ones of the change list: a current configuration is neither deleted nor listed twice.
+func (dbc *dbManager) recordConfigRevisions(lsn string, at time.Time, current, replaced, deleted []*Configuration) error {
+	tx, err := dbc.getDb().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, c := range replaced {
+		if err = closeConfigRevision(tx, c, lsn, at, false); err != nil {
+			return err
+		}
+	}
+	for _, c := range deleted {
+		if err = closeConfigRevision(tx, c, lsn, at, true); err != nil {
+			return err
+		}
+	}
+	for _, c := range current {
+		// a revision may still be open if a change was missed
+		_, err = tx.Exec(`
+		UPDATE APID_CONFIGURATION_HISTORY SET replaced_lsn = ?, replaced_at = ?, deleted = 0
+		WHERE id = ? AND replaced_at IS NULL;
+		`, lsn, formatDbTime(at), c.ID)
+		if err != nil {
+			return err
+		}
+		if err = insertConfigRevision(tx, c, lsn, formatDbTime(at), nil, nil, false); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// closeConfigRevision closes the open revision of the configuration.
+// If there's none, the revision started before history was recorded, and is added as closed.
+func closeConfigRevision(tx apid.Tx, c *Configuration, lsn string, at time.Time, deleted bool) error {
+	res, err := tx.Exec(`
+	UPDATE APID_CONFIGURATION_HISTORY SET replaced_lsn = ?, replaced_at = ?, deleted = ?
+	WHERE id = ? AND replaced_at IS NULL;
+	`, lsn, formatDbTime(at), deleted, c.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	return insertConfigRevision(tx, c, "", "", lsn, formatDbTime(at), deleted)
+}
+
+func insertConfigRevision(tx apid.Tx, c *Configuration, lsn, seenAt string, replacedLsn, replacedAt interface{}, deleted bool) error {
+	_, err := tx.Exec(`
+	INSERT INTO APID_CONFIGURATION_HISTORY (`+configHistoryColumns+`, lsn, seen_at, replaced_lsn, replaced_at, deleted)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+	`, c.ID, c.OrgID, c.EnvID, c.BlobID, c.BlobResourceID, c.Type, c.Name, c.Revision, c.Path,
+		c.Created, c.CreatedBy, c.Updated, c.UpdatedBy, lsn, seenAt, replacedLsn, replacedAt, deleted)
+	return err
+}
+
+// seedConfigHistory brings the history in line with the current configurations of a new snapshot, at the config index lsn:
+// revisions that changed or disappeared are closed, configurations without an open revision get one.
+func seedConfigHistory(db apid.DB, lsn string, at time.Time) error {
+	if lsn == "" {
+		var epoch sql.NullInt64
+		if err := db.QueryRow("SELECT lsn, epoch FROM APID_CONFIGURATION_LSN LIMIT 1;").Scan(&lsn, &epoch); err != nil {
+			return err
+		}
+		lsn = formatConfigIndex(epoch.Int64, lsn)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+	UPDATE APID_CONFIGURATION_HISTORY SET replaced_lsn = ?, replaced_at = ?,
+		deleted = NOT EXISTS (SELECT 1 FROM METADATA_RUNTIME_ENTITY_METADATA AS m WHERE m.id = APID_CONFIGURATION_HISTORY.id)
+	WHERE replaced_at IS NULL AND NOT EXISTS (
+		SELECT 1 FROM METADATA_RUNTIME_ENTITY_METADATA AS m
+		WHERE m.id = APID_CONFIGURATION_HISTORY.id
+			AND m.revision IS APID_CONFIGURATION_HISTORY.revision
+			AND m.bean_blob_id IS APID_CONFIGURATION_HISTORY.bean_blob_id
+			AND m.resource_blob_id IS APID_CONFIGURATION_HISTORY.resource_blob_id
+	);
+	`, lsn, formatDbTime(at))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+	INSERT INTO APID_CONFIGURATION_HISTORY (`+configHistoryColumns+`, lsn, seen_at, deleted)
+	SELECT `+configHistoryColumns+`, ?, ?, 0 FROM METADATA_RUNTIME_ENTITY_METADATA AS m
+	WHERE NOT EXISTS (
+		SELECT 1 FROM APID_CONFIGURATION_HISTORY AS h WHERE h.id = m.id AND h.replaced_at IS NULL
+	);
+	`, lsn, formatDbTime(at))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// copyConfigHistory copies the history of the previous snapshot to a new one that doesn't have any yet
+func copyConfigHistory(from, to apid.DB) error {
+	_, err := copyTable(from, to, "APID_CONFIGURATION_HISTORY", configHistoryColumns+", lsn, seen_at, replaced_lsn, replaced_at, deleted", "seq")
+	if err != nil {
+		return err
+	}
+	_, err = copyTable(from, to, "APID_CONFIGURATION_HISTORY_START", "lsn", "lsn")
+	return err
+}
+
+// copyTable copies the rows of a table to the same table of another db, in order, if it's empty there.
+// It returns the number of rows copied.
+func copyTable(from, to apid.DB, table, columns, orderBy string) (int, error) {
+	var count int
+	if err := to.QueryRow("SELECT count(*) FROM " + table + ";").Scan(&count); err != nil || count > 0 {
+		return 0, err
+	}
+	rows, err := from.Query("SELECT " + columns + " FROM " + table + " ORDER BY " + orderBy + ";")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	tx, err := to.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	num := strings.Count(columns, ",") + 1
+	stmt, err := tx.Prepare("INSERT INTO " + table + " (" + columns + ") VALUES (?" +
+		strings.Repeat(", ?", num-1) + ");")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	values := make([]sql.NullString, num)
+	args := make([]interface{}, num)
+	for rows.Next() {
+		for i := range values {
+			args[i] = &values[i]
+		}
+		if err = rows.Scan(args...); err != nil {
+			return 0, err
+		}
+		for i := range values {
+			args[i] = values[i]
+		}
+		if _, err = stmt.Exec(args...); err != nil {
+			return 0, err
+		}
+		count++
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	return count, tx.Commit()
+}
+
+// getConfigHistory returns the revisions of a configuration, newest first
+func (dbc *dbManager) getConfigHistory(configId string) ([]configRevision, error) {
+	rows, err := dbc.getDb().Query(`
+	SELECT `+configHistoryColumns+`, lsn, seen_at, replaced_lsn, replaced_at, deleted
+	FROM APID_CONFIGURATION_HISTORY
+	WHERE id = ?
+	ORDER BY seq DESC;
+	`, configId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return configRevisionsFromDbRows(rows)
+}
+
+// getConfigurationsAsOf reconstructs the configurations that were current after the change at the config index asOf,
+// in the order they became current. errHistoryUnavailable is returned if asOf is older than the history.
+func (dbc *dbManager) getConfigurationsAsOf(asOf string, typeFilter string) ([]Configuration, error) {
+	var start sql.NullString
+	err := dbc.getDb().QueryRow(`
+	SELECT lsn FROM APID_CONFIGURATION_HISTORY WHERE lsn != '' ORDER BY seq LIMIT 1;
+	`).Scan(&start)
+	switch {
+	case err == sql.ErrNoRows:
+		return []Configuration{}, nil
+	case err != nil:
+		return nil, err
+	}
+	if cmpRes, err := compareConfigIndexes(start.String, asOf); err != nil || cmpRes > 0 {
+		return nil, errHistoryUnavailable
+	}
+	// revisions replaced before the start were pruned
+	err = dbc.getDb().QueryRow("SELECT lsn FROM APID_CONFIGURATION_HISTORY_START LIMIT 1;").Scan(&start)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, err
+	default:
+		if cmpRes, err := compareConfigIndexes(start.String, asOf); err != nil || cmpRes > 0 {
+			return nil, errHistoryUnavailable
+		}
+	}
+
+	query := `
+	SELECT ` + configHistoryColumns + `, lsn, seen_at, replaced_lsn, replaced_at, deleted
+	FROM APID_CONFIGURATION_HISTORY
+	WHERE type = ? OR ? = ''
+	ORDER BY seq DESC;
+	`
+	rows, err := dbc.getDb().Query(query, typeFilter, typeFilter)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	revisions, err := configRevisionsFromDbRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// the newest revision of each configuration that was current at asOf
+	found := make(map[string]bool)
+	confs := make([]Configuration, 0)
+	for _, r := range revisions {
+		if found[r.ID] || !r.currentAt(asOf) {
+			continue
+		}
+		found[r.ID] = true
+		confs = append(confs, r.Configuration)
+	}
+	for i, j := 0, len(confs)-1; i < j; i, j = i+1, j-1 {
+		confs[i], confs[j] = confs[j], confs[i]
+	}
+	return confs, nil
+}
+
+// currentAt tells if the revision was current after the change at the config index.
+// Revisions from before history was recorded are assumed current until replaced.
+func (r *configRevision) currentAt(index string) bool {
+	if r.Lsn != "" {
+		if cmpRes, err := compareConfigIndexes(r.Lsn, index); err != nil || cmpRes > 0 {
+			return false
+		}
+	}
+	if r.ReplacedLsn != "" {
+		if cmpRes, err := compareConfigIndexes(r.ReplacedLsn, index); err != nil || cmpRes <= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// parseRetainRevisionsByType parses a list of "type:revisions" pairs separated by commas, at least 1 revision each
+func parseRetainRevisionsByType(s string) (map[string]int, error) {
+	retain, err := parseTypeValues(s, "revisions")
+	if err != nil {
+		return nil, err
+	}
+	for confType, n := range retain {
+		if n < 1 {
+			return nil, fmt.Errorf("invalid type revisions %s:%d, must be at least 1", confType, n)
+		}
+	}
+	return retain, nil
+}
+
+// getRetainedBlobs returns the blobs of the last revisions of each configuration, by organization, environment and name.
+// retainByType is the number of revisions kept for a type, retain for the others.
+// Nothing is kept for configurations that were deleted.
+func (dbc *dbManager) getRetainedBlobs(retainByType map[string]int, retain int) (map[string]bool, error) {
+	_, retained, err := dbc.getRetainedRevisions(retainByType, retain)
+	return retained, err
+}
+
+// getRetainedRevisions returns the seq of the revisions whose blobs are retained, and their blobs, see getRetainedBlobs
+func (dbc *dbManager) getRetainedRevisions(retainByType map[string]int, retain int) (map[int64]bool, map[string]bool, error) {
+	rows, err := dbc.getDb().Query(`
+	SELECT seq, organization_id, environment_id, name, type, bean_blob_id, resource_blob_id, deleted
+	FROM APID_CONFIGURATION_HISTORY
+	ORDER BY seq DESC;
+	`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	type configKey struct {
+		org, env, name string
+	}
+	kept := make(map[configKey]int)
+	last := make(map[configKey][2]string)
+	revisions := make(map[int64]bool)
+	retained := make(map[string]bool)
+	for rows.Next() {
+		var seq int64
+		var org, env, name, confType, blobId, resourceBlobId sql.NullString
+		var deleted sql.NullBool
+		if err = rows.Scan(&seq, &org, &env, &name, &confType, &blobId, &resourceBlobId, &deleted); err != nil {
+			return nil, nil, err
+		}
+		key := configKey{org.String, env.String, name.String}
+		blobs := [2]string{blobId.String, resourceBlobId.String}
+		n, ok := retainByType[confType.String]
+		if !ok {
+			n = retain
+		}
+		prev, seen := last[key]
+		switch {
+		case !seen && deleted.Bool:
+			// the newest revision was deleted
+			kept[key] = n
+		case seen && prev == blobs:
+			// same blobs as the newer revision
+			continue
+		}
+		last[key] = blobs
+		if kept[key] >= n {
+			continue
+		}
+		kept[key]++
+		revisions[seq] = true
+		for _, id := range blobs {
+			if id != "" {
+				retained[id] = true
+			}
+		}
+	}
+	return revisions, retained, rows.Err()
+}
+
+// pruneConfigHistory deletes the revisions replaced before the cutoff, except the ones whose blobs are retained,
+// so that the history doesn't grow forever. asOf then only reaches back to the newest config index they were
+// replaced at. It returns the number of revisions deleted.
+func (dbc *dbManager) pruneConfigHistory(before time.Time, retainByType map[string]int, retain int) (int, error) {
+	retained, _, err := dbc.getRetainedRevisions(retainByType, retain)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := dbc.getDb().Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	// times are stored in UTC RFC3339, they compare as strings
+	rows, err := tx.Query(`
+	SELECT seq, replaced_lsn FROM APID_CONFIGURATION_HISTORY
+	WHERE replaced_at IS NOT NULL AND replaced_at != '' AND replaced_at < ?;
+	`, formatDbTime(before))
+	if err != nil {
+		return 0, err
+	}
+	var pruned []int64
+	var start sql.NullString
+	for rows.Next() {
+		var seq int64
+		var replacedLsn sql.NullString
+		if err = rows.Scan(&seq, &replacedLsn); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if retained[seq] {
+			continue
+		}
+		pruned = append(pruned, seq)
+		if cmpRes, err := compareConfigIndexes(replacedLsn.String, start.String); !start.Valid || (err == nil && cmpRes > 0) {
+			start = replacedLsn
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(pruned) == 0 {
+		return 0, err
+	}
+	for _, seq := range pruned {
+		if _, err = tx.Exec("DELETE FROM APID_CONFIGURATION_HISTORY WHERE seq = ?;", seq); err != nil {
+			return 0, err
+		}
+	}
+	var prev sql.NullString
+	err = tx.QueryRow("SELECT lsn FROM APID_CONFIGURATION_HISTORY_START LIMIT 1;").Scan(&prev)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if cmpRes, err := compareConfigIndexes(start.String, prev.String); !prev.Valid || (err == nil && cmpRes > 0) {
+		if _, err = tx.Exec("DELETE FROM APID_CONFIGURATION_HISTORY_START;"); err != nil {
+			return 0, err
+		}
+		if _, err = tx.Exec("INSERT INTO APID_CONFIGURATION_HISTORY_START (lsn) VALUES (?);", start.String); err != nil {
+			return 0, err
+		}
+	}
+	return len(pruned), tx.Commit()
+}
+
+func configRevisionsFromDbRows(rows *sql.Rows) ([]configRevision, error) {
+	revisions := make([]configRevision, 0)
+	for rows.Next() {
+		var r configRevision
+		var lsn, seenAt, replacedLsn, replacedAt sql.NullString
+		var deleted sql.NullBool
+		if err := scanConfiguration(rows, &r.Configuration, &lsn, &seenAt, &replacedLsn, &replacedAt, &deleted); err != nil {
+			return nil, err
+		}
+		r.Lsn = lsn.String
+		r.SeenAt = parseDbTime(seenAt.String)
+		r.ReplacedLsn = replacedLsn.String
+		r.ReplacedAt = parseDbTime(replacedAt.String)
+		r.Deleted = deleted.Bool
+		revisions = append(revisions, r)
+	}
+	return revisions, rows.Err()
+}
+
+// scanConfiguration scans configHistoryColumns into c, followed by the extra columns
+func scanConfiguration(rows *sql.Rows, c *Configuration, extra ...interface{}) error {
+	fields := make([]sql.NullString, reflect.TypeOf(*c).NumField())
+	dest := make([]interface{}, 0, len(fields)+len(extra))
+	for i := range fields {
+		dest = append(dest, &fields[i])
+	}
+	if err := rows.Scan(append(dest, extra...)...); err != nil {
+		return err
+	}
+	v := reflect.ValueOf(c).Elem()
+	for i := range fields {
+		v.Field(i).SetString(fields[i].String)
+	}
+	return nil
+}
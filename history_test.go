@@ -0,0 +1,297 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayConfDeploy
+
+import (
+	"github.com/apid/apid-core/data"
+	"github.com/apigee-labs/transicator/common"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var _ = Describe("configuration history", func() {
+	const configId = "3ecd351c-1173-40bf-b830-c194e5ef9038"
+	// configurations of initTestDb
+	const configCount = 6
+	var testCount int
+	var testDbMan *dbManager
+
+	var _ = BeforeEach(func() {
+		testCount += 1
+		testDbMan = &dbManager{
+			data:     services.Data(),
+			dbMux:    sync.RWMutex{},
+			lsnMutex: sync.RWMutex{},
+		}
+		testDbMan.setDbVersion("testHistory" + strconv.Itoa(testCount))
+		initTestDb(testDbMan.getDb())
+		Expect(testDbMan.initDb()).Should(Succeed())
+	})
+
+	var _ = AfterEach(func() {
+		data.Delete(data.VersionedDBID("common", "testHistory"+strconv.Itoa(testCount)))
+		data.Delete(data.VersionedDBID("common", "testHistoryNext"+strconv.Itoa(testCount)))
+	})
+
+	It("should seed the current configurations", func() {
+		history, err := testDbMan.getConfigHistory(configId)
+		Expect(err).Should(Succeed())
+		Expect(history).Should(HaveLen(1))
+		Expect(history[0].ID).Should(Equal(configId))
+		Expect(history[0].Lsn).Should(Equal(InitLSN))
+		Expect(history[0].SeenAt).ShouldNot(BeZero())
+		Expect(history[0].ReplacedAt).Should(BeZero())
+
+		// seeding again doesn't duplicate revisions
+		Expect(testDbMan.initDb()).Should(Succeed())
+		history, err = testDbMan.getConfigHistory(configId)
+		Expect(err).Should(Succeed())
+		Expect(history).Should(HaveLen(1))
+
+		history, err = testDbMan.getConfigHistory("non-existent")
+		Expect(err).Should(Succeed())
+		Expect(history).Should(BeEmpty())
+	})
+
+	It("should record revisions of changes", func() {
+		old, err := testDbMan.getConfigById(configId)
+		Expect(err).Should(Succeed())
+		updated := *old
+		updated.Revision = "2"
+		updated.BlobID = "new-blob"
+		at := time.Now().Add(time.Hour).Truncate(time.Second)
+		Expect(testDbMan.recordConfigRevisions("1.0.0", at, []*Configuration{&updated}, []*Configuration{old}, nil)).Should(Succeed())
+		Expect(testDbMan.recordConfigRevisions("2.0.0", at.Add(time.Hour), nil, nil, []*Configuration{&updated})).Should(Succeed())
+
+		history, err := testDbMan.getConfigHistory(configId)
+		Expect(err).Should(Succeed())
+		Expect(history).Should(HaveLen(2))
+		Expect(history[0].Configuration).Should(Equal(updated))
+		Expect(history[0].Lsn).Should(Equal("1.0.0"))
+		Expect(history[0].SeenAt.Equal(at)).Should(BeTrue())
+		Expect(history[0].ReplacedLsn).Should(Equal("2.0.0"))
+		Expect(history[0].ReplacedAt.Equal(at.Add(time.Hour))).Should(BeTrue())
+		Expect(history[0].Deleted).Should(BeTrue())
+		Expect(history[1].Configuration).Should(Equal(*old))
+		Expect(history[1].ReplacedLsn).Should(Equal("1.0.0"))
+		Expect(history[1].Deleted).Should(BeFalse())
+
+		// revisions from before history was recorded are added when replaced
+		unknown := makeTestDeployment()
+		Expect(testDbMan.recordConfigRevisions("3.0.0", at, nil, nil, []*Configuration{unknown})).Should(Succeed())
+		history, err = testDbMan.getConfigHistory(unknown.ID)
+		Expect(err).Should(Succeed())
+		Expect(history).Should(HaveLen(1))
+		Expect(history[0].Lsn).Should(BeEmpty())
+		Expect(history[0].SeenAt).Should(BeZero())
+		Expect(history[0].ReplacedLsn).Should(Equal("3.0.0"))
+		Expect(history[0].Deleted).Should(BeTrue())
+	})
+
+	It("should reconstruct the configurations as of a config index", func() {
+		const deletedId = "1dc4895e-6494-4b59-979f-5f4c89c073b4"
+		asOf := func(index string, typeFilter string) map[string]Configuration {
+			confs, err := testDbMan.getConfigurationsAsOf(index, typeFilter)
+			Expect(err).Should(Succeed())
+			byId := make(map[string]Configuration)
+			for _, c := range confs {
+				byId[c.ID] = c
+			}
+			Expect(byId).Should(HaveLen(len(confs)))
+			return byId
+		}
+		old, err := testDbMan.getConfigById(configId)
+		Expect(err).Should(Succeed())
+		deleted, err := testDbMan.getConfigById(deletedId)
+		Expect(err).Should(Succeed())
+		updated := *old
+		updated.Revision = "2"
+		inserted := makeTestDeployment()
+		Expect(testDbMan.recordConfigRevisions("0.1.0", time.Now(), []*Configuration{&updated}, []*Configuration{old}, nil)).Should(Succeed())
+		Expect(testDbMan.recordConfigRevisions("0.2.0", time.Now(), nil, nil, []*Configuration{deleted})).Should(Succeed())
+		Expect(testDbMan.recordConfigRevisions("0.3.0", time.Now(), []*Configuration{inserted}, nil, nil)).Should(Succeed())
+
+		confs := asOf(InitLSN, "")
+		Expect(confs).Should(HaveLen(configCount))
+		Expect(confs[configId]).Should(Equal(*old))
+		confs = asOf("0.1.5", "")
+		Expect(confs).Should(HaveLen(configCount))
+		Expect(confs[configId]).Should(Equal(updated))
+		confs = asOf("0.2.0", "")
+		Expect(confs).Should(HaveLen(configCount - 1))
+		Expect(confs).ShouldNot(HaveKey(deletedId))
+		confs = asOf("0.3.0", "")
+		Expect(confs).Should(HaveLen(configCount))
+		Expect(confs[inserted.ID]).Should(Equal(*inserted))
+		confs = asOf("0.3.0", inserted.Type)
+		Expect(confs).Should(Equal(map[string]Configuration{inserted.ID: *inserted}))
+
+		// history started later
+		_, err = testDbMan.getDb().Exec("DELETE FROM APID_CONFIGURATION_HISTORY;")
+		Expect(err).Should(Succeed())
+		Expect(seedConfigHistory(testDbMan.getDb(), "0.4.0", time.Now())).Should(Succeed())
+		_, err = testDbMan.getConfigurationsAsOf(common.Sequence{LSN: 3}.String(), "")
+		Expect(err).Should(Equal(errHistoryUnavailable))
+		Expect(asOf("0.4.0", "")).Should(HaveLen(configCount))
+
+		// a new snapshot epoch follows all the indexes of the previous ones, whatever their LSN
+		newer := *old
+		newer.Revision = "3"
+		Expect(testDbMan.recordConfigRevisions("7-0.1.0", time.Now(), []*Configuration{&newer}, []*Configuration{old}, nil)).Should(Succeed())
+		Expect(asOf("0.5.0", "")[configId]).Should(Equal(*old))
+		Expect(asOf("7-0.1.0", "")[configId]).Should(Equal(newer))
+		_, err = testDbMan.getConfigurationsAsOf("x-0.1.0", "")
+		Expect(err).Should(Equal(errHistoryUnavailable))
+	})
+
+	It("should retain the blobs of the last revisions of each configuration", func() {
+		revision := func(c Configuration, rev, blobId string) *Configuration {
+			c.ID = "id-" + rev
+			c.Revision = rev
+			c.BlobID = blobId
+			c.BlobResourceID = ""
+			return &c
+		}
+		base, err := testDbMan.getConfigById(configId)
+		Expect(err).Should(Succeed())
+		_, err = testDbMan.getDb().Exec("DELETE FROM APID_CONFIGURATION_HISTORY;")
+		Expect(err).Should(Succeed())
+		first := revision(*base, "1", "blob-1")
+		second := revision(*base, "2", "blob-2")
+		// redeployed with the same blob
+		third := revision(*base, "3", "blob-2")
+		fourth := revision(*base, "4", "blob-4")
+		Expect(testDbMan.recordConfigRevisions("0.1.0", time.Now(), []*Configuration{first}, nil, nil)).Should(Succeed())
+		Expect(testDbMan.recordConfigRevisions("0.2.0", time.Now(), []*Configuration{second}, nil, []*Configuration{first})).Should(Succeed())
+		Expect(testDbMan.recordConfigRevisions("0.3.0", time.Now(), []*Configuration{third}, nil, []*Configuration{second})).Should(Succeed())
+		Expect(testDbMan.recordConfigRevisions("0.4.0", time.Now(), []*Configuration{fourth}, nil, []*Configuration{third})).Should(Succeed())
+
+		retained, err := testDbMan.getRetainedBlobs(nil, 2)
+		Expect(err).Should(Succeed())
+		Expect(retained).Should(Equal(map[string]bool{"blob-4": true, "blob-2": true}))
+		retained, err = testDbMan.getRetainedBlobs(map[string]int{base.Type: 3}, 1)
+		Expect(err).Should(Succeed())
+		Expect(retained).Should(Equal(map[string]bool{"blob-4": true, "blob-2": true, "blob-1": true}))
+		retained, err = testDbMan.getRetainedBlobs(map[string]int{"other": 3}, 1)
+		Expect(err).Should(Succeed())
+		Expect(retained).Should(Equal(map[string]bool{"blob-4": true}))
+
+		// nothing is retained of deleted configurations
+		Expect(testDbMan.recordConfigRevisions("0.5.0", time.Now(), nil, nil, []*Configuration{fourth})).Should(Succeed())
+		retained, err = testDbMan.getRetainedBlobs(nil, 3)
+		Expect(err).Should(Succeed())
+		Expect(retained).Should(BeEmpty())
+	})
+
+	It("should parse retained revisions by type", func() {
+		retain, err := parseRetainRevisionsByType("ORGANIZATION:10, ENVIRONMENT:1,")
+		Expect(err).Should(Succeed())
+		Expect(retain).Should(Equal(map[string]int{"ORGANIZATION": 10, "ENVIRONMENT": 1}))
+		_, err = parseRetainRevisionsByType("ORGANIZATION")
+		Expect(err).Should(MatchError(ContainSubstring("revisions")))
+		_, err = parseRetainRevisionsByType("ORGANIZATION:0")
+		Expect(err).Should(MatchError(ContainSubstring("at least 1")))
+	})
+
+	It("should prune old revisions whose blobs aren't retained", func() {
+		base := makeTestDeployment()
+		revision := func(rev, blobId string) *Configuration {
+			c := *base
+			c.ID = "id-" + rev
+			c.Revision = rev
+			c.BlobID = blobId
+			c.BlobResourceID = ""
+			return &c
+		}
+		_, err := testDbMan.getDb().Exec("DELETE FROM APID_CONFIGURATION_HISTORY;")
+		Expect(err).Should(Succeed())
+		now := time.Now()
+		day := 24 * time.Hour
+		first := revision("1", "blob-1")
+		second := revision("2", "blob-2")
+		third := revision("3", "blob-3")
+		fourth := revision("4", "blob-4")
+		Expect(testDbMan.recordConfigRevisions("0.1.0", now.Add(-10*day), []*Configuration{first}, nil, nil)).Should(Succeed())
+		Expect(testDbMan.recordConfigRevisions("0.2.0", now.Add(-9*day), []*Configuration{second}, nil, []*Configuration{first})).Should(Succeed())
+		Expect(testDbMan.recordConfigRevisions("0.3.0", now.Add(-8*day), []*Configuration{third}, nil, []*Configuration{second})).Should(Succeed())
+		Expect(testDbMan.recordConfigRevisions("0.4.0", now.Add(-time.Hour), []*Configuration{fourth}, nil, []*Configuration{third})).Should(Succeed())
+
+		// the third one is retained, the fourth one replaced it recently anyway
+		n, err := testDbMan.pruneConfigHistory(now.Add(-2*day), nil, 2)
+		Expect(err).Should(Succeed())
+		Expect(n).Should(Equal(2))
+		for _, c := range []*Configuration{first, second} {
+			history, err := testDbMan.getConfigHistory(c.ID)
+			Expect(err).Should(Succeed())
+			Expect(history).Should(BeEmpty())
+		}
+		n, err = testDbMan.pruneConfigHistory(now.Add(-2*day), nil, 2)
+		Expect(err).Should(Succeed())
+		Expect(n).Should(BeZero())
+
+		// asOf doesn't reach back before the pruned revisions were replaced
+		_, err = testDbMan.getConfigurationsAsOf("0.2.5", "")
+		Expect(err).Should(Equal(errHistoryUnavailable))
+		confs, err := testDbMan.getConfigurationsAsOf("0.3.0", "")
+		Expect(err).Should(Succeed())
+		Expect(confs).Should(Equal([]Configuration{*third}))
+
+		// nor after the history is carried over to a new snapshot
+		testDbMan.setDbVersion("testHistoryNext" + strconv.Itoa(testCount))
+		initTestDb(testDbMan.getDb())
+		Expect(testDbMan.initDb()).Should(Succeed())
+		_, err = testDbMan.getConfigurationsAsOf("0.2.5", "")
+		Expect(err).Should(Equal(errHistoryUnavailable))
+	})
+
+	It("should carry history over to a new snapshot", func() {
+		old, err := testDbMan.getConfigById(configId)
+		Expect(err).Should(Succeed())
+		updated := *old
+		updated.Revision = "2"
+		Expect(testDbMan.recordConfigRevisions("1.0.0", time.Now(), []*Configuration{&updated}, []*Configuration{old}, nil)).Should(Succeed())
+		Expect(testDbMan.updateLSN("1.0.0")).Should(Succeed())
+
+		// the new snapshot has the original revision, and misses another configuration
+		testDbMan.setDbVersion("testHistoryNext" + strconv.Itoa(testCount))
+		initTestDb(testDbMan.getDb())
+		_, err = testDbMan.getDb().Exec("DELETE FROM metadata_runtime_entity_metadata WHERE id = ?;",
+			"1dc4895e-6494-4b59-979f-5f4c89c073b4")
+		Expect(err).Should(Succeed())
+		Expect(testDbMan.initDb()).Should(Succeed())
+
+		// the new snapshot is seeded under its own epoch
+		index := formatConfigIndex(testDbMan.getEpoch(), "1.0.0")
+		Expect(index).ShouldNot(Equal("1.0.0"))
+		history, err := testDbMan.getConfigHistory(configId)
+		Expect(err).Should(Succeed())
+		Expect(history).Should(HaveLen(3))
+		Expect(history[0].Revision).Should(BeEmpty())
+		Expect(history[0].Lsn).Should(Equal(index))
+		Expect(history[0].ReplacedAt).Should(BeZero())
+		Expect(history[1].Revision).Should(Equal("2"))
+		Expect(history[1].ReplacedLsn).Should(Equal(index))
+		Expect(history[1].Deleted).Should(BeFalse())
+
+		history, err = testDbMan.getConfigHistory("1dc4895e-6494-4b59-979f-5f4c89c073b4")
+		Expect(err).Should(Succeed())
+		Expect(history).Should(HaveLen(1))
+		Expect(history[0].ReplacedLsn).Should(Equal(index))
+		Expect(history[0].Deleted).Should(BeTrue())
+	})
+})
@@ -45,6 +45,31 @@ const (
 	maxIdleConnsPerHost         = 50
 	httpTimeout                 = time.Minute
 	configBearerToken           = "apigeesync_bearer_token"
+	configTrustedKeysDir        = "gatewaydeploy_trusted_keys_dir"
+	configTypePriorities        = "gatewaydeploy_download_type_priorities"
+	configBlobOnDemand          = "gatewaydeploy_blob_on_demand"
+	configBlobStallTimeout      = "gatewaydeploy_blob_stall_timeout"
+	configBreakerThreshold      = "gatewaydeploy_breaker_failure_threshold"
+	configBreakerProbeInterval  = "gatewaydeploy_breaker_probe_interval"
+	configBlobMirrorPolicy      = "gatewaydeploy_blob_mirror_policy"
+	configTokenSource           = "gatewaydeploy_token_source"
+	configTokenFile             = "gatewaydeploy_token_file"
+	configOAuthTokenURL         = "gatewaydeploy_oauth_token_url"
+	configOAuthClientId         = "gatewaydeploy_oauth_client_id"
+	configOAuthClientSecret     = "gatewaydeploy_oauth_client_secret"
+	configBandwidthGlobal       = "gatewaydeploy_bandwidth_global"
+	configBandwidthWorker       = "gatewaydeploy_bandwidth_worker"
+	configBandwidthSchedules    = "gatewaydeploy_bandwidth_schedules"
+	configWorkersAdaptive       = "gatewaydeploy_download_workers_adaptive"
+	configWorkersMin            = "gatewaydeploy_download_workers_min"
+	configWorkersMax            = "gatewaydeploy_download_workers_max"
+	configShutdownTimeout       = "gatewaydeploy_shutdown_timeout"
+	configPinReleaseOnChange    = "gatewaydeploy_pin_release_on_change"
+	configRetainRevisions       = "gatewaydeploy_retain_revisions"
+	configRetainRevisionsByType = "gatewaydeploy_retain_revisions_by_type"
+	configHistoryMaxAge         = "gatewaydeploy_history_max_age"
+	configGzipResponses         = "gatewaydeploy_configurations_gzip"
+	configCursorSecret          = "gatewaydeploy_cursor_secret"
 )
 
 var (
@@ -55,6 +80,10 @@ var (
 	debounceDuration time.Duration
 	apiServerBaseURI *url.URL
 	eventHandler     *apigeeSyncHandler
+	// download priority added for blobs of configurations by type
+	downloadTypePriorities map[string]int
+	// bearer tokens for the blob server
+	tokens tokenProvider = &configTokenProvider{}
 )
 
 func init() {
@@ -91,6 +120,22 @@ func initPlugin(s apid.Services) (apid.PluginData, error) {
 	config.SetDefault(configDownloadConnTimeout, 5*time.Minute)
 	config.SetDefault(configConcurrentDownloads, 15)
 	config.SetDefault(configDownloadQueueSize, 2000)
+	config.SetDefault(configBlobOnDemand, blobOnDemandOff)
+	config.SetDefault(configBlobStallTimeout, 30*time.Second)
+	config.SetDefault(configBreakerThreshold, 5)
+	config.SetDefault(configBreakerProbeInterval, 30*time.Second)
+	config.SetDefault(configBlobMirrorPolicy, mirrorPolicyFailover)
+	config.SetDefault(configTokenSource, tokenSourceConfig)
+	config.SetDefault(configBandwidthGlobal, 0)
+	config.SetDefault(configBandwidthWorker, 0)
+	config.SetDefault(configWorkersAdaptive, false)
+	config.SetDefault(configWorkersMin, 1)
+	config.SetDefault(configWorkersMax, 50)
+	config.SetDefault(configShutdownTimeout, defaultShutdownTimeout)
+	config.SetDefault(configPinReleaseOnChange, true)
+	config.SetDefault(configRetainRevisions, 3)
+	config.SetDefault(configHistoryMaxAge, 30*24*time.Hour)
+	config.SetDefault(configGzipResponses, false)
 
 	debounceDuration = config.GetDuration(configDebounceDuration)
 	if debounceDuration < time.Millisecond {
@@ -112,6 +157,96 @@ func initPlugin(s apid.Services) (apid.PluginData, error) {
 		return pluginData, fmt.Errorf("%s must be a positive duration", configDownloadConnTimeout)
 	}
 
+	blobOnDemandMode := config.GetString(configBlobOnDemand)
+	switch blobOnDemandMode {
+	case blobOnDemandOff, blobOnDemandStream, blobOnDemandRetry:
+	default:
+		return pluginData, fmt.Errorf("%s must be one of %s, %s, %s", configBlobOnDemand, blobOnDemandOff, blobOnDemandStream, blobOnDemandRetry)
+	}
+
+	blobStallTimeout := config.GetDuration(configBlobStallTimeout)
+	if blobStallTimeout < time.Millisecond {
+		return pluginData, fmt.Errorf("%s must be a positive duration", configBlobStallTimeout)
+	}
+
+	breakerThreshold := config.GetInt(configBreakerThreshold)
+	if breakerThreshold < 1 {
+		return pluginData, fmt.Errorf("%s must be a positive integer", configBreakerThreshold)
+	}
+
+	breakerProbeInterval := config.GetDuration(configBreakerProbeInterval)
+	if breakerProbeInterval < time.Millisecond {
+		return pluginData, fmt.Errorf("%s must be a positive duration", configBreakerProbeInterval)
+	}
+
+	// the blob server base may be a list of mirrors
+	blobServerURLs, err := parseMirrors(config.GetString(configBlobServerBaseURI))
+	if err != nil {
+		return pluginData, fmt.Errorf("%s parse err: %v", configBlobServerBaseURI, err)
+	}
+
+	blobMirrorPolicy := config.GetString(configBlobMirrorPolicy)
+	switch blobMirrorPolicy {
+	case mirrorPolicyFailover, mirrorPolicyLatency:
+	default:
+		return pluginData, fmt.Errorf("%s must be one of %s, %s", configBlobMirrorPolicy, mirrorPolicyFailover, mirrorPolicyLatency)
+	}
+
+	bandwidthSchedules, err := parseBandwidthSchedules(config.GetString(configBandwidthSchedules))
+	if err != nil {
+		return pluginData, fmt.Errorf("%s parse err: %v", configBandwidthSchedules, err)
+	}
+	bandwidth := bandwidthLimits{
+		GlobalBytesPerSec: int64(config.GetInt(configBandwidthGlobal)),
+		WorkerBytesPerSec: int64(config.GetInt(configBandwidthWorker)),
+		Schedules:         bandwidthSchedules,
+	}
+	if err := bandwidth.validate(); err != nil {
+		return pluginData, fmt.Errorf("invalid bandwidth limits: %v", err)
+	}
+
+	workersMin := config.GetInt(configWorkersMin)
+	workersMax := config.GetInt(configWorkersMax)
+	if workersMin < 1 || workersMax < workersMin {
+		return pluginData, fmt.Errorf("%s and %s must be positive, min <= max", configWorkersMin, configWorkersMax)
+	}
+
+	shutdownTimeout := config.GetDuration(configShutdownTimeout)
+	if shutdownTimeout < time.Millisecond || shutdownTimeout >= apid.ShutdownTimeout {
+		return pluginData, fmt.Errorf("%s must be a positive duration shorter than %s", configShutdownTimeout, apid.ShutdownTimeout)
+	}
+
+	downloadTypePriorities, err = parseTypePriorities(config.GetString(configTypePriorities))
+	if err != nil {
+		return pluginData, fmt.Errorf("%s parse err: %v", configTypePriorities, err)
+	}
+	for confType, p := range downloadTypePriorities {
+		if p < -maxTypePriority || p > maxTypePriority {
+			return pluginData, fmt.Errorf("%s must be between %d and %d for %s", configTypePriorities, -maxTypePriority, maxTypePriority, confType)
+		}
+	}
+
+	retainRevisions := config.GetInt(configRetainRevisions)
+	if retainRevisions < 1 {
+		return pluginData, fmt.Errorf("%s must be at least 1", configRetainRevisions)
+	}
+	retainRevisionsByType, err := parseRetainRevisionsByType(config.GetString(configRetainRevisionsByType))
+	if err != nil {
+		return pluginData, fmt.Errorf("%s parse err: %v", configRetainRevisionsByType, err)
+	}
+	historyMaxAge := config.GetDuration(configHistoryMaxAge)
+	if historyMaxAge <= 0 {
+		log.Warnf("%s is not positive, the configuration history is never pruned and grows forever", configHistoryMaxAge)
+	}
+
+	if !config.IsSet(configCursorSecret) {
+		log.Infof("%s is not set, config index cursors signed before a restart are rejected", configCursorSecret)
+	}
+	cursors, err := newCursorSigner(config.GetString(configCursorSecret))
+	if err != nil {
+		return pluginData, fmt.Errorf("unable to initialize config index cursors: %v", err)
+	}
+
 	log.Debug("apiServerBaseURI = " + apiServerBaseURI.String())
 
 	tr = util.Transport(config.GetString(util.ConfigfwdProxyPortURL))
@@ -121,11 +256,44 @@ func initPlugin(s apid.Services) (apid.PluginData, error) {
 		Transport: tr,
 		Timeout:   httpTimeout,
 		CheckRedirect: func(req *http.Request, _ []*http.Request) error {
-			req.Header.Set("Authorization", getBearerToken())
+			token, err := getBearerToken(req.Context())
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Authorization", token)
 			return nil
 		},
 	}
 
+	switch source := config.GetString(configTokenSource); source {
+	case tokenSourceConfig:
+		tokens = &configTokenProvider{}
+	case tokenSourceFile:
+		if !config.IsSet(configTokenFile) {
+			return pluginData, fmt.Errorf("Missing required config value: %s", configTokenFile)
+		}
+		tokens = &fileTokenProvider{
+			path: config.GetString(configTokenFile),
+		}
+	case tokenSourceOAuth:
+		for _, key := range []string{configOAuthTokenURL, configOAuthClientId, configOAuthClientSecret} {
+			if !config.IsSet(key) {
+				return pluginData, fmt.Errorf("Missing required config value: %s", key)
+			}
+		}
+		tokens = &oauthTokenProvider{
+			client: &http.Client{
+				Transport: tr,
+				Timeout:   httpTimeout,
+			},
+			tokenURL:     config.GetString(configOAuthTokenURL),
+			clientId:     config.GetString(configOAuthClientId),
+			clientSecret: config.GetString(configOAuthClientSecret),
+		}
+	default:
+		return pluginData, fmt.Errorf("%s must be one of %s, %s, %s", configTokenSource, tokenSourceConfig, tokenSourceFile, tokenSourceOAuth)
+	}
+
 	// initialize db manager
 
 	dbMan := &dbManager{
@@ -140,14 +308,25 @@ func initPlugin(s apid.Services) (apid.PluginData, error) {
 		configurationEndpoint:   configEndpoint,
 		blobEndpoint:            blobEndpoint,
 		configurationIdEndpoint: configIdEndpoint,
+		historyEndpoint:         historyEndpoint,
+		healthEndpoint:          healthEndpoint,
+		metricsEndpoint:         metricsEndpoint,
+		bandwidthEndpoint:       bandwidthEndpoint,
+		workersEndpoint:         workersEndpoint,
+		downloadsEndpoint:       downloadsEndpoint,
+		pinsEndpoint:            pinsEndpoint,
 		newChangeListChan:       make(chan interface{}, 5),
 		addSubscriber:           make(chan chan interface{}, 100),
 		apiInitialized:          false,
+		blobOnDemandMode:        blobOnDemandMode,
+		blobStallTimeout:        blobStallTimeout,
+		responseCache:           newResponseCache(),
+		gzipResponses:           config.GetBool(configGzipResponses),
+		cursors:                 cursors,
 	}
 
 	// initialize bundle manager
 
-	blobServerURL := config.GetString(configBlobServerBaseURI)
 	relativeBundlePath := config.GetString(configBlobDirKey)
 	storagePath := config.GetString(configStoragePath)
 	bundlePath = path.Join(storagePath, relativeBundlePath)
@@ -155,22 +334,42 @@ func initPlugin(s apid.Services) (apid.PluginData, error) {
 		return pluginData, fmt.Errorf("Failed bundle directory creation: %v", err)
 	}
 	log.Infof("Bundle directory path is %s", bundlePath)
+	// blob signature verification is enabled only if trusted keys are configured
+	var verifier *blobVerifier
+	if config.IsSet(configTrustedKeysDir) {
+		verifier, err = loadTrustedKeys(config.GetString(configTrustedKeysDir))
+		if err != nil {
+			return pluginData, fmt.Errorf("Failed loading trusted keys: %v", err)
+		}
+		log.Infof("Blob signature verification enabled with %d trusted keys", len(verifier.keys))
+	}
+
 	concurrentDownloads := config.GetInt(configConcurrentDownloads)
 	downloadQueueSize := config.GetInt(configDownloadQueueSize)
 	bundleMan := &bundleManager{
-		blobServerUrl:         blobServerURL,
+		mirrors:               newMirrorSet(blobServerURLs, blobMirrorPolicy),
 		dbMan:                 dbMan,
 		apiMan:                apiMan,
 		concurrentDownloads:   concurrentDownloads,
 		markConfigFailedAfter: markDeploymentFailedAfter,
 		bundleRetryDelay:      time.Second,
 		bundleCleanupDelay:    bundleCleanupDelay,
-		downloadQueue:         make(chan *DownloadRequest, downloadQueueSize),
+		downloadQueue:         newDownloadQueue(downloadQueueSize),
+		breaker:               newCircuitBreaker(breakerThreshold, breakerProbeInterval),
 		isClosed:              new(int32),
 		client:                httpClient,
+		verifier:              verifier,
+		bandwidth:             newBandwidthLimiter(bandwidth),
+		shutdownTimeout:       shutdownTimeout,
+		retainRevisions:       retainRevisions,
+		retainRevisionsByType: retainRevisionsByType,
+		historyMaxAge:         historyMaxAge,
 	}
+	bundleMan.pool = newWorkerPool(bundleMan, workersMin, workersMax, config.GetBool(configWorkersAdaptive))
 
 	bundleMan.initializeBundleDownloading()
+	apiMan.bundleMan = bundleMan
+	apiMan.verifyBlobs = verifier != nil
 
 	// initialize event handler
 	eventHandler = &apigeeSyncHandler{
@@ -178,6 +377,8 @@ func initPlugin(s apid.Services) (apid.PluginData, error) {
 		apiMan:    apiMan,
 		bundleMan: bundleMan,
 		closed:    false,
+
+		pinReleaseOnChange: config.GetBool(configPinReleaseOnChange),
 	}
 
 	eventHandler.initListener(services)
@@ -186,7 +387,3 @@ func initPlugin(s apid.Services) (apid.PluginData, error) {
 
 	return pluginData, nil
 }
-
-func getBearerToken() string {
-	return "Bearer " + config.GetString(configBearerToken)
-}
@@ -15,6 +15,7 @@ package apiGatewayConfDeploy
 
 import (
 	"os"
+	"time"
 
 	"github.com/apid/apid-core"
 	"github.com/apigee-labs/transicator/common"
@@ -27,6 +28,16 @@ const (
 
 func (h *apigeeSyncHandler) initListener(services apid.Services) {
 	services.Events().Listen(APIGEE_SYNC_EVENT, h)
+	services.Events().ListenOnceFunc(apid.ShutdownEventSelector, h.shutdown)
+}
+
+// shutdown stops processing changes, then stops the downloads.
+// apid waits for it to return, up to apid.ShutdownTimeout.
+func (h *apigeeSyncHandler) shutdown(event apid.Event) {
+	log.Debugf("shutting down: %v", event)
+	h.stopListener(services)
+	h.bundleMan.Close()
+	log.Debug("shutdown complete")
 }
 
 func (h *apigeeSyncHandler) stopListener(services apid.Services) {
@@ -41,6 +52,8 @@ type apigeeSyncHandler struct {
 	apiMan    apiManagerInterface
 	bundleMan bundleManagerInterface
 	closed    bool
+	// remove the pin of a configuration when a change of it arrives
+	pinReleaseOnChange bool
 }
 
 func (h *apigeeSyncHandler) String() string {
@@ -69,7 +82,7 @@ func (h *apigeeSyncHandler) processSnapshot(snapshot *common.Snapshot) {
 	}
 
 	if lsn := h.dbMan.getLSN(); lsn != "" {
-		// receive a new snapshot at runtime
+		// receive a new snapshot at runtime, initDb started a new epoch for it
 		if err = h.dbMan.updateLSN(lsn); err != nil {
 			log.Errorf("Unable to update LSN: %v", err)
 		}
@@ -77,6 +90,12 @@ func (h *apigeeSyncHandler) processSnapshot(snapshot *common.Snapshot) {
 		if err = h.dbMan.loadLsnFromDb(); err != nil {
 			log.Errorf("Unable to load LSN From Db: %v", err)
 		}
+		// the db is of a new snapshot if no epoch was started on it
+		if h.dbMan.getEpoch() == 0 {
+			if err = h.dbMan.startSnapshotEpoch(); err != nil {
+				log.Errorf("Unable to start snapshot epoch: %v", err)
+			}
+		}
 	}
 	h.startupOnExistingDatabase()
 	//h.apiMan.InitAPI()
@@ -97,8 +116,34 @@ func (h *apigeeSyncHandler) startupOnExistingDatabase() {
 
 		log.Debugf("Queuing %d blob downloads", len(blobIds))
 
+		// partial files of blobs unreferenced since the last run aren't resumed
+		h.bundleMan.purgePartialBlobs()
+
+		// per-type priorities of the backfill
+		var priorities map[string]int
+		if confs, err := h.dbMan.getAllConfigurations(""); err != nil {
+			log.Errorf("unable to query database for configuration types: %v", err)
+		} else {
+			priorities = blobPriorities(configurationPointers(confs), priorityBackfill)
+		}
+
+		// downloads pending at the last shutdown keep their priority
+		if pending, err := h.dbMan.takePendingDownloads(); err != nil {
+			log.Errorf("unable to query database for pending downloads: %v", err)
+		} else if len(pending) > 0 {
+			log.Debugf("resuming %d pending downloads", len(pending))
+			if priorities == nil {
+				priorities = make(map[string]int)
+			}
+			for blobId, priority := range pending {
+				if priority > priorities[blobId] {
+					priorities[blobId] = priority
+				}
+			}
+		}
+
 		// initialize API endpoints only after 1 round of download attempts is made
-		h.bundleMan.downloadBlobsWithCallback(blobIds, func() {
+		h.bundleMan.downloadBlobsWithCallback(blobIds, priorities, func() {
 			h.apiMan.InitAPI()
 			h.apiMan.notifyNewChange()
 		})
@@ -106,52 +151,133 @@ func (h *apigeeSyncHandler) startupOnExistingDatabase() {
 	}()
 }
 
+// configChange is the net change of a configuration in a change list:
+// old is nil if it was inserted, new is nil if it was deleted.
+type configChange struct {
+	old, new *Configuration
+}
+
 func (h *apigeeSyncHandler) processChangeList(changes *common.ChangeList) {
 
 	log.Debugf("Processing changes")
 	// changes have been applied to DB by apidApigeeSync
-	var insertedConfigs, updatedNewConfigs, updatedOldConfigs, deletedConfigs []*Configuration
+	// a configuration may change several times in a change list, only its state before and after the list counts
+	var ids []string
+	netChanges := make(map[string]*configChange)
+	var oldConfigs []*Configuration
 	isConfigChanged := false
 	for _, change := range changes.Changes {
 		switch change.Table {
 		case CONFIG_METADATA_TABLE:
 			isConfigChanged = true
+			var oldConf, newConf *Configuration
 			switch change.Operation {
 			case common.Insert:
 				conf := configurationFromRow(change.NewRow)
-				insertedConfigs = append(insertedConfigs, &conf)
+				newConf = &conf
 			case common.Delete:
 				conf := configurationFromRow(change.OldRow)
-				deletedConfigs = append(deletedConfigs, &conf)
+				oldConf = &conf
 			case common.Update:
 				confNew := configurationFromRow(change.NewRow)
 				confOld := configurationFromRow(change.OldRow)
-				updatedNewConfigs = append(updatedNewConfigs, &confNew)
-				updatedOldConfigs = append(updatedOldConfigs, &confOld)
+				oldConf, newConf = &confOld, &confNew
 			default:
 				log.Errorf("unexpected operation: %s", change.Operation)
+				continue
 			}
+			if oldConf != nil {
+				oldConfigs = append(oldConfigs, oldConf)
+			}
+			var id string
+			if newConf != nil {
+				id = newConf.ID
+			} else {
+				id = oldConf.ID
+			}
+			net := netChanges[id]
+			if net == nil {
+				net = &configChange{old: oldConf}
+				netChanges[id] = net
+				ids = append(ids, id)
+			}
+			net.new = newConf
 		}
 	}
-	// delete old configs from FS
-	if len(deletedConfigs)+len(updatedOldConfigs) > 0 {
-		log.Debugf("will delete %d old blobs", len(deletedConfigs)+len(updatedOldConfigs))
-		//TODO delete blobs for deleted configs
-		blobIds := extractBlobsToDelete(append(deletedConfigs, updatedOldConfigs...))
+	var insertedConfigs, updatedNewConfigs, updatedOldConfigs, deletedConfigs []*Configuration
+	for _, id := range ids {
+		switch net := netChanges[id]; {
+		case net.old == nil && net.new == nil:
+			// inserted and deleted again
+		case net.old == nil:
+			insertedConfigs = append(insertedConfigs, net.new)
+		case net.new == nil:
+			deletedConfigs = append(deletedConfigs, net.old)
+		default:
+			updatedNewConfigs = append(updatedNewConfigs, net.new)
+			updatedOldConfigs = append(updatedOldConfigs, net.old)
+		}
+	}
+	// delete old configs from FS, including those only seen within the change list
+	if len(oldConfigs) > 0 {
+		log.Debugf("will delete %d old blobs", len(oldConfigs))
+		blobIds := extractBlobsToDelete(oldConfigs)
 		go h.bundleMan.deleteBlobs(blobIds)
 	}
 
 	// download and expose new configs
 	if isConfigChanged {
+		newConfigs := append(insertedConfigs, updatedNewConfigs...)
+		// configurations are served from memory, and must not be behind the config index
+		h.dbMan.applyConfigChanges(changes.LastSequence, newConfigs, deletedConfigs)
 		h.dbMan.updateLSN(changes.LastSequence)
-		blobs := extractBlobsToDownload(append(insertedConfigs, updatedNewConfigs...))
-		h.bundleMan.downloadBlobsWithCallback(blobs, h.apiMan.notifyNewChange)
+		index := formatConfigIndex(h.dbMan.getEpoch(), changes.LastSequence)
+		err := h.dbMan.recordConfigRevisions(index, time.Now(), newConfigs, updatedOldConfigs, deletedConfigs)
+		if err != nil {
+			log.Errorf("Unable to record configuration history: %v", err)
+		}
+		h.releasePins(append(newConfigs, deletedConfigs...), changes.LastSequence)
+		blobs := extractBlobsToDownload(newConfigs)
+		h.bundleMan.downloadBlobsWithCallback(blobs, blobPriorities(newConfigs, priorityChangeList), h.apiMan.notifyNewChange)
 	} else if h.dbMan.getLSN() == InitLSN {
 		h.dbMan.updateLSN(changes.LastSequence)
 	}
 
 }
 
+// releasePins removes the pins of changed configurations, or warns that they're kept
+func (h *apigeeSyncHandler) releasePins(changed []*Configuration, lsn string) {
+	pins, err := h.dbMan.getConfigPins()
+	if err != nil {
+		log.Errorf("Unable to get configuration pins: %v", err)
+		return
+	}
+	if len(pins) == 0 {
+		return
+	}
+	pinned := make(map[string]*configPin, len(pins))
+	for i := range pins {
+		pinned[pins[i].ID] = &pins[i]
+	}
+	for _, conf := range changed {
+		pin := pinned[conf.ID]
+		if pin == nil {
+			continue
+		}
+		if !h.pinReleaseOnChange {
+			log.Warnf("configuration %s changed at %s, still pinned to revision %q (config index %s)",
+				conf.ID, lsn, pin.Revision, pin.Lsn)
+			continue
+		}
+		if _, err := h.dbMan.unpinConfiguration(conf.ID); err != nil {
+			log.Errorf("Unable to release pin of configuration %s: %v", conf.ID, err)
+			continue
+		}
+		log.Warnf("configuration %s unpinned from revision %q (config index %s) by change at %s",
+			conf.ID, pin.Revision, pin.Lsn, lsn)
+	}
+}
+
 func extractBlobsToDownload(confs []*Configuration) (blobs []string) {
 	//TODO: do not include already-downloaded blobs
 	for _, conf := range confs {
@@ -178,6 +304,14 @@ func extractBlobsToDelete(confs []*Configuration) (blobs []string) {
 	return
 }
 
+func configurationPointers(confs []Configuration) []*Configuration {
+	ptrs := make([]*Configuration, len(confs))
+	for i := range confs {
+		ptrs[i] = &confs[i]
+	}
+	return ptrs
+}
+
 func configurationFromRow(row common.Row) (c Configuration) {
 
 	row.Get("id", &c.ID)
@@ -197,7 +331,7 @@ func configurationFromRow(row common.Row) (c Configuration) {
 	return
 }
 
-// TODO delete from file system
+// safeDelete removes a file from the file system. A missing file is fine, other failures are only logged.
 func safeDelete(file string) {
 	if e := os.Remove(file); e != nil && !os.IsNotExist(e) {
 		log.Warnf("unable to delete file %s: %v", file, e)
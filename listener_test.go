@@ -124,6 +124,22 @@ var _ = Describe("listener", func() {
 			Expect(dummyDbMan.getLSN()).Should(Equal(dummyDbMan.dbLSN))
 		})
 
+		It("Should start a snapshot epoch on new snapshots only", func() {
+			dummyDbMan.dbLSN = "1.0.0"
+			// apid starts from a new snapshot
+			<-apid.Events().Emit(APIGEE_SYNC_EVENT, &common.Snapshot{SnapshotInfo: fmt.Sprint(rand.Uint32())})
+			Expect(dummyDbMan.getEpoch()).Should(Equal(int64(1)))
+
+			// apid restarts from the same db
+			dummyDbMan.lsn = ""
+			<-apid.Events().Emit(APIGEE_SYNC_EVENT, &common.Snapshot{SnapshotInfo: dummyDbMan.version})
+			Expect(dummyDbMan.getEpoch()).Should(Equal(int64(1)))
+
+			// a new snapshot at runtime
+			<-apid.Events().Emit(APIGEE_SYNC_EVENT, &common.Snapshot{SnapshotInfo: fmt.Sprint(rand.Uint32())})
+			Expect(dummyDbMan.getEpoch()).Should(Equal(int64(2)))
+		})
+
 		It("Should store LSN when receiving snapshot at runtime", func() {
 			dummyDbMan.lsn = fmt.Sprintf("%d.%d.%d", testCount, testCount, testCount)
 			// emit snapshot
@@ -237,6 +253,174 @@ var _ = Describe("listener", func() {
 			}
 
 		})
+
+		It("should release pins of changed configurations", func() {
+			updated := makeTestDeployment()
+			deleted := makeTestDeployment()
+			kept := makeTestDeployment()
+			for _, conf := range []*Configuration{updated, deleted, kept} {
+				dummyDbMan.pins = append(dummyDbMan.pins, configPin{Configuration: *conf})
+			}
+			changeList := &common.ChangeList{
+				Changes: []common.Change{
+					{
+						Operation: common.Update,
+						Table:     CONFIG_METADATA_TABLE,
+						NewRow:    rowFromDeployment(updated),
+						OldRow:    rowFromDeployment(updated),
+					},
+					{
+						Operation: common.Delete,
+						Table:     CONFIG_METADATA_TABLE,
+						OldRow:    rowFromDeployment(deleted),
+					},
+				},
+				LastSequence: "2.2.2",
+			}
+
+			// pins are kept unless configured
+			<-apid.Events().Emit(APIGEE_SYNC_EVENT, changeList)
+			for i := 0; i < 2; i++ {
+				<-dummyBundleMan.blobChan
+			}
+			Expect(dummyDbMan.pins).Should(HaveLen(3))
+
+			testHandler.pinReleaseOnChange = true
+			<-apid.Events().Emit(APIGEE_SYNC_EVENT, changeList)
+			for i := 0; i < 2; i++ {
+				<-dummyBundleMan.blobChan
+			}
+			Expect(dummyDbMan.pins).Should(Equal([]configPin{{Configuration: *kept}}))
+		})
+
+		It("should record the revisions of changes", func() {
+			inserted := makeTestDeployment()
+			updated := makeTestDeployment()
+			changeList := &common.ChangeList{
+				Changes: []common.Change{
+					{
+						Operation: common.Insert,
+						Table:     CONFIG_METADATA_TABLE,
+						NewRow:    rowFromDeployment(inserted),
+					},
+					{
+						Operation: common.Update,
+						Table:     CONFIG_METADATA_TABLE,
+						NewRow:    rowFromDeployment(updated),
+						OldRow:    rowFromDeployment(makeTestDeployment()),
+					},
+				},
+				LastSequence: "2.2.2",
+			}
+
+			<-apid.Events().Emit(APIGEE_SYNC_EVENT, changeList)
+			for i := 0; i < 4; i++ {
+				<-dummyBundleMan.blobChan
+			}
+
+			Expect(dummyDbMan.history).Should(HaveLen(2))
+			for i, conf := range []*Configuration{inserted, updated} {
+				Expect(dummyDbMan.history[i].Configuration).Should(Equal(*conf))
+				Expect(dummyDbMan.history[i].Lsn).Should(Equal("2.2.2"))
+			}
+		})
+
+		It("should apply changes to the in-memory configurations", func() {
+			old := makeTestDeployment()
+			deleted := makeTestDeployment()
+			dummyDbMan.snapshot = newConfigSnapshot("1.1.1", []Configuration{*old, *deleted})
+			updated := *old
+			updated.Revision = "2"
+			inserted := makeTestDeployment()
+			changeList := &common.ChangeList{
+				Changes: []common.Change{
+					{
+						Operation: common.Update,
+						Table:     CONFIG_METADATA_TABLE,
+						NewRow:    rowFromDeployment(&updated),
+						OldRow:    rowFromDeployment(old),
+					},
+					{
+						Operation: common.Delete,
+						Table:     CONFIG_METADATA_TABLE,
+						OldRow:    rowFromDeployment(deleted),
+					},
+					{
+						Operation: common.Insert,
+						Table:     CONFIG_METADATA_TABLE,
+						NewRow:    rowFromDeployment(inserted),
+					},
+				},
+				LastSequence: "2.2.2",
+			}
+
+			<-apid.Events().Emit(APIGEE_SYNC_EVENT, changeList)
+			for i := 0; i < 4; i++ {
+				<-dummyBundleMan.blobChan
+			}
+
+			Expect(dummyDbMan.snapshot.lsn).Should(Equal("2.2.2"))
+			Expect(dummyDbMan.snapshot.getConfigurations("")).Should(Equal([]Configuration{updated, *inserted}))
+		})
+
+		It("should apply the net change of configurations changed several times", func() {
+			reinserted := makeTestDeployment()
+			dummyDbMan.snapshot = newConfigSnapshot("1.1.1", []Configuration{*reinserted})
+			inserted := makeTestDeployment()
+			updated := *inserted
+			updated.Revision = "2"
+			transient := makeTestDeployment()
+			recreated := *reinserted
+			recreated.Revision = "2"
+			changeList := &common.ChangeList{
+				Changes: []common.Change{
+					{
+						Operation: common.Insert,
+						Table:     CONFIG_METADATA_TABLE,
+						NewRow:    rowFromDeployment(inserted),
+					},
+					{
+						Operation: common.Insert,
+						Table:     CONFIG_METADATA_TABLE,
+						NewRow:    rowFromDeployment(transient),
+					},
+					{
+						Operation: common.Delete,
+						Table:     CONFIG_METADATA_TABLE,
+						OldRow:    rowFromDeployment(reinserted),
+					},
+					{
+						Operation: common.Update,
+						Table:     CONFIG_METADATA_TABLE,
+						NewRow:    rowFromDeployment(&updated),
+						OldRow:    rowFromDeployment(inserted),
+					},
+					{
+						Operation: common.Delete,
+						Table:     CONFIG_METADATA_TABLE,
+						OldRow:    rowFromDeployment(transient),
+					},
+					{
+						Operation: common.Insert,
+						Table:     CONFIG_METADATA_TABLE,
+						NewRow:    rowFromDeployment(&recreated),
+					},
+				},
+				LastSequence: "2.2.2",
+			}
+
+			<-apid.Events().Emit(APIGEE_SYNC_EVENT, changeList)
+			blobs := make([]string, 4)
+			for i := range blobs {
+				blobs[i] = <-dummyBundleMan.blobChan
+			}
+
+			Expect(blobs).Should(ConsistOf(updated.BlobID, updated.BlobResourceID, recreated.BlobID, recreated.BlobResourceID))
+			Expect(dummyDbMan.snapshot.getConfigurations("")).Should(Equal([]Configuration{recreated, updated}))
+			Expect(dummyDbMan.history).Should(HaveLen(2))
+			Expect(dummyDbMan.history[0].Configuration).Should(Equal(updated))
+			Expect(dummyDbMan.history[1].Configuration).Should(Equal(recreated))
+		})
 	})
 
 	Context("LSN", func() {
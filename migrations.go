@@ -0,0 +1,218 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package apiGatewayConfDeploy
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/apid/apid-core"
+)
+
+// schemaMigration brings the plugin-owned tables from version-1 to version.
+// Migrations are applied in order, each one in its own transaction together with the version it reaches.
+// Never edit a released migration, append a new one instead.
+type schemaMigration struct {
+	version     int
+	description string
+	migrate     func(tx apid.Tx) error
+}
+
+var schemaMigrations = []schemaMigration{
+	{1, "create blob and LSN tables", migrateCreateTables},
+	{2, "add blob metadata columns", migrateBlobMetadata},
+	{3, "create configuration history", migrateConfigHistory},
+	{4, "create configuration pins", migrateConfigPins},
+	{5, "add config index snapshot epoch", migrateSnapshotEpoch},
+	{6, "create configuration history start", migrateConfigHistoryStart},
+}
+
+// schemaVersion is the version of the plugin-owned tables this build knows about
+var schemaVersion = schemaMigrations[len(schemaMigrations)-1].version
+
+// ErrSchemaTooNew is returned when the database was migrated by a newer version of the plugin
+type ErrSchemaTooNew struct {
+	Version int
+	Known   int
+}
+
+func (e *ErrSchemaTooNew) Error() string {
+	return fmt.Sprintf("database schema version %d is newer than the latest known version %d", e.Version, e.Known)
+}
+
+// initTables creates or migrates the plugin-owned tables to schemaVersion
+func initTables(db apid.DB) error {
+	current, err := getSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current > schemaVersion {
+		return &ErrSchemaTooNew{Version: current, Known: schemaVersion}
+	}
+	for _, m := range schemaMigrations {
+		if m.version <= current {
+			continue
+		}
+		if err = applyMigration(db, m); err != nil {
+			return fmt.Errorf("schema migration %d (%s) failed: %v", m.version, m.description, err)
+		}
+		log.Debugf("applied schema migration %d: %s", m.version, m.description)
+	}
+	return nil
+}
+
+// getSchemaVersion returns the version recorded in the database, 0 if none was applied yet
+func getSchemaVersion(db apid.DB) (int, error) {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS APID_CONFIG_SCHEMA_VERSION (
+		version integer NOT NULL
+	);
+	`)
+	if err != nil {
+		return 0, err
+	}
+	var version sql.NullInt64
+	err = db.QueryRow("SELECT max(version) FROM APID_CONFIG_SCHEMA_VERSION;").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+func applyMigration(db apid.DB, m schemaMigration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err = m.migrate(tx); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM APID_CONFIG_SCHEMA_VERSION;"); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("INSERT INTO APID_CONFIG_SCHEMA_VERSION (version) VALUES (?);", m.version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateCreateTables creates the original tables.
+// They may already exist in databases created before versioning.
+func migrateCreateTables(tx apid.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE IF NOT EXISTS APID_BLOB_AVAILABLE (
+		id text primary key,
+   		local_fs_location text NOT NULL
+	);
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+	CREATE TABLE IF NOT EXISTS APID_BLOB_QUARANTINE (
+		id text primary key,
+		local_fs_location text,
+		reason text,
+		quarantined_at text
+	);
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+	CREATE TABLE IF NOT EXISTS APID_BLOB_FAILURE (
+		id text primary key,
+		reason text,
+		permanent integer,
+		attempts integer,
+		last_attempt_at text
+	);
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+	CREATE TABLE IF NOT EXISTS APID_BLOB_PENDING (
+		id text primary key,
+		priority integer
+	);
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+	CREATE TABLE IF NOT EXISTS APID_CONFIGURATION_LSN (
+		lsn text primary key
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// insert a row if APID_CONFIGURATION_LSN is empty
+	_, err = tx.Exec(`
+	INSERT INTO APID_CONFIGURATION_LSN (lsn)
+	SELECT '0.0.0'
+	WHERE NOT EXISTS (SELECT * FROM APID_CONFIGURATION_LSN)
+	`)
+	return err
+}
+
+// migrateBlobMetadata adds the metadata columns of APID_BLOB_AVAILABLE.
+// Databases created before versioning may already have some of them.
+func migrateBlobMetadata(tx apid.Tx) error {
+	return addMissingColumns(tx, "APID_BLOB_AVAILABLE", [][2]string{
+		{"size", "integer"},
+		{"content_type", "text"},
+		{"sha256", "text"},
+		{"downloaded_at", "text"},
+		{"source", "text"},
+		{"last_served_at", "text"},
+	})
+}
+
+// addMissingColumns adds the {name, type} columns the table doesn't have yet
+func addMissingColumns(tx apid.Tx, table string, columns [][2]string) error {
+	rows, err := tx.Query("PRAGMA table_info(" + table + ");")
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err = rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[strings.ToLower(name)] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, c := range columns {
+		if existing[c[0]] {
+			continue
+		}
+		if _, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + c[0] + " " + c[1] + ";"); err != nil {
+			return err
+		}
+		log.Debugf("added column %s to %s", c[0], table)
+	}
+	return nil
+}
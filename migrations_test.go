@@ -0,0 +1,108 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayConfDeploy
+
+import (
+	"errors"
+	"github.com/apid/apid-core"
+	"github.com/apid/apid-core/data"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"strconv"
+	"sync"
+)
+
+var _ = Describe("schema migrations", func() {
+	var testCount int
+	var testDbMan *dbManager
+	var oldMigrations []schemaMigration
+	var oldVersion int
+
+	var _ = BeforeEach(func() {
+		testCount += 1
+		testDbMan = &dbManager{
+			data:     services.Data(),
+			dbMux:    sync.RWMutex{},
+			lsnMutex: sync.RWMutex{},
+		}
+		testDbMan.setDbVersion("testMigrations" + strconv.Itoa(testCount))
+		oldMigrations = schemaMigrations
+		oldVersion = schemaVersion
+	})
+
+	var _ = AfterEach(func() {
+		schemaMigrations = oldMigrations
+		schemaVersion = oldVersion
+		data.Delete(data.VersionedDBID("common", "testMigrations"+strconv.Itoa(testCount)))
+	})
+
+	addMigration := func(m schemaMigration) {
+		schemaMigrations = append(append([]schemaMigration{}, oldMigrations...), m)
+		schemaVersion = m.version
+	}
+
+	It("should record the latest version, and be idempotent", func() {
+		Expect(testDbMan.initDb()).Should(Succeed())
+		version, err := getSchemaVersion(testDbMan.getDb())
+		Expect(err).Should(Succeed())
+		Expect(version).Should(Equal(schemaVersion))
+		Expect(testDbMan.initDb()).Should(Succeed())
+		version, err = getSchemaVersion(testDbMan.getDb())
+		Expect(err).Should(Succeed())
+		Expect(version).Should(Equal(schemaVersion))
+		Expect(pluginData.ExtraData["schemaVersion"]).Should(Equal(strconv.Itoa(schemaVersion)))
+	})
+
+	It("should only apply new migrations", func() {
+		Expect(testDbMan.initDb()).Should(Succeed())
+		applied := 0
+		addMigration(schemaMigration{oldVersion + 1, "add lsn column", func(tx apid.Tx) error {
+			applied++
+			return addMissingColumns(tx, "APID_CONFIGURATION_LSN", [][2]string{{"updated_at", "text"}})
+		}})
+		Expect(testDbMan.initDb()).Should(Succeed())
+		Expect(testDbMan.initDb()).Should(Succeed())
+		Expect(applied).Should(Equal(1))
+		version, err := getSchemaVersion(testDbMan.getDb())
+		Expect(err).Should(Succeed())
+		Expect(version).Should(Equal(oldVersion + 1))
+		_, err = testDbMan.getDb().Exec("UPDATE APID_CONFIGURATION_LSN SET updated_at = 'now';")
+		Expect(err).Should(Succeed())
+	})
+
+	It("should roll back failed migrations", func() {
+		Expect(testDbMan.initDb()).Should(Succeed())
+		addMigration(schemaMigration{oldVersion + 1, "broken", func(tx apid.Tx) error {
+			if _, err := tx.Exec("CREATE TABLE APID_MIGRATION_TEST (id text);"); err != nil {
+				return err
+			}
+			return errors.New("broken migration")
+		}})
+		Expect(testDbMan.initDb()).ShouldNot(Succeed())
+		version, err := getSchemaVersion(testDbMan.getDb())
+		Expect(err).Should(Succeed())
+		Expect(version).Should(Equal(oldVersion))
+		_, err = testDbMan.getDb().Exec("SELECT * FROM APID_MIGRATION_TEST;")
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("should refuse a schema newer than known", func() {
+		Expect(testDbMan.initDb()).Should(Succeed())
+		_, err := testDbMan.getDb().Exec("UPDATE APID_CONFIG_SCHEMA_VERSION SET version = ?;", schemaVersion+1)
+		Expect(err).Should(Succeed())
+		err = testDbMan.initDb()
+		Expect(err).Should(Equal(&ErrSchemaTooNew{Version: schemaVersion + 1, Known: schemaVersion}))
+	})
+})
@@ -0,0 +1,210 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package apiGatewayConfDeploy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mirrorPolicyFailover = "failover"
+	mirrorPolicyLatency  = "latency"
+
+	// a failed mirror is tried after the healthy ones until this long after its last failure
+	mirrorRecheckInterval = 30 * time.Second
+	// weight of the last request in the average latency of a mirror
+	mirrorLatencyWeight = 0.3
+)
+
+// mirrorSet is the list of blob servers, tried in turn until one of them answers.
+// With the failover policy mirrors are tried in the configured order,
+// with the latency policy they are picked at random, weighted by the inverse of their average latency.
+// In both cases mirrors that failed recently are tried last.
+type mirrorSet struct {
+	mu      sync.Mutex
+	policy  string
+	mirrors []*blobMirror
+}
+
+type blobMirror struct {
+	url         string
+	failures    int
+	lastFailure time.Time
+	latency     time.Duration
+	requests    int64
+}
+
+type mirrorStatus struct {
+	Url                 string `json:"url"`
+	Healthy             bool   `json:"healthy"`
+	ConsecutiveFailures int    `json:"consecutiveFailures"`
+	LatencyMs           int64  `json:"latencyMs"`
+	Requests            int64  `json:"requests"`
+}
+
+func newMirrorSet(urls []string, policy string) *mirrorSet {
+	m := &mirrorSet{
+		policy: policy,
+	}
+	for _, u := range urls {
+		m.mirrors = append(m.mirrors, &blobMirror{url: u})
+	}
+	return m
+}
+
+// parseMirrors parses a list of blob server base URLs separated by commas
+func parseMirrors(s string) ([]string, error) {
+	var urls []string
+	for _, u := range strings.Split(s, ",") {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return nil, fmt.Errorf("invalid blob server url %q: %v", u, err)
+		}
+		if parsed.Scheme == "" || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid blob server url %q: must be absolute", u)
+		}
+		urls = append(urls, u)
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no blob server url")
+	}
+	return urls, nil
+}
+
+// must be called with mu held
+func (b *blobMirror) healthyLocked(now time.Time) bool {
+	return b.failures == 0 || now.Sub(b.lastFailure) >= mirrorRecheckInterval
+}
+
+// order returns the mirrors in the order they should be tried
+func (m *mirrorSet) order() []*blobMirror {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	var healthy, failed []*blobMirror
+	for _, b := range m.mirrors {
+		if b.healthyLocked(now) {
+			healthy = append(healthy, b)
+		} else {
+			failed = append(failed, b)
+		}
+	}
+	if m.policy == mirrorPolicyLatency {
+		healthy = weightedShuffle(healthy)
+	}
+	// the mirror which failed first is more likely to be back
+	sort.SliceStable(failed, func(i, j int) bool {
+		return failed[i].lastFailure.Before(failed[j].lastFailure)
+	})
+	return append(healthy, failed...)
+}
+
+// weightedShuffle orders the mirrors at random, faster mirrors first more often.
+// Mirrors without latency yet come first, so that they get measured.
+// must be called with mu held
+func weightedShuffle(mirrors []*blobMirror) []*blobMirror {
+	var ordered, measured []*blobMirror
+	for _, b := range mirrors {
+		if b.latency == 0 {
+			ordered = append(ordered, b)
+		} else {
+			measured = append(measured, b)
+		}
+	}
+	for len(measured) > 0 {
+		var total float64
+		for _, b := range measured {
+			total += 1 / b.latency.Seconds()
+		}
+		pick := randFloat64() * total
+		i := 0
+		for ; i < len(measured)-1; i++ {
+			pick -= 1 / measured[i].latency.Seconds()
+			if pick < 0 {
+				break
+			}
+		}
+		ordered = append(ordered, measured[i])
+		measured = append(measured[:i], measured[i+1:]...)
+	}
+	return ordered
+}
+
+// record updates the health and latency of the mirror after a request.
+// Only failures meaning the blob server is unavailable count against the mirror.
+func (m *mirrorSet) record(b *blobMirror, latency time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b.requests++
+	if isBlobServerFailure(err) {
+		b.failures++
+		b.lastFailure = time.Now()
+		return
+	}
+	b.failures = 0
+	if b.latency == 0 {
+		b.latency = latency
+	} else {
+		b.latency = time.Duration(mirrorLatencyWeight*float64(latency) + (1-mirrorLatencyWeight)*float64(b.latency))
+	}
+}
+
+// getSignedURL asks the mirrors in turn for the signed URL of the blob,
+// moving to the next mirror only if the current one is unavailable.
+// source is the url of the mirror that answered last.
+func (m *mirrorSet) getSignedURL(ctx context.Context, client *http.Client, blobId string) (signedUrl string, signature string, source string, err error) {
+	for _, b := range m.order() {
+		start := time.Now()
+		source = b.url
+		signedUrl, signature, err = getSignedURL(ctx, client, b.url, blobId)
+		if ctx.Err() != nil {
+			// cancelled, not the mirror's fault
+			return
+		}
+		m.record(b, time.Since(start), err)
+		if err == nil || !isBlobServerFailure(err) {
+			return
+		}
+		log.Warnf("blob server %s unavailable for blobId=%s, trying next mirror: %v", b.url, blobId, err)
+	}
+	return
+}
+
+func (m *mirrorSet) status() []mirrorStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	status := make([]mirrorStatus, 0, len(m.mirrors))
+	for _, b := range m.mirrors {
+		status = append(status, mirrorStatus{
+			Url:                 b.url,
+			Healthy:             b.healthyLocked(now),
+			ConsecutiveFailures: b.failures,
+			LatencyMs:           int64(b.latency / time.Millisecond),
+			Requests:            b.requests,
+		})
+	}
+	return status
+}
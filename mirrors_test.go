@@ -0,0 +1,142 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayConfDeploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/apid/apid-core/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+)
+
+var _ = Describe("blob server mirrors", func() {
+	var servers []*httptest.Server
+	var statuses []*int32
+	var hits []*int32
+
+	startMirror := func() string {
+		status := new(int32)
+		hit := new(int32)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(hit, 1)
+			if s := atomic.LoadInt32(status); s != 0 {
+				w.WriteHeader(int(s))
+				return
+			}
+			json.NewEncoder(w).Encode(blobServerResponse{
+				SignedUrl: "http://" + r.Host + "/signed" + r.URL.Path,
+			})
+		}))
+		servers = append(servers, server)
+		statuses = append(statuses, status)
+		hits = append(hits, hit)
+		return server.URL
+	}
+
+	var _ = BeforeEach(func() {
+		servers = nil
+		statuses = nil
+		hits = nil
+	})
+
+	var _ = AfterEach(func() {
+		for _, s := range servers {
+			s.Close()
+		}
+	})
+
+	It("should fail over to the next mirror", func() {
+		m := newMirrorSet([]string{startMirror(), startMirror()}, mirrorPolicyFailover)
+		atomic.StoreInt32(statuses[0], http.StatusServiceUnavailable)
+		id := util.GenerateUUID()
+		signedUrl, _, source, err := m.getSignedURL(context.Background(), http.DefaultClient, id)
+		Expect(err).Should(Succeed())
+		Expect(signedUrl).Should(Equal(servers[1].URL + "/signed/blobs/" + id))
+		Expect(source).Should(Equal(servers[1].URL))
+
+		// the failed mirror is tried last until it's rechecked
+		order := m.order()
+		Expect(order[0].url).Should(Equal(servers[1].URL))
+		Expect(order[1].url).Should(Equal(servers[0].URL))
+		status := m.status()
+		Expect(status[0].Healthy).Should(BeFalse())
+		Expect(status[0].ConsecutiveFailures).Should(Equal(1))
+		Expect(status[1].Healthy).Should(BeTrue())
+
+		m.mirrors[0].lastFailure = time.Now().Add(-mirrorRecheckInterval)
+		Expect(m.order()[0].url).Should(Equal(servers[0].URL))
+	})
+
+	It("should not fail over if the blob doesn't exist", func() {
+		m := newMirrorSet([]string{startMirror(), startMirror()}, mirrorPolicyFailover)
+		atomic.StoreInt32(statuses[0], http.StatusNotFound)
+		_, _, _, err := m.getSignedURL(context.Background(), http.DefaultClient, util.GenerateUUID())
+		Expect(err).ShouldNot(Succeed())
+		Expect(isRetryable(err)).Should(BeFalse())
+		Expect(atomic.LoadInt32(hits[1])).Should(BeZero())
+		Expect(m.status()[0].Healthy).Should(BeTrue())
+	})
+
+	It("should return the last error if all mirrors fail", func() {
+		m := newMirrorSet([]string{startMirror(), startMirror()}, mirrorPolicyFailover)
+		atomic.StoreInt32(statuses[0], http.StatusServiceUnavailable)
+		atomic.StoreInt32(statuses[1], http.StatusBadGateway)
+		_, _, _, err := m.getSignedURL(context.Background(), http.DefaultClient, util.GenerateUUID())
+		Expect(err).ShouldNot(Succeed())
+		Expect(err.(*downloadError).statusCode).Should(Equal(http.StatusBadGateway))
+		Expect(isBlobServerFailure(err)).Should(BeTrue())
+	})
+
+	It("should prefer faster mirrors with the latency policy", func() {
+		m := newMirrorSet([]string{"http://fast", "http://slow", "http://new"}, mirrorPolicyLatency)
+		m.record(m.mirrors[0], 10*time.Millisecond, nil)
+		m.record(m.mirrors[1], 990*time.Millisecond, nil)
+		first := map[string]int{}
+		for i := 0; i < 1000; i++ {
+			order := m.order()
+			Expect(order).Should(HaveLen(3))
+			// unmeasured mirrors are tried first
+			Expect(order[0].url).Should(Equal("http://new"))
+			first[order[1].url]++
+		}
+		Expect(first["http://fast"]).Should(BeNumerically(">", 900))
+		Expect(first["http://slow"]).Should(BeNumerically(">", 0))
+	})
+
+	It("should average the latency", func() {
+		m := newMirrorSet([]string{"http://mirror"}, mirrorPolicyLatency)
+		m.record(m.mirrors[0], 100*time.Millisecond, nil)
+		m.record(m.mirrors[0], 200*time.Millisecond, nil)
+		Expect(m.status()[0].LatencyMs).Should(Equal(int64(130)))
+		m.record(m.mirrors[0], time.Second, fmt.Errorf("unknown"))
+		Expect(m.status()[0].Requests).Should(Equal(int64(3)))
+	})
+
+	It("should parse the list of mirrors", func() {
+		urls, err := parseMirrors("http://primary:9000, https://secondary/base,")
+		Expect(err).Should(Succeed())
+		Expect(urls).Should(Equal([]string{"http://primary:9000", "https://secondary/base"}))
+		_, err = parseMirrors("")
+		Expect(err).ShouldNot(Succeed())
+		_, err = parseMirrors("primary")
+		Expect(err).ShouldNot(Succeed())
+	})
+})
@@ -2,7 +2,10 @@ package apiGatewayConfDeploy
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"database/sql"
 	"encoding/json"
+	"fmt"
 	"github.com/gorilla/mux"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -10,20 +13,37 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type dummyDbManager struct {
-	unreadyBlobIds   []string
-	readyDeployments []Configuration
-	localFSLocation  string
-	fileResponse     chan string
-	version          string
-	configurations   map[string]*Configuration
-	lsn              string
-	dbLSN            string
-	err              error
+	unreadyBlobIds     []string
+	readyDeployments   []Configuration
+	localFSLocation    string
+	fileResponse       chan string
+	quarantineResponse chan string
+	failureResponse    chan bool
+	blobReferenced     bool
+	pendingDownloads   map[string]int
+	pendingMux         sync.Mutex
+	blobMeta           *blobMetadata
+	servedBlobs        chan string
+	history            []configRevision
+	asOf               string
+	pins               []configPin
+	unreferencedBlobs  map[string]string
+	retainedBlobs      map[string]bool
+	purgedBlobs        chan string
+	prunedBefore       time.Time
+	snapshot           *configSnapshot
+	version            string
+	configurations     map[string]*Configuration
+	lsn                string
+	epoch              int64
+	dbLSN              string
+	err                error
 }
 
 func (d *dummyDbManager) setDbVersion(version string) {
@@ -31,6 +51,10 @@ func (d *dummyDbManager) setDbVersion(version string) {
 }
 
 func (d *dummyDbManager) initDb() error {
+	// a snapshot received at runtime starts a new epoch
+	if d.lsn != "" {
+		d.epoch++
+	}
 	return nil
 }
 
@@ -45,7 +69,8 @@ func (d *dummyDbManager) getAllConfigurations(typeFilter string) ([]Configuratio
 	return []Configuration{*(d.configurations[typeFilter])}, nil
 }
 
-func (d *dummyDbManager) updateLocalFsLocation(blobId, localFsLocation string) error {
+func (d *dummyDbManager) updateLocalFsLocation(blobId, localFsLocation string, meta *blobMetadata) error {
+	d.blobMeta = meta
 	file, err := os.Open(localFsLocation)
 	if err != nil {
 		return err
@@ -62,17 +87,165 @@ func (d *dummyDbManager) updateLocalFsLocation(blobId, localFsLocation string) e
 	return nil
 }
 
-func (d *dummyDbManager) getLocalFSLocation(string) (string, error) {
+func (d *dummyDbManager) quarantineBlob(blobId, localFsLocation, reason string) error {
+	if d.quarantineResponse != nil {
+		go func() {
+			d.quarantineResponse <- blobId
+		}()
+	}
+	return nil
+}
+
+func (d *dummyDbManager) updateBlobFailure(blobId, reason string, permanent bool) error {
+	if d.failureResponse != nil {
+		go func() {
+			d.failureResponse <- permanent
+		}()
+	}
+	return nil
+}
+
+func (d *dummyDbManager) getLocalFSLocation(blobId string) (string, error) {
+	for _, id := range d.unreadyBlobIds {
+		if id == blobId {
+			return "", sql.ErrNoRows
+		}
+	}
 	return d.localFSLocation, d.err
 }
 
+func (d *dummyDbManager) getBlobMetadata(blobId string) (*blobMetadata, error) {
+	location, err := d.getLocalFSLocation(blobId)
+	if err != nil {
+		return nil, err
+	}
+	meta := &blobMetadata{}
+	if d.blobMeta != nil {
+		*meta = *d.blobMeta
+	}
+	meta.LocalFsLocation = location
+	return meta, nil
+}
+
+func (d *dummyDbManager) updateBlobServed(blobId string, servedAt time.Time) error {
+	if d.servedBlobs != nil {
+		go func() {
+			d.servedBlobs <- blobId
+		}()
+	}
+	return nil
+}
+
+func (d *dummyDbManager) isBlobReferenced(blobId string) (bool, error) {
+	return d.blobReferenced, nil
+}
+
+func (d *dummyDbManager) savePendingDownloads(priorities map[string]int) error {
+	d.pendingMux.Lock()
+	defer d.pendingMux.Unlock()
+	d.pendingDownloads = priorities
+	return nil
+}
+
+func (d *dummyDbManager) takePendingDownloads() (map[string]int, error) {
+	d.pendingMux.Lock()
+	defer d.pendingMux.Unlock()
+	pending := d.pendingDownloads
+	d.pendingDownloads = nil
+	return pending, nil
+}
+
 func (d *dummyDbManager) getConfigById(id string) (*Configuration, error) {
 	return d.configurations[id], d.err
 }
+
+func (d *dummyDbManager) recordConfigRevisions(lsn string, at time.Time, current, replaced, deleted []*Configuration) error {
+	for _, c := range current {
+		d.history = append(d.history, configRevision{Configuration: *c, Lsn: lsn, SeenAt: at})
+	}
+	return nil
+}
+
+func (d *dummyDbManager) getConfigHistory(configId string) ([]configRevision, error) {
+	var revisions []configRevision
+	for i := len(d.history) - 1; i >= 0; i-- {
+		if d.history[i].ID == configId {
+			revisions = append(revisions, d.history[i])
+		}
+	}
+	return revisions, d.err
+}
+
+func (d *dummyDbManager) getConfigurationsAsOf(asOf string, typeFilter string) ([]Configuration, error) {
+	d.asOf = asOf
+	return d.readyDeployments, d.err
+}
+
+func (d *dummyDbManager) pinConfiguration(pin *configPin) error {
+	d.unpinConfiguration(pin.ID)
+	d.pins = append(d.pins, *pin)
+	return nil
+}
+
+func (d *dummyDbManager) unpinConfiguration(configId string) (*configPin, error) {
+	for i := range d.pins {
+		if d.pins[i].ID == configId {
+			pin := d.pins[i]
+			d.pins = append(d.pins[:i], d.pins[i+1:]...)
+			return &pin, nil
+		}
+	}
+	return nil, nil
+}
+
+func (d *dummyDbManager) getConfigPins() ([]configPin, error) {
+	return append([]configPin{}, d.pins...), nil
+}
+
+func (d *dummyDbManager) getConfigSnapshot() *configSnapshot {
+	return d.snapshot
+}
+
+func (d *dummyDbManager) applyConfigChanges(lsn string, current, deleted []*Configuration) {
+	if d.snapshot == nil {
+		d.snapshot = newConfigSnapshot(InitLSN, nil)
+	}
+	d.snapshot = d.snapshot.withChanges(lsn, current, deleted)
+}
+
+func (d *dummyDbManager) getUnreferencedBlobs() (map[string]string, error) {
+	return d.unreferencedBlobs, nil
+}
+
+func (d *dummyDbManager) getRetainedBlobs(retainByType map[string]int, retain int) (map[string]bool, error) {
+	return d.retainedBlobs, nil
+}
+
+func (d *dummyDbManager) pruneConfigHistory(before time.Time, retainByType map[string]int, retain int) (int, error) {
+	d.prunedBefore = before
+	return 0, nil
+}
+
+func (d *dummyDbManager) deleteBlobAvailability(blobId string) error {
+	if d.purgedBlobs != nil {
+		d.purgedBlobs <- blobId
+	}
+	return nil
+}
+
 func (d *dummyDbManager) getLSN() string {
 	return d.lsn
 }
 
+func (d *dummyDbManager) getEpoch() int64 {
+	return d.epoch
+}
+
+func (d *dummyDbManager) startSnapshotEpoch() error {
+	d.epoch++
+	return nil
+}
+
 func (d *dummyDbManager) updateLSN(LSN string) error {
 	d.lsn = LSN
 	d.dbLSN = LSN
@@ -100,14 +273,18 @@ func (a *dummyApiManager) notifyNewChange() {
 }
 
 type dummyBundleManager struct {
-	blobChan chan string
+	blobChan  chan string
+	progress  *downloadProgress
+	breaker   breakerStatus
+	bandwidth *bandwidthLimiter
+	pool      workerPoolStatus
 }
 
 func (bm *dummyBundleManager) initializeBundleDownloading() {
 
 }
 
-func (bm *dummyBundleManager) downloadBlobsWithCallback(blobs []string, callback func()) {
+func (bm *dummyBundleManager) downloadBlobsWithCallback(blobs []string, priorities map[string]int, callback func()) {
 	go func() {
 		for _, id := range blobs {
 			bm.blobChan <- id
@@ -116,17 +293,63 @@ func (bm *dummyBundleManager) downloadBlobsWithCallback(blobs []string, callback
 	go callback()
 }
 
-func (bm *dummyBundleManager) makeDownloadRequest(blobId string, bunchRequest *BunchDownloadRequest) *DownloadRequest {
+func (bm *dummyBundleManager) makeDownloadRequest(blobId string, priority int, bunchRequest *BunchDownloadRequest) *DownloadRequest {
 	return &DownloadRequest{
 		blobId:       blobId,
 		bunchRequest: bunchRequest,
+		priority:     priority,
+	}
+}
+
+func (bm *dummyBundleManager) prioritizeBlob(blobId string) bool {
+	return false
+}
+
+func (bm *dummyBundleManager) fetchBlob(blobId string) *downloadProgress {
+	return bm.progress
+}
+
+func (bm *dummyBundleManager) getProgress() []blobProgress {
+	if bm.progress == nil {
+		return []blobProgress{}
 	}
+	return []blobProgress{bm.progress.snapshot()}
 }
 
 func (bm *dummyBundleManager) deleteBlobs(blobIds []string) {
 
 }
 
+func (bm *dummyBundleManager) purgePartialBlobs() {
+
+}
+
+func (bm *dummyBundleManager) getBandwidthLimits() bandwidthLimits {
+	return bm.bandwidth.getLimits()
+}
+
+func (bm *dummyBundleManager) setBandwidthLimits(limits bandwidthLimits) error {
+	return bm.bandwidth.setLimits(limits)
+}
+
+func (bm *dummyBundleManager) getWorkerPool() workerPoolStatus {
+	return bm.pool
+}
+
+func (bm *dummyBundleManager) setWorkerPool(s workerPoolStatus) error {
+	if s.Min < 1 || s.Max < s.Min {
+		return fmt.Errorf("invalid worker pool bounds min=%d max=%d", s.Min, s.Max)
+	}
+	bm.pool = s
+	return nil
+}
+
+func (bm *dummyBundleManager) status() *downloadStatus {
+	return &downloadStatus{
+		BlobServer: bm.breaker,
+	}
+}
+
 func (bm *dummyBundleManager) Close() {
 
 }
@@ -137,6 +360,8 @@ type dummyBlobServer struct {
 	signedTimeout  *int32
 	blobTimeout    *int32
 	resetTimeout   bool
+	signKey        *ecdsa.PrivateKey
+	signedStatus   *int32
 }
 
 func (b *dummyBlobServer) start() {
@@ -153,6 +378,11 @@ func (b *dummyBlobServer) returnSigned(w http.ResponseWriter, r *http.Request) {
 		}
 		time.Sleep(time.Second)
 	}
+	if status := atomic.LoadInt32(b.signedStatus); status != 0 {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(int(status))
+		return
+	}
 	vars := mux.Vars(r)
 	blobId := vars["blobId"]
 
@@ -166,6 +396,9 @@ func (b *dummyBlobServer) returnSigned(w http.ResponseWriter, r *http.Request) {
 		SignedUrl:                uriString,
 		SignedUrlExpiryTimestamp: time.Now().Add(3 * time.Hour).Format(time.RFC3339),
 	}
+	if b.signKey != nil {
+		res.Signature = signTestBlob(b.signKey, []byte(blobId))
+	}
 
 	resBytes, err := json.Marshal(res)
 	Expect(err).Should(Succeed())
@@ -0,0 +1,321 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package apiGatewayConfDeploy
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	partialDir          = "partial"
+	partialValidatorExt = ".validator"
+)
+
+// blob ids being written to their partial file, so that concurrent downloads of the same blob don't clobber each other
+var partialLocks = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+// partialBlob is the local file a blob is downloaded to.
+// If resumable, the file is kept across failed attempts together with the validator (ETag or Last-Modified)
+// of the response it came from, and the next attempt continues from its current size with a Range request.
+type partialBlob struct {
+	blobId      string
+	fileName    string
+	file        *os.File
+	offset      int64
+	expected    int64
+	validator   string
+	contentType string
+	resumable   bool
+	completed   bool
+}
+
+func getPartialFilePath(blobId string) string {
+	return path.Join(bundlePath, partialDir, base64.URLEncoding.EncodeToString([]byte(blobId)))
+}
+
+func openPartialBlob(blobId string) (*partialBlob, error) {
+	p := &partialBlob{
+		blobId: blobId,
+	}
+
+	partialLocks.Lock()
+	if !partialLocks.m[blobId] {
+		partialLocks.m[blobId] = true
+		p.resumable = true
+	}
+	partialLocks.Unlock()
+
+	// another download of the same blob is in progress, fall back to a private temp file
+	if !p.resumable {
+		f, err := ioutil.TempFile(bundlePath, "blob")
+		if err != nil {
+			return nil, err
+		}
+		trackTempFile(f.Name())
+		p.file = f
+		p.fileName = f.Name()
+		return p, nil
+	}
+
+	if err := os.MkdirAll(path.Join(bundlePath, partialDir), 0700); err != nil {
+		p.unlock()
+		return nil, err
+	}
+	p.fileName = getPartialFilePath(blobId)
+	f, err := os.OpenFile(p.fileName, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		p.unlock()
+		return nil, err
+	}
+	p.file = f
+
+	if b, err := ioutil.ReadFile(p.fileName + partialValidatorExt); err == nil {
+		p.validator = string(b)
+	}
+	// a partial file without validator can't be checked against the remote object
+	if p.validator != "" {
+		if fi, err := f.Stat(); err == nil {
+			p.offset = fi.Size()
+		}
+	}
+	return p, nil
+}
+
+// request starts the transfer of the remaining bytes from uri, and positions the file accordingly
+func (p *partialBlob) request(ctx context.Context, client *http.Client, uri string) (io.ReadCloser, error) {
+	if p.offset > 0 {
+		header := http.Header{}
+		header.Set("Range", fmt.Sprintf("bytes=%d-", p.offset))
+		header.Set("If-Range", p.validator)
+		res, err := doRequestWithAuth(ctx, client, uri, header)
+		if err != nil {
+			return nil, err
+		}
+		switch res.StatusCode {
+		case http.StatusPartialContent:
+			if start, total := parseContentRange(res.Header.Get("Content-Range")); start == p.offset {
+				if _, err = p.file.Seek(p.offset, io.SeekStart); err != nil {
+					res.Body.Close()
+					return nil, err
+				}
+				p.expected = total
+				p.contentType = res.Header.Get("Content-Type")
+				log.Debugf("resuming download of blobId=%s at %d bytes", p.blobId, p.offset)
+				return res.Body, nil
+			}
+			res.Body.Close()
+		case http.StatusOK:
+			// ranges not supported, or the object changed
+			log.Debugf("unable to resume download of blobId=%s, restarting", p.blobId)
+			if err = p.restart(res); err != nil {
+				res.Body.Close()
+				return nil, err
+			}
+			return res.Body, nil
+		default:
+			res.Body.Close()
+			if res.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+				return nil, statusError(uri, res)
+			}
+		}
+	}
+
+	res, err := doRequestWithAuth(ctx, client, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, statusError(uri, res)
+	}
+	if err = p.restart(res); err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// restart truncates the file, and remembers the size and validator of the new response
+func (p *partialBlob) restart(res *http.Response) error {
+	p.offset = 0
+	p.expected = res.ContentLength
+	p.contentType = res.Header.Get("Content-Type")
+	if err := p.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := p.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if !p.resumable {
+		return nil
+	}
+	p.validator = res.Header.Get("ETag")
+	if p.validator == "" {
+		p.validator = res.Header.Get("Last-Modified")
+	}
+	if p.validator == "" {
+		os.Remove(p.fileName + partialValidatorExt)
+		return nil
+	}
+	return ioutil.WriteFile(p.fileName+partialValidatorExt, []byte(p.validator), 0600)
+}
+
+// complete moves the fully downloaded blob to a new file in bundlePath, and returns its name
+func (p *partialBlob) complete() (string, error) {
+	p.completed = true
+	if err := p.file.Close(); err != nil {
+		return "", err
+	}
+	if !p.resumable {
+		return p.fileName, nil
+	}
+	f, err := ioutil.TempFile(bundlePath, "blob")
+	if err != nil {
+		return "", err
+	}
+	trackTempFile(f.Name())
+	f.Close()
+	if err = os.Rename(p.fileName, f.Name()); err != nil {
+		os.Remove(f.Name())
+		untrackTempFile(f.Name())
+		return "", err
+	}
+	os.Remove(p.fileName + partialValidatorExt)
+	return f.Name(), nil
+}
+
+// Close releases the partial file. Unfinished private temp files are removed, resumable ones are kept.
+func (p *partialBlob) Close() {
+	if !p.completed {
+		p.file.Close()
+		if !p.resumable {
+			safeDelete(p.fileName)
+			untrackTempFile(p.fileName)
+		}
+	}
+	if p.resumable {
+		p.unlock()
+	}
+}
+
+func (p *partialBlob) unlock() {
+	partialLocks.Lock()
+	delete(partialLocks.m, p.blobId)
+	partialLocks.Unlock()
+}
+
+// removePartialBlob removes the partial file of a blob that won't be downloaded anymore,
+// unless a download of the blob is writing to it.
+func removePartialBlob(blobId string) {
+	partialLocks.Lock()
+	defer partialLocks.Unlock()
+	if partialLocks.m[blobId] {
+		return
+	}
+	fileName := getPartialFilePath(blobId)
+	safeDelete(fileName)
+	safeDelete(fileName + partialValidatorExt)
+}
+
+// purgePartialBlobs removes the partial files of blobs that neither a configuration nor a pin references anymore,
+// e.g. left by downloads that failed for good, or by a previous run
+func (bm *bundleManager) purgePartialBlobs() {
+	files, err := ioutil.ReadDir(path.Join(bundlePath, partialDir))
+	if err != nil {
+		return
+	}
+	blobIds := make(map[string]bool)
+	for _, f := range files {
+		b, err := base64.URLEncoding.DecodeString(strings.TrimSuffix(f.Name(), partialValidatorExt))
+		if err != nil {
+			continue
+		}
+		blobIds[string(b)] = true
+	}
+	removed := 0
+	for blobId := range blobIds {
+		if referenced, err := bm.dbMan.isBlobReferenced(blobId); err != nil || referenced {
+			continue
+		}
+		removePartialBlob(blobId)
+		removed++
+	}
+	if removed > 0 {
+		log.Debugf("removed the partial files of %d unreferenced blobs", removed)
+	}
+}
+
+// tempFiles are the private files of downloads in progress, until they're committed or removed.
+// The ones left when the workers are stopped are removed on shutdown.
+var tempFiles = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+func trackTempFile(name string) {
+	tempFiles.Lock()
+	defer tempFiles.Unlock()
+	tempFiles.m[name] = true
+}
+
+func untrackTempFile(name string) {
+	if name == "" {
+		return
+	}
+	tempFiles.Lock()
+	defer tempFiles.Unlock()
+	delete(tempFiles.m, name)
+}
+
+// removeTempFiles removes the tracked temp files, and returns how many there were
+func removeTempFiles() int {
+	tempFiles.Lock()
+	defer tempFiles.Unlock()
+	n := len(tempFiles.m)
+	for name := range tempFiles.m {
+		safeDelete(name)
+		delete(tempFiles.m, name)
+	}
+	return n
+}
+
+// parseContentRange parses the first byte position and the complete length of a "bytes start-end/size" header.
+// start is -1 if invalid, size is -1 if unknown.
+func parseContentRange(contentRange string) (start int64, size int64) {
+	var end int64
+	var sizeStr string
+	if !strings.HasPrefix(contentRange, "bytes ") {
+		return -1, -1
+	}
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%s", &start, &end, &sizeStr); err != nil {
+		return -1, -1
+	}
+	if size, err := strconv.ParseInt(sizeStr, 10, 64); err == nil {
+		return start, size
+	}
+	return start, -1
+}
@@ -0,0 +1,143 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayConfDeploy
+
+import (
+	"bytes"
+	"context"
+	"github.com/apid/apid-core/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+)
+
+var _ = Describe("partial", func() {
+	var content []byte
+	var etag string
+	var supportRange bool
+	var rangeRequested string
+	var server *httptest.Server
+
+	var _ = BeforeEach(func() {
+		content = []byte(strings.Repeat(util.GenerateUUID(), 100))
+		etag = `"` + util.GenerateUUID() + `"`
+		supportRange = true
+		rangeRequested = ""
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rangeRequested = r.Header.Get("Range")
+			if !supportRange {
+				w.Write(content)
+				return
+			}
+			w.Header().Set("ETag", etag)
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		}))
+	})
+
+	var _ = AfterEach(func() {
+		server.Close()
+	})
+
+	// simulate an interrupted download
+	writePartial := func(id string, n int, validator string) {
+		p, err := openPartialBlob(id)
+		Expect(err).Should(Succeed())
+		Expect(p.resumable).Should(BeTrue())
+		_, err = p.file.Write(content[:n])
+		Expect(err).Should(Succeed())
+		Expect(ioutil.WriteFile(p.fileName+partialValidatorExt, []byte(validator), 0600)).Should(Succeed())
+		p.Close()
+	}
+
+	download := func(id string) []byte {
+		p, err := openPartialBlob(id)
+		Expect(err).Should(Succeed())
+		defer p.Close()
+		body, err := p.request(context.Background(), http.DefaultClient, server.URL)
+		Expect(err).Should(Succeed())
+		defer body.Close()
+		_, err = io.Copy(p.file, body)
+		Expect(err).Should(Succeed())
+		file, err := p.complete()
+		Expect(err).Should(Succeed())
+		defer os.Remove(file)
+		b, err := ioutil.ReadFile(file)
+		Expect(err).Should(Succeed())
+		return b
+	}
+
+	It("should download a blob from the start", func() {
+		id := util.GenerateUUID()
+		Expect(download(id)).Should(Equal(content))
+		Expect(rangeRequested).Should(BeEmpty())
+		_, err := os.Stat(getPartialFilePath(id))
+		Expect(os.IsNotExist(err)).Should(BeTrue())
+	})
+
+	It("should resume a partial download with a range request", func() {
+		id := util.GenerateUUID()
+		writePartial(id, 100, etag)
+		Expect(download(id)).Should(Equal(content))
+		Expect(rangeRequested).Should(Equal("bytes=100-"))
+	})
+
+	It("should restart the download if the object changed", func() {
+		id := util.GenerateUUID()
+		writePartial(id, 100, `"outdated"`)
+		Expect(download(id)).Should(Equal(content))
+		Expect(rangeRequested).Should(Equal("bytes=100-"))
+	})
+
+	It("should restart the download if ranges are not supported", func() {
+		id := util.GenerateUUID()
+		writePartial(id, 100, etag)
+		supportRange = false
+		Expect(download(id)).Should(Equal(content))
+	})
+
+	It("should not share the partial file between concurrent downloads", func() {
+		id := util.GenerateUUID()
+		p1, err := openPartialBlob(id)
+		Expect(err).Should(Succeed())
+		p2, err := openPartialBlob(id)
+		Expect(err).Should(Succeed())
+		Expect(p1.resumable).Should(BeTrue())
+		Expect(p2.resumable).Should(BeFalse())
+		Expect(p2.fileName).ShouldNot(Equal(p1.fileName))
+		p2.Close()
+		_, err = os.Stat(p2.fileName)
+		Expect(os.IsNotExist(err)).Should(BeTrue())
+		p1.Close()
+	})
+
+	It("should parse Content-Range", func() {
+		start, size := parseContentRange("bytes 100-199/200")
+		Expect(start).Should(Equal(int64(100)))
+		Expect(size).Should(Equal(int64(200)))
+		start, size = parseContentRange("bytes 100-199/*")
+		Expect(start).Should(Equal(int64(100)))
+		Expect(size).Should(Equal(int64(-1)))
+		start, _ = parseContentRange("")
+		Expect(start).Should(Equal(int64(-1)))
+		start, _ = parseContentRange("items 1-2/3")
+		Expect(start).Should(Equal(int64(-1)))
+	})
+})
@@ -0,0 +1,156 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package apiGatewayConfDeploy
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/apid/apid-core"
+)
+
+// configPin overrides the current revision of a configuration with a previously seen one
+type configPin struct {
+	// the pinned revision
+	Configuration
+	// config index the pinned revision became current at
+	Lsn      string
+	PinnedAt time.Time
+}
+
+func migrateConfigPins(tx apid.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE IF NOT EXISTS APID_CONFIGURATION_PIN (
+		id text primary key,
+		organization_id text,
+		environment_id text,
+		bean_blob_id text,
+		resource_blob_id text,
+		type text,
+		name text,
+		revision text,
+		path text,
+		created_at text,
+		created_by text,
+		updated_at text,
+		updated_by text,
+		lsn text,
+		pinned_at text
+	);
+	`)
+	return err
+}
+
+// pinConfiguration pins a configuration, replacing its previous pin
+func (dbc *dbManager) pinConfiguration(pin *configPin) error {
+	dbc.pinsMux.Lock()
+	defer dbc.pinsMux.Unlock()
+	defer dbc.pins.Store([]configPin(nil))
+	c := &pin.Configuration
+	_, err := dbc.getDb().Exec(`
+	INSERT OR REPLACE INTO APID_CONFIGURATION_PIN (`+configHistoryColumns+`, lsn, pinned_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+	`, c.ID, c.OrgID, c.EnvID, c.BlobID, c.BlobResourceID, c.Type, c.Name, c.Revision, c.Path,
+		c.Created, c.CreatedBy, c.Updated, c.UpdatedBy, pin.Lsn, formatDbTime(pin.PinnedAt))
+	if err != nil {
+		log.Errorf("INSERT APID_CONFIGURATION_PIN Failed: %v", err)
+	}
+	return err
+}
+
+// unpinConfiguration removes the pin of a configuration, and returns it. nil if there was none.
+func (dbc *dbManager) unpinConfiguration(configId string) (*configPin, error) {
+	dbc.pinsMux.Lock()
+	defer dbc.pinsMux.Unlock()
+	defer dbc.pins.Store([]configPin(nil))
+	tx, err := dbc.getDb().Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(`
+	SELECT `+configHistoryColumns+`, lsn, pinned_at FROM APID_CONFIGURATION_PIN WHERE id = ?;
+	`, configId)
+	if err != nil {
+		return nil, err
+	}
+	pins, err := configPinsFromDbRows(rows)
+	rows.Close()
+	if err != nil || len(pins) == 0 {
+		return nil, err
+	}
+	if _, err = tx.Exec("DELETE FROM APID_CONFIGURATION_PIN WHERE id = ?;", configId); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &pins[0], nil
+}
+
+// getConfigPins returns the pins, sorted by configuration id. They're cached until they change.
+func (dbc *dbManager) getConfigPins() ([]configPin, error) {
+	pins, _ := dbc.pins.Load().([]configPin)
+	if pins == nil {
+		dbc.pinsMux.Lock()
+		defer dbc.pinsMux.Unlock()
+		if pins, _ = dbc.pins.Load().([]configPin); pins == nil {
+			var err error
+			if pins, err = dbc.queryConfigPins(); err != nil {
+				return nil, err
+			}
+			dbc.pins.Store(pins)
+		}
+	}
+	return append([]configPin{}, pins...), nil
+}
+
+// copyConfigPins carries the pins of the previous snapshot over to a new one that doesn't have any yet.
+// It returns the number of pins copied.
+func copyConfigPins(from, to apid.DB) (int, error) {
+	return copyTable(from, to, "APID_CONFIGURATION_PIN", configHistoryColumns+", lsn, pinned_at", "id")
+}
+
+// resetConfigPins drops the cached pins, of the previous db
+func (dbc *dbManager) resetConfigPins() {
+	dbc.pinsMux.Lock()
+	defer dbc.pinsMux.Unlock()
+	dbc.pins.Store([]configPin(nil))
+}
+
+func (dbc *dbManager) queryConfigPins() ([]configPin, error) {
+	rows, err := dbc.getDb().Query(`
+	SELECT ` + configHistoryColumns + `, lsn, pinned_at FROM APID_CONFIGURATION_PIN ORDER BY id;
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return configPinsFromDbRows(rows)
+}
+
+func configPinsFromDbRows(rows *sql.Rows) ([]configPin, error) {
+	pins := make([]configPin, 0)
+	for rows.Next() {
+		var p configPin
+		var lsn, pinnedAt sql.NullString
+		if err := scanConfiguration(rows, &p.Configuration, &lsn, &pinnedAt); err != nil {
+			return nil, err
+		}
+		p.Lsn = lsn.String
+		p.PinnedAt = parseDbTime(pinnedAt.String)
+		pins = append(pins, p)
+	}
+	return pins, rows.Err()
+}
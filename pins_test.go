@@ -0,0 +1,102 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayConfDeploy
+
+import (
+	"github.com/apid/apid-core/data"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var _ = Describe("configuration pins", func() {
+	var testCount int
+	var testDbMan *dbManager
+
+	var _ = BeforeEach(func() {
+		testCount += 1
+		testDbMan = &dbManager{
+			data:     services.Data(),
+			dbMux:    sync.RWMutex{},
+			lsnMutex: sync.RWMutex{},
+		}
+		testDbMan.setDbVersion("testPins" + strconv.Itoa(testCount))
+		initTestDb(testDbMan.getDb())
+		Expect(testDbMan.initDb()).Should(Succeed())
+	})
+
+	var _ = AfterEach(func() {
+		data.Delete(data.VersionedDBID("common", "testPins"+strconv.Itoa(testCount)))
+		data.Delete(data.VersionedDBID("common", "testPinsNext"+strconv.Itoa(testCount)))
+	})
+
+	It("should pin, replace and unpin configurations", func() {
+		pins, err := testDbMan.getConfigPins()
+		Expect(err).Should(Succeed())
+		Expect(pins).Should(BeEmpty())
+
+		pinnedAt := time.Now().UTC().Truncate(time.Second)
+		first := configPin{Configuration: *makeTestDeployment(), Lsn: "0.1.0", PinnedAt: pinnedAt}
+		second := configPin{Configuration: *makeTestDeployment(), Lsn: "0.2.0", PinnedAt: pinnedAt}
+		Expect(testDbMan.pinConfiguration(&first)).Should(Succeed())
+		Expect(testDbMan.pinConfiguration(&second)).Should(Succeed())
+		first.Revision = "2"
+		first.Lsn = "0.3.0"
+		Expect(testDbMan.pinConfiguration(&first)).Should(Succeed())
+		pins, err = testDbMan.getConfigPins()
+		Expect(err).Should(Succeed())
+		Expect(pins).Should(ConsistOf(first, second))
+
+		pin, err := testDbMan.unpinConfiguration(first.ID)
+		Expect(err).Should(Succeed())
+		Expect(*pin).Should(Equal(first))
+		pin, err = testDbMan.unpinConfiguration(first.ID)
+		Expect(err).Should(Succeed())
+		Expect(pin).Should(BeNil())
+		pins, err = testDbMan.getConfigPins()
+		Expect(err).Should(Succeed())
+		Expect(pins).Should(Equal([]configPin{second}))
+	})
+
+	It("should carry pins over to a new snapshot", func() {
+		pin := configPin{Configuration: *makeTestDeployment(), Lsn: "0.1.0", PinnedAt: time.Now().UTC().Truncate(time.Second)}
+		Expect(testDbMan.pinConfiguration(&pin)).Should(Succeed())
+		pins, err := testDbMan.getConfigPins()
+		Expect(err).Should(Succeed())
+		Expect(pins).Should(Equal([]configPin{pin}))
+
+		testDbMan.setDbVersion("testPinsNext" + strconv.Itoa(testCount))
+		initTestDb(testDbMan.getDb())
+		Expect(testDbMan.initDb()).Should(Succeed())
+		pins, err = testDbMan.getConfigPins()
+		Expect(err).Should(Succeed())
+		Expect(pins).Should(Equal([]configPin{pin}))
+	})
+
+	It("should keep blobs of pinned revisions referenced", func() {
+		pin := configPin{Configuration: *makeTestDeployment(), PinnedAt: time.Now()}
+		referenced, err := testDbMan.isBlobReferenced(pin.BlobResourceID)
+		Expect(err).Should(Succeed())
+		Expect(referenced).Should(BeFalse())
+		Expect(testDbMan.pinConfiguration(&pin)).Should(Succeed())
+		for _, blobId := range []string{pin.BlobID, pin.BlobResourceID} {
+			referenced, err = testDbMan.isBlobReferenced(blobId)
+			Expect(err).Should(Succeed())
+			Expect(referenced).Should(BeTrue())
+		}
+	})
+})
@@ -13,12 +13,16 @@
 // limitations under the License.
 package apiGatewayConfDeploy
 
-import "github.com/apid/apid-core"
+import (
+	"strconv"
+
+	"github.com/apid/apid-core"
+)
 
 var pluginData = apid.PluginData{
 	Name:    "apidGatewayConfDeploy",
 	Version: "0.0.2",
 	ExtraData: map[string]interface{}{
-		"schemaVersion": "0.0.1",
+		"schemaVersion": strconv.Itoa(schemaVersion),
 	},
 }
@@ -0,0 +1,259 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package apiGatewayConfDeploy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	workerPoolInterval = 10 * time.Second
+	// must be shorter than apid.ShutdownTimeout
+	defaultShutdownTimeout = 5 * time.Second
+	// adaptive mode adds workers while there are more queued downloads per worker than this
+	adaptiveBacklogPerWorker = 5
+	// adaptive mode halves the workers above this rate of blob server failures
+	adaptiveMaxErrorRate = 0.2
+	// adaptive mode removes a worker while the blob server is slower than this
+	adaptiveMaxLatency = 2 * time.Second
+)
+
+// workerPool runs the download workers. The pool is resized through the admin API,
+// or when apigeesync_concurrent_downloads changes in the config.
+// In adaptive mode the size follows the queue depth and the health of the blob server instead.
+type workerPool struct {
+	mu         sync.Mutex
+	bm         *bundleManager
+	size       int
+	active     int
+	nextId     int
+	adaptive   bool
+	min        int
+	max        int
+	configSize int
+	attempts   int
+	failures   int
+	stop       chan struct{}
+	running    sync.WaitGroup
+}
+
+type workerPoolStatus struct {
+	Size     int  `json:"size"`
+	Active   int  `json:"active"`
+	Adaptive bool `json:"adaptive"`
+	Min      int  `json:"min"`
+	Max      int  `json:"max"`
+}
+
+func newWorkerPool(bm *bundleManager, min, max int, adaptive bool) *workerPool {
+	return &workerPool{
+		bm:         bm,
+		adaptive:   adaptive,
+		min:        min,
+		max:        max,
+		configSize: config.GetInt(configConcurrentDownloads),
+		stop:       make(chan struct{}),
+	}
+}
+
+// start runs size workers, and the controller adjusting the size every interval
+func (p *workerPool) start(size int, interval time.Duration) {
+	p.resize(size)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.tick()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (p *workerPool) close() {
+	close(p.stop)
+}
+
+// resize starts workers, or asks the queue to retire the extra workers on their next pop
+func (p *workerPool) resize(size int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.resizeLocked(size)
+}
+
+// must be called with mu held
+func (p *workerPool) resizeLocked(size int) {
+	if size < 1 {
+		size = 1
+	}
+	diff := size - p.size
+	if diff == 0 {
+		return
+	}
+	log.Debugf("resizing download worker pool from %d to %d", p.size, size)
+	p.size = size
+	if diff < 0 {
+		p.bm.downloadQueue.retire(-diff)
+		return
+	}
+	// workers which are still to be retired are kept instead
+	diff -= p.bm.downloadQueue.cancelRetire(diff)
+	for i := 0; i < diff; i++ {
+		p.nextId++
+		p.active++
+		p.running.Add(1)
+		w := &BundleDownloader{
+			id:       p.nextId,
+			workChan: make(chan *DownloadRequest),
+			bm:       p.bm,
+			bucket:   &tokenBucket{},
+		}
+		w.Start()
+	}
+}
+
+// exited is called by a worker which stopped
+func (p *workerPool) exited() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active--
+	p.running.Done()
+}
+
+// wait waits for the workers to stop, and returns false if they didn't within timeout
+func (p *workerPool) wait(timeout time.Duration) bool {
+	stopped := make(chan struct{})
+	go func() {
+		p.running.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// observe records the result of a download, for the adaptive mode
+func (p *workerPool) observe(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.attempts++
+	if isBlobServerFailure(err) {
+		p.failures++
+	}
+}
+
+func (p *workerPool) tick() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.adaptive {
+		// pick up a new value of the config
+		if size := config.GetInt(configConcurrentDownloads); size > 0 && size != p.configSize {
+			log.Infof("%s changed to %d", configConcurrentDownloads, size)
+			p.configSize = size
+			p.resizeLocked(size)
+		}
+		return
+	}
+	var errorRate float64
+	if p.attempts > 0 {
+		errorRate = float64(p.failures) / float64(p.attempts)
+	}
+	p.attempts, p.failures = 0, 0
+	breakerOpen := p.bm.breaker.status().State != breakerClosed
+	size := adaptiveSize(p.size, p.min, p.max, p.bm.downloadQueue.len(), errorRate,
+		bestMirrorLatency(p.bm.mirrors.status()), breakerOpen)
+	p.resizeLocked(size)
+}
+
+// adaptiveSize returns the next size of the pool, between min and max
+func adaptiveSize(size, min, max, queued int, errorRate float64, latency time.Duration, breakerOpen bool) int {
+	switch {
+	case breakerOpen || errorRate > adaptiveMaxErrorRate:
+		// back off from a failing blob server
+		size = size / 2
+	case latency > adaptiveMaxLatency:
+		size--
+	case queued > size*adaptiveBacklogPerWorker:
+		// grow by half at most per interval
+		step := (queued+adaptiveBacklogPerWorker-1)/adaptiveBacklogPerWorker - size
+		if step > size/2+1 {
+			step = size/2 + 1
+		}
+		size += step
+	case queued == 0:
+		size--
+	}
+	if size < min {
+		size = min
+	}
+	if size > max {
+		size = max
+	}
+	return size
+}
+
+// bestMirrorLatency returns the latency of the fastest healthy mirror, 0 if unknown
+func bestMirrorLatency(mirrors []mirrorStatus) time.Duration {
+	var best time.Duration
+	for _, m := range mirrors {
+		latency := time.Duration(m.LatencyMs) * time.Millisecond
+		if m.Healthy && latency > 0 && (best == 0 || latency < best) {
+			best = latency
+		}
+	}
+	return best
+}
+
+func (p *workerPool) getStatus() workerPoolStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return workerPoolStatus{
+		Size:     p.size,
+		Active:   p.active,
+		Adaptive: p.adaptive,
+		Min:      p.min,
+		Max:      p.max,
+	}
+}
+
+// set applies the size and mode of the pool. The size is ignored in adaptive mode.
+func (p *workerPool) set(s workerPoolStatus) error {
+	if s.Min < 1 || s.Max < s.Min {
+		return fmt.Errorf("invalid worker pool bounds min=%d max=%d", s.Min, s.Max)
+	}
+	if !s.Adaptive && s.Size < 1 {
+		return fmt.Errorf("invalid worker pool size %d", s.Size)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.adaptive = s.Adaptive
+	p.min = s.Min
+	p.max = s.Max
+	if !s.Adaptive {
+		p.resizeLocked(s.Size)
+	} else if p.size < p.min {
+		p.resizeLocked(p.min)
+	} else if p.size > p.max {
+		p.resizeLocked(p.max)
+	}
+	return nil
+}
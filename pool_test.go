@@ -0,0 +1,53 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayConfDeploy
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("worker pool", func() {
+
+	It("should scale with the queue depth", func() {
+		// grows by half at most
+		Expect(adaptiveSize(4, 1, 50, 100, 0, 0, false)).Should(Equal(7))
+		Expect(adaptiveSize(4, 1, 50, 25, 0, 0, false)).Should(Equal(5))
+		Expect(adaptiveSize(4, 1, 6, 100, 0, 0, false)).Should(Equal(6))
+		// steady
+		Expect(adaptiveSize(4, 1, 50, 20, 0, 0, false)).Should(Equal(4))
+		// idle
+		Expect(adaptiveSize(4, 1, 50, 0, 0, 0, false)).Should(Equal(3))
+		Expect(adaptiveSize(2, 2, 50, 0, 0, 0, false)).Should(Equal(2))
+	})
+
+	It("should scale down when the blob server struggles", func() {
+		Expect(adaptiveSize(10, 1, 50, 100, 0.5, 0, false)).Should(Equal(5))
+		Expect(adaptiveSize(10, 1, 50, 100, 0, 0, true)).Should(Equal(5))
+		Expect(adaptiveSize(10, 8, 50, 100, 0, 0, true)).Should(Equal(8))
+		Expect(adaptiveSize(10, 1, 50, 100, 0, 3*time.Second, false)).Should(Equal(9))
+	})
+
+	It("should use the fastest healthy mirror", func() {
+		Expect(bestMirrorLatency([]mirrorStatus{
+			{LatencyMs: 300, Healthy: true},
+			{LatencyMs: 100, Healthy: false},
+			{LatencyMs: 0, Healthy: true},
+			{LatencyMs: 200, Healthy: true},
+		})).Should(Equal(200 * time.Millisecond))
+		Expect(bestMirrorLatency(nil)).Should(BeZero())
+	})
+})
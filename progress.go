@@ -0,0 +1,322 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package apiGatewayConfDeploy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	blobOnDemandOff    = "off"
+	blobOnDemandStream = "stream"
+	blobOnDemandRetry  = "retry"
+
+	minRetryAfter     = time.Second
+	maxRetryAfter     = 5 * time.Minute
+	defaultRetryAfter = 5 * time.Second
+	streamBufferSize  = 32 * 1024
+)
+
+var (
+	errBlobAvailable   = errors.New("blob download finished")
+	errStreamStalled   = errors.New("no download progress before timeout")
+	errStreamRestarted = errors.New("download restarted from the beginning")
+)
+
+// downloadProgress tracks the download of a blob into its partial file,
+// so that gateways asking for the blob can follow the transfer.
+type downloadProgress struct {
+	blobId         string
+	mu             sync.Mutex
+	changed        chan struct{}
+	fileName       string
+	generation     int
+	received       int64
+	expected       int64
+	attemptOffset  int64
+	attemptStarted time.Time
+	done           bool
+	err            error
+}
+
+// blobProgress is a snapshot of the download of a blob, reported by the admin API and on configurations
+type blobProgress struct {
+	BlobId   string `json:"blobId"`
+	Received int64  `json:"received"`
+	Expected int64  `json:"expected"`
+	Started  string `json:"started,omitempty"`
+}
+
+func newDownloadProgress(blobId string) *downloadProgress {
+	return &downloadProgress{
+		blobId:   blobId,
+		changed:  make(chan struct{}),
+		expected: -1,
+	}
+}
+
+// must be called with mu held
+func (p *downloadProgress) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// start is called when an attempt begins to write fileName at offset. expected is -1 if unknown.
+func (p *downloadProgress) start(fileName string, offset, expected int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if fileName != p.fileName || offset < p.received {
+		// what followers already sent is no longer valid
+		p.generation++
+	}
+	p.fileName = fileName
+	p.received = offset
+	p.expected = expected
+	p.attemptOffset = offset
+	p.attemptStarted = time.Now()
+	p.notify()
+}
+
+func (p *downloadProgress) add(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.received += n
+	p.notify()
+}
+
+// finish marks the end of the download, err is nil if the blob is available
+func (p *downloadProgress) finish(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done = true
+	p.err = err
+	p.notify()
+}
+
+func (p *downloadProgress) snapshot() blobProgress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := blobProgress{
+		BlobId:   p.blobId,
+		Received: p.received,
+		Expected: p.expected,
+	}
+	if !p.attemptStarted.IsZero() {
+		s.Started = p.attemptStarted.UTC().Format(iso8601)
+	}
+	return s
+}
+
+// estimateRemaining returns the expected time until the download completes, from the rate of the current attempt
+func (p *downloadProgress) estimateRemaining() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	remaining := defaultRetryAfter
+	elapsed := time.Since(p.attemptStarted)
+	transferred := p.received - p.attemptOffset
+	if p.expected > 0 && transferred > 0 && elapsed > 0 {
+		rate := float64(transferred) / elapsed.Seconds()
+		seconds := float64(p.expected-p.received) / rate
+		if seconds > maxRetryAfter.Seconds() {
+			return maxRetryAfter
+		}
+		remaining = time.Duration(seconds * float64(time.Second))
+	}
+	if remaining < minRetryAfter {
+		remaining = minRetryAfter
+	} else if remaining > maxRetryAfter {
+		remaining = maxRetryAfter
+	}
+	return remaining
+}
+
+// progressWriter reports the bytes written through it
+type progressWriter struct {
+	w io.Writer
+	p *downloadProgress
+}
+
+func (pw *progressWriter) Write(b []byte) (int, error) {
+	n, err := pw.w.Write(b)
+	if n > 0 {
+		pw.p.add(int64(n))
+	}
+	return n, err
+}
+
+// trackProgress returns the progress of the blob, created if it isn't tracked yet
+func (bm *bundleManager) trackProgress(blobId string) *downloadProgress {
+	bm.progressMux.Lock()
+	defer bm.progressMux.Unlock()
+	if bm.progress == nil {
+		bm.progress = make(map[string]*downloadProgress)
+	}
+	p, ok := bm.progress[blobId]
+	if !ok {
+		p = newDownloadProgress(blobId)
+		bm.progress[blobId] = p
+	}
+	return p
+}
+
+// finishProgress stops tracking the blob, err is nil if the blob is available
+func (bm *bundleManager) finishProgress(blobId string, err error) {
+	bm.progressMux.Lock()
+	p, ok := bm.progress[blobId]
+	delete(bm.progress, blobId)
+	bm.progressMux.Unlock()
+	if ok {
+		p.finish(err)
+	}
+}
+
+// getProgress returns the progress of the active downloads, ordered by blob id
+func (bm *bundleManager) getProgress() []blobProgress {
+	bm.progressMux.Lock()
+	tracked := make([]*downloadProgress, 0, len(bm.progress))
+	for _, p := range bm.progress {
+		tracked = append(tracked, p)
+	}
+	bm.progressMux.Unlock()
+	progress := make([]blobProgress, 0, len(tracked))
+	for _, p := range tracked {
+		progress = append(progress, p.snapshot())
+	}
+	sort.Slice(progress, func(i, j int) bool {
+		return progress[i].BlobId < progress[j].BlobId
+	})
+	return progress
+}
+
+// fetchBlob makes sure the blob is being downloaded with priorityOnDemand, and returns its progress
+func (bm *bundleManager) fetchBlob(blobId string) *downloadProgress {
+	p := bm.trackProgress(blobId)
+	if !bm.downloadQueue.bump(blobId) {
+		log.Debugf("starting on-demand download of blobId=%s", blobId)
+		go bm.enqueueRequest(bm.makeDownloadRequest(blobId, priorityOnDemand, nil))
+	}
+	return p
+}
+
+// streamBlob sends the blob to the client as it's being written to the partial file.
+// It returns errBlobAvailable if the download finished before streaming started,
+// so that the blob is served from its final location instead.
+// If holdBack is true, e.g. blobs must be verified before they're served, it only waits for the download to finish.
+// Once the response has started, errors abort the connection so that the client doesn't take a truncated blob for complete.
+// The response is chunked, without Content-Length, so that it's complete only once the blob is available.
+func streamBlob(w http.ResponseWriter, r *http.Request, p *downloadProgress, stallTimeout time.Duration, holdBack bool) error {
+	// wait for a download attempt to start
+	var f *os.File
+	var generation int
+	for f == nil {
+		p.mu.Lock()
+		fileName, done, doneErr, changed := p.fileName, p.done, p.err, p.changed
+		generation = p.generation
+		p.mu.Unlock()
+		if done {
+			if doneErr != nil {
+				return doneErr
+			}
+			return errBlobAvailable
+		}
+		if fileName != "" && !holdBack {
+			var err error
+			if f, err = os.Open(fileName); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if f != nil {
+				break
+			}
+		}
+		select {
+		case <-changed:
+		case <-time.After(stallTimeout):
+			return errStreamStalled
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+	}
+	defer f.Close()
+
+	started := false
+	var sent int64
+	buf := make([]byte, streamBufferSize)
+	abort := func(err error) error {
+		if started {
+			log.Errorf("aborting stream of blobId=%s: %v", p.blobId, err)
+			panic(http.ErrAbortHandler)
+		}
+		return err
+	}
+	for {
+		p.mu.Lock()
+		received, done, doneErr, changed := p.received, p.done, p.err, p.changed
+		restarted := p.generation != generation
+		p.mu.Unlock()
+
+		if restarted {
+			return abort(errStreamRestarted)
+		}
+		if done && doneErr != nil {
+			return abort(doneErr)
+		}
+		if !started {
+			w.Header().Set("Content-Type", headerSteam)
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		for sent < received {
+			n, err := f.ReadAt(buf[:min64(int64(len(buf)), received-sent)], sent)
+			if n > 0 {
+				if _, werr := w.Write(buf[:n]); werr != nil {
+					return abort(werr)
+				}
+				sent += int64(n)
+			}
+			if err != nil && err != io.EOF {
+				return abort(err)
+			}
+			if n == 0 {
+				break
+			}
+		}
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		if done && sent >= received {
+			log.Debugf("streamed blobId=%s, %d bytes", p.blobId, sent)
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-time.After(stallTimeout):
+			return abort(errStreamStalled)
+		case <-r.Context().Done():
+			return abort(r.Context().Err())
+		}
+	}
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,89 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayConfDeploy
+
+import (
+	"github.com/apid/apid-core/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("progress", func() {
+	var p *downloadProgress
+
+	var _ = BeforeEach(func() {
+		p = newDownloadProgress(util.GenerateUUID())
+	})
+
+	It("should estimate remaining time from the transfer rate", func() {
+		Expect(p.estimateRemaining()).Should(Equal(defaultRetryAfter))
+
+		p.start("file", 0, 1000)
+		p.attemptStarted = time.Now().Add(-10 * time.Second)
+		p.add(100)
+		remaining := p.estimateRemaining()
+		Expect(remaining).Should(BeNumerically("~", 90*time.Second, time.Second))
+
+		// bounded
+		p.add(899)
+		Expect(p.estimateRemaining()).Should(Equal(minRetryAfter))
+		p.start("file", 999, 1000000000)
+		p.attemptStarted = time.Now().Add(-10 * time.Second)
+		p.add(1)
+		Expect(p.estimateRemaining()).Should(Equal(maxRetryAfter))
+	})
+
+	It("should detect restarted downloads", func() {
+		p.start("file", 0, -1)
+		generation := p.generation
+		p.add(100)
+
+		// resumed
+		p.start("file", 100, -1)
+		Expect(p.generation).Should(Equal(generation))
+
+		// truncated
+		p.start("file", 0, -1)
+		Expect(p.generation).ShouldNot(Equal(generation))
+	})
+
+	It("should notify changes", func() {
+		changed := p.changed
+		p.add(1)
+		Expect(changed).Should(BeClosed())
+		changed = p.changed
+		p.finish(nil)
+		Expect(changed).Should(BeClosed())
+		Expect(p.done).Should(BeTrue())
+	})
+
+	It("should list the active downloads", func() {
+		bm := &bundleManager{}
+		Expect(bm.getProgress()).Should(BeEmpty())
+		second := bm.trackProgress("b")
+		second.start("file", 0, -1)
+		second.add(10)
+		bm.trackProgress("a")
+		progress := bm.getProgress()
+		Expect(progress).Should(HaveLen(2))
+		Expect(progress[0]).Should(Equal(blobProgress{BlobId: "a", Expected: -1}))
+		Expect(progress[1].BlobId).Should(Equal("b"))
+		Expect(progress[1].Received).Should(Equal(int64(10)))
+
+		bm.finishProgress("a", nil)
+		Expect(bm.getProgress()).Should(HaveLen(1))
+	})
+})
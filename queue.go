@@ -0,0 +1,452 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package apiGatewayConfDeploy
+
+import (
+	"container/heap"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// base priorities of download requests, per-type priorities are added on top of them
+const (
+	priorityBackfill   = 0
+	priorityChangeList = 100
+	priorityOnDemand   = 1000
+	// per-type priorities are within ±maxTypePriority, so that they don't reorder base priorities
+	maxTypePriority = priorityChangeList/2 - 1
+	// requests of higher priority than the backfill aren't bounded by the queue capacity
+	maxBoundedPriority = priorityBackfill + maxTypePriority
+)
+
+// downloadQueue is a bounded priority queue of download requests.
+// Requests of higher priority are popped first, requests of equal priority in FIFO order.
+// A request stays pending from its first push until done is called, so that it can be bumped
+// while it's queued, being downloaded or backing off.
+// Retries wait in the delayed heap until they are due, a single timer moves them back to the queue.
+// Delayed retries count towards the capacity, so that new backfill requests block while the blob server is failing.
+// Change list and on demand requests aren't bounded by the capacity, they never wait for the backfill.
+type downloadQueue struct {
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	items    requestHeap
+	delayed  delayHeap
+	// requests blocked in push, in arrival order
+	blocked  []*DownloadRequest
+	timer    *time.Timer
+	pending  map[string][]*DownloadRequest
+	capacity int
+	seq      uint64
+	retiring int
+	closed   bool
+}
+
+func newDownloadQueue(capacity int) *downloadQueue {
+	q := &downloadQueue{
+		pending:  make(map[string][]*DownloadRequest),
+		capacity: capacity,
+	}
+	q.notEmpty = sync.NewCond(&q.mu)
+	q.notFull = sync.NewCond(&q.mu)
+	return q
+}
+
+// push blocks while the queue is full, unless the request is above maxBoundedPriority.
+// Blocked requests are admitted by priority, then in arrival order. It returns false if the queue is closed.
+func (q *downloadQueue) push(r *DownloadRequest) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !r.pending {
+		r.pending = true
+		q.pending[r.blobId] = append(q.pending[r.blobId], r)
+	}
+	if !q.closed && q.mustWaitLocked(r, len(q.blocked)) {
+		q.blocked = append(q.blocked, r)
+		for !q.closed && q.mustWaitLocked(r, q.blockedIndexLocked(r)) {
+			q.notFull.Wait()
+		}
+		q.blocked = append(q.blocked[:q.blockedIndexLocked(r)], q.blocked[q.blockedIndexLocked(r)+1:]...)
+		// the next one may be admitted too
+		q.notFull.Broadcast()
+	}
+	if q.closed {
+		return false
+	}
+	q.enqueueLocked(r)
+	q.notEmpty.Signal()
+	return true
+}
+
+// mustWaitLocked returns true if r, at index i of the blocked requests, can't be admitted yet.
+// must be called with mu held
+func (q *downloadQueue) mustWaitLocked(r *DownloadRequest, i int) bool {
+	if r.priority > maxBoundedPriority {
+		return false
+	}
+	if len(q.items)+len(q.delayed) >= q.capacity {
+		return true
+	}
+	for j, b := range q.blocked {
+		if b.priority > r.priority || (b.priority == r.priority && j < i) {
+			return true
+		}
+	}
+	return false
+}
+
+// must be called with mu held
+func (q *downloadQueue) blockedIndexLocked(r *DownloadRequest) int {
+	for i, b := range q.blocked {
+		if b == r {
+			return i
+		}
+	}
+	return len(q.blocked)
+}
+
+// pushAfter queues a retry once the delay has passed. It doesn't block, as the request was popped before.
+// It returns false if the queue is closed or the request was cancelled.
+func (q *downloadQueue) pushAfter(r *DownloadRequest, delay time.Duration) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || r.cancelled {
+		return false
+	}
+	r.due = time.Now().Add(delay)
+	heap.Push(&q.delayed, r)
+	if q.delayed[0] == r {
+		q.scheduleLocked()
+	}
+	return true
+}
+
+// must be called with mu held
+func (q *downloadQueue) enqueueLocked(r *DownloadRequest) {
+	q.seq++
+	r.seq = q.seq
+	heap.Push(&q.items, r)
+}
+
+// scheduleLocked sets the timer to the earliest due retry. must be called with mu held
+func (q *downloadQueue) scheduleLocked() {
+	if len(q.delayed) == 0 {
+		return
+	}
+	d := time.Until(q.delayed[0].due)
+	if q.timer == nil {
+		q.timer = time.AfterFunc(d, q.release)
+	} else {
+		q.timer.Reset(d)
+	}
+}
+
+// release moves due retries to the queue
+func (q *downloadQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	now := time.Now()
+	released := false
+	for len(q.delayed) > 0 && !q.delayed[0].due.After(now) {
+		q.enqueueLocked(heap.Pop(&q.delayed).(*DownloadRequest))
+		released = true
+	}
+	if released {
+		q.notEmpty.Broadcast()
+	}
+	q.scheduleLocked()
+}
+
+// pop blocks until a request is available.
+// It returns false if the queue is closed, or if the calling worker must retire.
+func (q *downloadQueue) pop() (*DownloadRequest, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for !q.closed && q.retiring == 0 && len(q.items) == 0 {
+		q.notEmpty.Wait()
+	}
+	if q.closed {
+		return nil, false
+	}
+	if q.retiring > 0 {
+		q.retiring--
+		return nil, false
+	}
+	r := heap.Pop(&q.items).(*DownloadRequest)
+	if len(q.blocked) > 0 {
+		// only the blocked request of highest priority may proceed
+		q.notFull.Broadcast()
+	}
+	return r, true
+}
+
+// done removes a request that won't be pushed again from the pending requests
+func (q *downloadQueue) done(r *DownloadRequest) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !r.pending {
+		return
+	}
+	r.pending = false
+	reqs := q.pending[r.blobId]
+	for i, p := range reqs {
+		if p == r {
+			reqs = append(reqs[:i], reqs[i+1:]...)
+			break
+		}
+	}
+	if len(reqs) == 0 {
+		delete(q.pending, r.blobId)
+	} else {
+		q.pending[r.blobId] = reqs
+	}
+}
+
+// cancel removes the pending requests of the blob and cancels their context.
+// Requests waiting in the queue or backing off are returned as waiting, the ones being downloaded as inFlight.
+func (q *downloadQueue) cancel(blobId string) (waiting []*DownloadRequest, inFlight []*DownloadRequest) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	reqs := q.pending[blobId]
+	if len(reqs) == 0 {
+		return
+	}
+	delete(q.pending, blobId)
+	for _, r := range reqs {
+		r.pending = false
+		r.cancelled = true
+		if r.cancel != nil {
+			r.cancel()
+		}
+		if r.index >= 0 {
+			heap.Remove(&q.items, r.index)
+			waiting = append(waiting, r)
+		} else if !r.due.IsZero() && q.delayed.remove(r) {
+			waiting = append(waiting, r)
+		} else {
+			inFlight = append(inFlight, r)
+		}
+	}
+	if len(waiting) > 0 {
+		heap.Init(&q.delayed)
+		q.scheduleLocked()
+		q.notFull.Broadcast()
+	}
+	return
+}
+
+// bump raises pending requests of the blob to priorityOnDemand, requests blocked in push are admitted,
+// and retries backing off are due at once. It returns false if there's no pending request for the blob.
+func (q *downloadQueue) bump(blobId string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	reqs := q.pending[blobId]
+	released := false
+	for _, r := range reqs {
+		if r.priority < priorityOnDemand {
+			r.priority = priorityOnDemand
+			if r.index >= 0 {
+				heap.Fix(&q.items, r.index)
+			}
+		}
+		if r.index < 0 && !r.due.IsZero() && q.delayed.remove(r) {
+			q.enqueueLocked(r)
+			released = true
+		}
+	}
+	if released {
+		heap.Init(&q.delayed)
+		q.scheduleLocked()
+		q.notEmpty.Broadcast()
+	}
+	if len(reqs) > 0 && len(q.blocked) > 0 {
+		q.notFull.Broadcast()
+	}
+	return len(reqs) > 0
+}
+
+// retire makes the next n calls to pop return false, so that n workers stop
+func (q *downloadQueue) retire(n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.retiring += n
+	q.notEmpty.Broadcast()
+}
+
+// cancelRetire cancels up to n pending retirements, and returns how many were cancelled
+func (q *downloadQueue) cancelRetire(n int) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if n > q.retiring {
+		n = q.retiring
+	}
+	q.retiring -= n
+	return n
+}
+
+// pendingPriorities returns the highest priority of the pending requests of each blob
+func (q *downloadQueue) pendingPriorities() map[string]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	priorities := make(map[string]int, len(q.pending))
+	for blobId, reqs := range q.pending {
+		for i, r := range reqs {
+			if i == 0 || r.priority > priorities[blobId] {
+				priorities[blobId] = r.priority
+			}
+		}
+	}
+	return priorities
+}
+
+// close releases all blocked push and pop calls
+func (q *downloadQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	if q.timer != nil {
+		q.timer.Stop()
+	}
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
+
+func (q *downloadQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// delayedLen returns the number of retries waiting for their due time
+func (q *downloadQueue) delayedLen() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.delayed)
+}
+
+type requestHeap []*DownloadRequest
+
+func (h requestHeap) Len() int { return len(h) }
+
+func (h requestHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h requestHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *requestHeap) Push(x interface{}) {
+	r := x.(*DownloadRequest)
+	r.index = len(*h)
+	*h = append(*h, r)
+}
+
+func (h *requestHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	r := old[n-1]
+	old[n-1] = nil
+	r.index = -1
+	*h = old[:n-1]
+	return r
+}
+
+// delayHeap orders retries by due time
+type delayHeap []*DownloadRequest
+
+func (h delayHeap) Len() int { return len(h) }
+
+func (h delayHeap) Less(i, j int) bool { return h[i].due.Before(h[j].due) }
+
+func (h delayHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *delayHeap) Push(x interface{}) {
+	*h = append(*h, x.(*DownloadRequest))
+}
+
+func (h *delayHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	r := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return r
+}
+
+// remove deletes the request without restoring the heap order, the caller must call heap.Init
+func (h *delayHeap) remove(r *DownloadRequest) bool {
+	old := *h
+	for i, d := range old {
+		if d == r {
+			n := len(old)
+			old[i] = old[n-1]
+			old[n-1] = nil
+			*h = old[:n-1]
+			return true
+		}
+	}
+	return false
+}
+
+// parseTypePriorities parses a list of "type:priority" pairs separated by commas
+func parseTypePriorities(s string) (map[string]int, error) {
+	return parseTypeValues(s, "priority")
+}
+
+// parseTypeValues parses a list of "type:value" pairs separated by commas, valueName is used in errors
+func parseTypeValues(s string, valueName string) (map[string]int, error) {
+	values := make(map[string]int)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid type %s %q, must be type:%s", valueName, pair, valueName)
+		}
+		v, err := strconv.Atoi(pair[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid type %s %q: %v", valueName, pair, err)
+		}
+		values[pair[:i]] = v
+	}
+	return values, nil
+}
+
+// blobPriorities maps the blobs of the configurations to the base priority plus the priority of their type
+func blobPriorities(confs []*Configuration, base int) map[string]int {
+	priorities := make(map[string]int)
+	for _, conf := range confs {
+		p := base + downloadTypePriorities[conf.Type]
+		for _, id := range []string{conf.BlobID, conf.BlobResourceID} {
+			if old, ok := priorities[id]; id != "" && (!ok || p > old) {
+				priorities[id] = p
+			}
+		}
+	}
+	return priorities
+}
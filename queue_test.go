@@ -0,0 +1,279 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayConfDeploy
+
+import (
+	"github.com/apid/apid-core/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("download queue", func() {
+	var q *downloadQueue
+
+	makeRequest := func(priority int) *DownloadRequest {
+		return &DownloadRequest{
+			blobId:   util.GenerateUUID(),
+			priority: priority,
+			index:    -1,
+		}
+	}
+
+	var _ = BeforeEach(func() {
+		q = newDownloadQueue(10)
+	})
+
+	var _ = AfterEach(func() {
+		q.close()
+	})
+
+	It("should pop by priority, then in FIFO order", func() {
+		backfill1 := makeRequest(priorityBackfill)
+		backfill2 := makeRequest(priorityBackfill)
+		live := makeRequest(priorityChangeList)
+		liveHigh := makeRequest(priorityChangeList + 5)
+		for _, r := range []*DownloadRequest{backfill1, backfill2, live, liveHigh} {
+			Expect(q.push(r)).Should(BeTrue())
+		}
+		for _, expected := range []*DownloadRequest{liveHigh, live, backfill1, backfill2} {
+			r, ok := q.pop()
+			Expect(ok).Should(BeTrue())
+			Expect(r).Should(Equal(expected))
+		}
+	})
+
+	It("should bump queued and pending requests", func() {
+		first := makeRequest(priorityChangeList)
+		backfill := makeRequest(priorityBackfill)
+		q.push(first)
+		q.push(backfill)
+		Expect(q.bump(backfill.blobId)).Should(BeTrue())
+		r, _ := q.pop()
+		Expect(r).Should(Equal(backfill))
+
+		// bump a request that's being downloaded, it keeps the priority when retried
+		r, _ = q.pop()
+		Expect(r).Should(Equal(first))
+		Expect(q.bump(first.blobId)).Should(BeTrue())
+		q.push(makeRequest(priorityChangeList))
+		q.push(first)
+		r, _ = q.pop()
+		Expect(r).Should(Equal(first))
+
+		// done requests can't be bumped
+		q.done(first)
+		Expect(q.bump(first.blobId)).Should(BeFalse())
+		Expect(q.bump(util.GenerateUUID())).Should(BeFalse())
+	})
+
+	It("should cancel queued, delayed and in-flight requests of a blob", func() {
+		queued := makeRequest(priorityBackfill)
+		delayed := makeRequest(priorityBackfill)
+		delayed.blobId = queued.blobId
+		inFlight := makeRequest(priorityBackfill)
+		inFlight.blobId = queued.blobId
+		other := makeRequest(priorityBackfill)
+		q.push(inFlight)
+		r, _ := q.pop()
+		Expect(r).Should(Equal(inFlight))
+		q.push(delayed)
+		q.pop()
+		Expect(q.pushAfter(delayed, time.Hour)).Should(BeTrue())
+		q.push(queued)
+		q.push(other)
+
+		waiting, cancelled := q.cancel(queued.blobId)
+		Expect(waiting).Should(ConsistOf(queued, delayed))
+		Expect(cancelled).Should(ConsistOf(inFlight))
+		Expect(q.len()).Should(Equal(1))
+		Expect(q.delayedLen()).Should(BeZero())
+		Expect(q.pendingPriorities()).Should(Equal(map[string]int{other.blobId: priorityBackfill}))
+
+		// cancelled requests aren't retried
+		Expect(q.pushAfter(inFlight, 0)).Should(BeFalse())
+		Expect(q.bump(queued.blobId)).Should(BeFalse())
+		waiting, cancelled = q.cancel(queued.blobId)
+		Expect(waiting).Should(BeEmpty())
+		Expect(cancelled).Should(BeEmpty())
+	})
+
+	It("should block push when full, and release on close", func() {
+		q = newDownloadQueue(1)
+		Expect(q.push(makeRequest(priorityBackfill))).Should(BeTrue())
+		pushed := make(chan bool)
+		go func() {
+			pushed <- q.push(makeRequest(priorityBackfill))
+		}()
+		Consistently(pushed, 200*time.Millisecond).ShouldNot(Receive())
+		q.pop()
+		Eventually(pushed).Should(Receive(BeTrue()))
+
+		go func() {
+			pushed <- q.push(makeRequest(priorityBackfill))
+		}()
+		Consistently(pushed, 200*time.Millisecond).ShouldNot(Receive())
+		q.close()
+		Eventually(pushed).Should(Receive(BeFalse()))
+		_, ok := q.pop()
+		Expect(ok).Should(BeFalse())
+	})
+
+	It("should not block change list and on demand requests when full", func() {
+		q = newDownloadQueue(1)
+		Expect(q.push(makeRequest(priorityBackfill))).Should(BeTrue())
+		Expect(q.push(makeRequest(priorityChangeList - maxTypePriority))).Should(BeTrue())
+		Expect(q.push(makeRequest(priorityOnDemand))).Should(BeTrue())
+		Expect(q.len()).Should(Equal(3))
+	})
+
+	It("should admit blocked requests by priority, and bumped ones right away", func() {
+		q = newDownloadQueue(1)
+		Expect(q.push(makeRequest(priorityBackfill))).Should(BeTrue())
+		admitted := make(chan *DownloadRequest, 3)
+		blocked := func() int {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			return len(q.blocked)
+		}
+		push := func(r *DownloadRequest) {
+			n := blocked()
+			go func() {
+				if q.push(r) {
+					admitted <- r
+				}
+			}()
+			Eventually(blocked).Should(Equal(n + 1))
+		}
+		low := makeRequest(priorityBackfill - 1)
+		first := makeRequest(priorityBackfill)
+		second := makeRequest(priorityBackfill)
+		high := makeRequest(priorityBackfill + maxTypePriority)
+		for _, r := range []*DownloadRequest{low, first, second, high} {
+			push(r)
+		}
+		Consistently(admitted, 100*time.Millisecond).ShouldNot(Receive())
+
+		Expect(q.bump(second.blobId)).Should(BeTrue())
+		Eventually(admitted).Should(Receive(Equal(second)))
+		r, _ := q.pop()
+		Expect(r).Should(Equal(second))
+		Consistently(admitted, 100*time.Millisecond).ShouldNot(Receive())
+		for _, expected := range []*DownloadRequest{high, first, low} {
+			_, ok := q.pop()
+			Expect(ok).Should(BeTrue())
+			Eventually(admitted).Should(Receive(Equal(expected)))
+		}
+	})
+
+	It("should release retries when they are due", func() {
+		late := makeRequest(priorityOnDemand)
+		early := makeRequest(priorityBackfill)
+		Expect(q.pushAfter(late, 300*time.Millisecond)).Should(BeTrue())
+		Expect(q.pushAfter(early, 100*time.Millisecond)).Should(BeTrue())
+		Expect(q.delayedLen()).Should(Equal(2))
+		Expect(q.len()).Should(BeZero())
+
+		start := time.Now()
+		r, _ := q.pop()
+		Expect(r).Should(Equal(early))
+		Expect(time.Since(start)).Should(BeNumerically(">=", 90*time.Millisecond))
+		r, _ = q.pop()
+		Expect(r).Should(Equal(late))
+		Expect(time.Since(start)).Should(BeNumerically(">=", 290*time.Millisecond))
+		Expect(q.delayedLen()).Should(BeZero())
+	})
+
+	It("should release bumped retries at once", func() {
+		backingOff := makeRequest(priorityBackfill)
+		other := makeRequest(priorityBackfill)
+		for _, r := range []*DownloadRequest{backingOff, other} {
+			Expect(q.push(r)).Should(BeTrue())
+			popped, _ := q.pop()
+			Expect(popped).Should(Equal(r))
+			Expect(q.pushAfter(r, maxDownloadBackOff)).Should(BeTrue())
+		}
+
+		start := time.Now()
+		Expect(q.bump(backingOff.blobId)).Should(BeTrue())
+		r, _ := q.pop()
+		Expect(r).Should(Equal(backingOff))
+		Expect(r.priority).Should(Equal(priorityOnDemand))
+		Expect(time.Since(start)).Should(BeNumerically("<", time.Second))
+		Expect(q.delayedLen()).Should(Equal(1))
+		Expect(q.len()).Should(BeZero())
+
+		// cancelling the one left still works
+		waiting, _ := q.cancel(other.blobId)
+		Expect(waiting).Should(Equal([]*DownloadRequest{other}))
+		Expect(q.delayedLen()).Should(BeZero())
+	})
+
+	It("should count retries towards the capacity", func() {
+		q = newDownloadQueue(1)
+		Expect(q.pushAfter(makeRequest(priorityBackfill), 200*time.Millisecond)).Should(BeTrue())
+		// retries never block
+		Expect(q.pushAfter(makeRequest(priorityBackfill), 200*time.Millisecond)).Should(BeTrue())
+		pushed := make(chan bool)
+		go func() {
+			pushed <- q.push(makeRequest(priorityBackfill))
+		}()
+		Consistently(pushed, 100*time.Millisecond).ShouldNot(Receive())
+		q.pop()
+		q.pop()
+		Eventually(pushed).Should(Receive(BeTrue()))
+		q.close()
+		Expect(q.pushAfter(makeRequest(priorityBackfill), 0)).Should(BeFalse())
+	})
+
+	It("should back off with jitter", func() {
+		backoff := createBackoff(100*time.Millisecond, 300*time.Millisecond)
+		for _, max := range []time.Duration{100, 200, 300, 300} {
+			d := backoff()
+			Expect(d).Should(BeNumerically(">=", max*time.Millisecond/2))
+			Expect(d).Should(BeNumerically("<=", max*time.Millisecond))
+		}
+	})
+
+	It("should parse type priorities", func() {
+		p, err := parseTypePriorities("ORGANIZATION:10, ENVIRONMENT:-5,")
+		Expect(err).Should(Succeed())
+		Expect(p).Should(Equal(map[string]int{"ORGANIZATION": 10, "ENVIRONMENT": -5}))
+		p, err = parseTypePriorities("")
+		Expect(err).Should(Succeed())
+		Expect(p).Should(BeEmpty())
+		_, err = parseTypePriorities("ORGANIZATION")
+		Expect(err).ShouldNot(Succeed())
+		_, err = parseTypePriorities("ORGANIZATION:high")
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("should give blobs the priority of their configuration type", func() {
+		oldPriorities := downloadTypePriorities
+		downloadTypePriorities = map[string]int{"ORGANIZATION": 10}
+		defer func() {
+			downloadTypePriorities = oldPriorities
+		}()
+		org := makeTestDeployment()
+		org.Type = "ORGANIZATION"
+		env := makeTestDeployment()
+		env.Type = "ENVIRONMENT"
+		env.BlobResourceID = org.BlobID
+		p := blobPriorities([]*Configuration{org, env}, priorityChangeList)
+		Expect(p[org.BlobID]).Should(Equal(priorityChangeList + 10))
+		Expect(p[org.BlobResourceID]).Should(Equal(priorityChangeList + 10))
+		Expect(p[env.BlobID]).Should(Equal(priorityChangeList))
+	})
+})
@@ -0,0 +1,115 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package apiGatewayConfDeploy
+
+// configSnapshot is an immutable in-memory copy of the configurations at a config index.
+// It's replaced as a whole when the configurations or the config index change, so it can be read without locks.
+// The slices it returns are shared, and must not be modified.
+type configSnapshot struct {
+	// snapshot epoch of lsn, see migrateSnapshotEpoch
+	epoch   int64
+	lsn     string
+	configs []Configuration
+	byId    map[string]int
+	byType  map[string][]Configuration
+}
+
+func newConfigSnapshot(lsn string, configs []Configuration) *configSnapshot {
+	s := &configSnapshot{
+		lsn:     lsn,
+		configs: configs,
+		byId:    make(map[string]int, len(configs)),
+		byType:  make(map[string][]Configuration),
+	}
+	for i := range configs {
+		s.byId[configs[i].ID] = i
+		s.byType[configs[i].Type] = append(s.byType[configs[i].Type], configs[i])
+	}
+	return s
+}
+
+// withIndex returns a snapshot of the same configurations at another config index
+func (s *configSnapshot) withIndex(epoch int64, lsn string) *configSnapshot {
+	if s.epoch == epoch && s.lsn == lsn {
+		return s
+	}
+	next := *s
+	next.epoch = epoch
+	next.lsn = lsn
+	return &next
+}
+
+// index returns the config index given to clients, see formatConfigIndex
+func (s *configSnapshot) index() string {
+	return formatConfigIndex(s.epoch, s.lsn)
+}
+
+// withChanges returns a copy of the snapshot at the config index lsn, with the current configurations
+// inserted or replacing those of the same id, and the deleted ones removed.
+// Configurations keep their position, new ones are added at the end.
+// An id must be either current or deleted, the last of its current configurations wins.
+func (s *configSnapshot) withChanges(lsn string, current, deleted []*Configuration) *configSnapshot {
+	removed := make(map[string]bool, len(deleted))
+	for _, c := range deleted {
+		removed[c.ID] = true
+	}
+	configs := make([]Configuration, len(s.configs), len(s.configs)+len(current))
+	copy(configs, s.configs)
+	added := make(map[string]int)
+	for _, c := range current {
+		if i, ok := s.byId[c.ID]; ok {
+			configs[i] = *c
+		} else if i, ok := added[c.ID]; ok {
+			configs[i] = *c
+		} else {
+			added[c.ID] = len(configs)
+			configs = append(configs, *c)
+		}
+	}
+	if len(removed) > 0 {
+		kept := configs[:0]
+		for _, c := range configs {
+			if !removed[c.ID] {
+				kept = append(kept, c)
+			}
+		}
+		configs = kept
+	}
+	next := newConfigSnapshot(lsn, configs)
+	next.epoch = s.epoch
+	return next
+}
+
+// getConfigurations returns the configurations of a type, or all of them if typeFilter is empty
+func (s *configSnapshot) getConfigurations(typeFilter string) []Configuration {
+	configs := s.configs
+	if typeFilter != "" {
+		configs = s.byType[typeFilter]
+	}
+	if configs == nil {
+		return []Configuration{}
+	}
+	// appending to the result mustn't write to the snapshot
+	return configs[:len(configs):len(configs)]
+}
+
+// getConfigById returns a copy of the configuration, or nil if there's none with the id
+func (s *configSnapshot) getConfigById(id string) *Configuration {
+	i, ok := s.byId[id]
+	if !ok {
+		return nil
+	}
+	config := s.configs[i]
+	return &config
+}
@@ -0,0 +1,84 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayConfDeploy
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("configuration snapshot", func() {
+	var org, env, other Configuration
+
+	var _ = BeforeEach(func() {
+		org = *makeTestDeployment()
+		org.Type = "ORGANIZATION"
+		env = *makeTestDeployment()
+		env.Type = "ENVIRONMENT"
+		other = *makeTestDeployment()
+		other.Type = "ENVIRONMENT"
+	})
+
+	It("should index configurations by id and type", func() {
+		s := newConfigSnapshot("1.0.0", []Configuration{org, env, other})
+		Expect(s.getConfigurations("")).Should(Equal([]Configuration{org, env, other}))
+		Expect(s.getConfigurations("ENVIRONMENT")).Should(Equal([]Configuration{env, other}))
+		Expect(s.getConfigurations("INVALID-TYPE")).Should(BeEmpty())
+		Expect(*s.getConfigById(env.ID)).Should(Equal(env))
+		Expect(s.getConfigById("non-existent")).Should(BeNil())
+
+		// results are copies
+		s.getConfigById(env.ID).Revision = "changed"
+		confs := append(s.getConfigurations(""), env)
+		confs = append(confs[:1], confs[2:]...)
+		Expect(s.getConfigurations("")).Should(Equal([]Configuration{org, env, other}))
+		Expect(*s.getConfigById(env.ID)).Should(Equal(env))
+	})
+
+	It("should apply changes to a copy", func() {
+		s := newConfigSnapshot("1.0.0", []Configuration{org, env, other})
+		updated := env
+		updated.Revision = "2"
+		inserted := *makeTestDeployment()
+		next := s.withChanges("2.0.0", []*Configuration{&updated, &inserted}, []*Configuration{&org})
+		Expect(next.lsn).Should(Equal("2.0.0"))
+		Expect(next.getConfigurations("")).Should(Equal([]Configuration{updated, other, inserted}))
+		Expect(next.getConfigurations("ENVIRONMENT")).Should(Equal([]Configuration{updated, other}))
+		Expect(next.getConfigById(org.ID)).Should(BeNil())
+		Expect(*next.getConfigById(inserted.ID)).Should(Equal(inserted))
+
+		Expect(s.lsn).Should(Equal("1.0.0"))
+		Expect(s.getConfigurations("")).Should(Equal([]Configuration{org, env, other}))
+
+		moved := next.withIndex(0, "3.0.0")
+		Expect(moved.lsn).Should(Equal("3.0.0"))
+		Expect(moved.getConfigurations("")).Should(Equal(next.getConfigurations("")))
+		Expect(next.lsn).Should(Equal("2.0.0"))
+		Expect(next.withIndex(0, "2.0.0")).Should(BeIdenticalTo(next))
+
+		// the epoch is kept by changes
+		epoch := next.withIndex(5, "2.0.0")
+		Expect(epoch.index()).Should(Equal("5-2.0.0"))
+		Expect(next.index()).Should(Equal("2.0.0"))
+		Expect(epoch.withChanges("3.0.0", nil, []*Configuration{&other}).index()).Should(Equal("5-3.0.0"))
+
+		// a configuration inserted twice is added once, with its last state
+		again := inserted
+		again.Revision = "2"
+		twice := *makeTestDeployment()
+		Expect(s.withChanges("2.0.0", []*Configuration{&twice, &inserted, &again}, nil).getConfigurations("")).
+			Should(Equal([]Configuration{org, env, other, twice, again}))
+	})
+})
@@ -0,0 +1,193 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package apiGatewayConfDeploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tokenSourceConfig = "config"
+	tokenSourceFile   = "file"
+	tokenSourceOAuth  = "oauth"
+
+	// oauth tokens are renewed this long before they expire
+	tokenExpiryMargin = 30 * time.Second
+	// used if the oauth endpoint doesn't say when the token expires
+	defaultTokenLifetime = 5 * time.Minute
+	// a failure to get an oauth token is returned to callers for this long, instead of asking again
+	tokenFailureBackoff = 5 * time.Second
+)
+
+// tokenProvider supplies the bearer token sent to the blob server
+type tokenProvider interface {
+	// token returns the current token, getting a new one may be interrupted by ctx
+	token(ctx context.Context) (string, error)
+	// invalidate is called when the token was rejected with 401, the next call to token gets a new one
+	invalidate(rejected string)
+}
+
+// configTokenProvider reads the token from the config on every call, it is kept up to date by apidApigeeSync
+type configTokenProvider struct{}
+
+func (p *configTokenProvider) token(ctx context.Context) (string, error) {
+	return config.GetString(configBearerToken), nil
+}
+
+func (p *configTokenProvider) invalidate(rejected string) {
+	log.Warnf("bearer token from %s rejected", configBearerToken)
+}
+
+// fileTokenProvider reads the token from a file, reloaded when it's rotated on disk
+type fileTokenProvider struct {
+	mu      sync.Mutex
+	path    string
+	cached  string
+	modTime time.Time
+	stale   bool
+}
+
+func (p *fileTokenProvider) token(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read token file %s: %v", p.path, err)
+	}
+	if p.cached != "" && !p.stale && info.ModTime().Equal(p.modTime) {
+		return p.cached, nil
+	}
+	b, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read token file %s: %v", p.path, err)
+	}
+	p.cached = strings.TrimSpace(string(b))
+	p.modTime = info.ModTime()
+	p.stale = false
+	return p.cached, nil
+}
+
+func (p *fileTokenProvider) invalidate(rejected string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if rejected == p.cached {
+		p.stale = true
+	}
+}
+
+// oauthTokenProvider gets tokens from an OAuth endpoint with the client credentials grant,
+// and caches them until they're about to expire.
+// A failure is cached for tokenFailureBackoff, so that callers waiting for the token fail fast.
+type oauthTokenProvider struct {
+	mu           sync.Mutex
+	client       *http.Client
+	tokenURL     string
+	clientId     string
+	clientSecret string
+	cached       string
+	expiresAt    time.Time
+	failure      error
+	failedUntil  time.Time
+}
+
+type oauthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func (p *oauthTokenProvider) token(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cached != "" && time.Now().Before(p.expiresAt) {
+		return p.cached, nil
+	}
+	if p.failure != nil && time.Now().Before(p.failedUntil) {
+		return "", p.failure
+	}
+	t, err := p.fetch(ctx)
+	if err != nil {
+		// an interrupted caller says nothing about the endpoint
+		if ctx.Err() == nil {
+			p.failure = err
+			p.failedUntil = time.Now().Add(tokenFailureBackoff)
+		}
+		return "", err
+	}
+	p.failure = nil
+	return t, nil
+}
+
+// fetch gets a new token from the endpoint and caches it, must be called with mu held
+func (p *oauthTokenProvider) fetch(ctx context.Context) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	req, err := http.NewRequestWithContext(ctx, "POST", p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.clientId), url.QueryEscape(p.clientSecret))
+	res, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to get token from %s: %v", p.tokenURL, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to get token from %s: status %d", p.tokenURL, res.StatusCode)
+	}
+	t := oauthTokenResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&t); err != nil {
+		return "", fmt.Errorf("invalid token response from %s: %v", p.tokenURL, err)
+	}
+	if t.AccessToken == "" {
+		return "", fmt.Errorf("invalid token response from %s: no access_token", p.tokenURL)
+	}
+	lifetime := defaultTokenLifetime
+	if t.ExpiresIn > 0 {
+		lifetime = time.Duration(t.ExpiresIn) * time.Second
+	}
+	if lifetime > 2*tokenExpiryMargin {
+		lifetime -= tokenExpiryMargin
+	}
+	p.cached = t.AccessToken
+	p.expiresAt = time.Now().Add(lifetime)
+	log.Debugf("got token from %s, expires in %s", p.tokenURL, lifetime)
+	return p.cached, nil
+}
+
+func (p *oauthTokenProvider) invalidate(rejected string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if rejected == p.cached {
+		p.cached = ""
+	}
+}
+
+func getBearerToken(ctx context.Context) (string, error) {
+	t, err := tokens.token(ctx)
+	if err != nil {
+		return "", err
+	}
+	return "Bearer " + t, nil
+}
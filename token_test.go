@@ -0,0 +1,212 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayConfDeploy
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/apid/apid-core/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var _ = Describe("token provider", func() {
+	var tokenFile string
+
+	var _ = BeforeEach(func() {
+		tokenFile = filepath.Join(bundlePath, "token-"+util.GenerateUUID())
+	})
+
+	var _ = AfterEach(func() {
+		os.Remove(tokenFile)
+	})
+
+	writeToken := func(token string, modTime time.Time) {
+		Expect(ioutil.WriteFile(tokenFile, []byte(token+"\n"), 0600)).Should(Succeed())
+		Expect(os.Chtimes(tokenFile, modTime, modTime)).Should(Succeed())
+	}
+
+	It("should reload the token file when it's rotated", func() {
+		p := &fileTokenProvider{path: tokenFile}
+		_, err := p.token(context.Background())
+		Expect(err).ShouldNot(Succeed())
+
+		writeToken("first", time.Now().Add(-time.Minute))
+		t, err := p.token(context.Background())
+		Expect(err).Should(Succeed())
+		Expect(t).Should(Equal("first"))
+
+		writeToken("second", time.Now())
+		t, err = p.token(context.Background())
+		Expect(err).Should(Succeed())
+		Expect(t).Should(Equal("second"))
+	})
+
+	It("should reread the token file after the token is rejected", func() {
+		p := &fileTokenProvider{path: tokenFile}
+		modTime := time.Now().Add(-time.Minute)
+		writeToken("first", modTime)
+		t, _ := p.token(context.Background())
+		Expect(t).Should(Equal("first"))
+		// rotated within the resolution of the file time
+		writeToken("second", modTime)
+		t, _ = p.token(context.Background())
+		Expect(t).Should(Equal("first"))
+		p.invalidate("first")
+		t, _ = p.token(context.Background())
+		Expect(t).Should(Equal("second"))
+	})
+
+	It("should cache oauth tokens until they're rejected", func() {
+		var issued int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			Expect(r.Method).Should(Equal("POST"))
+			Expect(r.ParseForm()).Should(Succeed())
+			Expect(r.PostForm.Get("grant_type")).Should(Equal("client_credentials"))
+			id, secret, ok := r.BasicAuth()
+			Expect(ok).Should(BeTrue())
+			Expect(id).Should(Equal("client"))
+			Expect(secret).Should(Equal("secret"))
+			n := atomic.AddInt32(&issued, 1)
+			json.NewEncoder(w).Encode(oauthTokenResponse{
+				AccessToken: "token" + strconv.Itoa(int(n)),
+				TokenType:   "Bearer",
+				ExpiresIn:   3600,
+			})
+		}))
+		defer server.Close()
+
+		p := &oauthTokenProvider{
+			client:       http.DefaultClient,
+			tokenURL:     server.URL,
+			clientId:     "client",
+			clientSecret: "secret",
+		}
+		t, err := p.token(context.Background())
+		Expect(err).Should(Succeed())
+		Expect(t).Should(Equal("token1"))
+		Expect(p.expiresAt).Should(BeTemporally("~", time.Now().Add(time.Hour-tokenExpiryMargin), time.Second))
+		t, _ = p.token(context.Background())
+		Expect(t).Should(Equal("token1"))
+
+		// an outdated rejection doesn't discard the new token
+		p.invalidate("token0")
+		t, _ = p.token(context.Background())
+		Expect(t).Should(Equal("token1"))
+		p.invalidate("token1")
+		t, _ = p.token(context.Background())
+		Expect(t).Should(Equal("token2"))
+		Expect(atomic.LoadInt32(&issued)).Should(Equal(int32(2)))
+	})
+
+	It("should fail if the oauth endpoint fails", func() {
+		var requested int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requested, 1)
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+		defer server.Close()
+		p := &oauthTokenProvider{
+			client:   http.DefaultClient,
+			tokenURL: server.URL,
+		}
+		_, err := p.token(context.Background())
+		Expect(err).ShouldNot(Succeed())
+
+		// the failure is returned until the backoff is over
+		_, cachedErr := p.token(context.Background())
+		Expect(cachedErr).Should(Equal(err))
+		Expect(atomic.LoadInt32(&requested)).Should(Equal(int32(1)))
+		p.failedUntil = time.Now()
+		_, err = p.token(context.Background())
+		Expect(err).ShouldNot(Succeed())
+		Expect(atomic.LoadInt32(&requested)).Should(Equal(int32(2)))
+	})
+
+	It("should interrupt getting an oauth token", func() {
+		release := make(chan bool)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		defer server.Close()
+		defer close(release)
+		p := &oauthTokenProvider{
+			client:   http.DefaultClient,
+			tokenURL: server.URL,
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+		start := time.Now()
+		_, err := p.token(ctx)
+		Expect(err).ShouldNot(Succeed())
+		Expect(time.Since(start)).Should(BeNumerically("<", time.Second))
+
+		// an interrupted caller doesn't make the others fail
+		Expect(p.failure).Should(BeNil())
+	})
+
+	It("should retry once with a new token after 401", func() {
+		oldTokens := tokens
+		defer func() {
+			tokens = oldTokens
+		}()
+		tokens = &fileTokenProvider{path: tokenFile}
+		modTime := time.Now().Add(-time.Minute)
+		writeToken("old", modTime)
+		var requests int32
+		var valid atomic.Value
+		valid.Store("Bearer old")
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			if r.Header.Get("Authorization") != valid.Load().(string) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte("ok"))
+		}))
+		defer server.Close()
+
+		res, err := doRequestWithAuth(context.Background(), http.DefaultClient, server.URL, nil)
+		Expect(err).Should(Succeed())
+		res.Body.Close()
+		Expect(res.StatusCode).Should(Equal(http.StatusOK))
+
+		// token rotated by the server and on disk
+		valid.Store("Bearer new")
+		writeToken("new", modTime)
+		res, err = doRequestWithAuth(context.Background(), http.DefaultClient, server.URL, nil)
+		Expect(err).Should(Succeed())
+		res.Body.Close()
+		Expect(res.StatusCode).Should(Equal(http.StatusOK))
+		Expect(atomic.LoadInt32(&requests)).Should(Equal(int32(3)))
+
+		// a rejected new token isn't retried again
+		valid.Store("Bearer newer")
+		res, err = doRequestWithAuth(context.Background(), http.DefaultClient, server.URL, nil)
+		Expect(err).Should(Succeed())
+		res.Body.Close()
+		Expect(res.StatusCode).Should(Equal(http.StatusUnauthorized))
+		Expect(atomic.LoadInt32(&requests)).Should(Equal(int32(5)))
+	})
+})
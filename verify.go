@@ -0,0 +1,157 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package apiGatewayConfDeploy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	quarantineDir = "quarantine"
+	// older quarantined files are removed beyond this, so that a blob server sending bad blobs can't fill the disk
+	maxQuarantinedFiles = 16
+)
+
+var (
+	ErrNoSignature      = errors.New("blob has no signature")
+	ErrInvalidSignature = errors.New("blob signature does not match any trusted key")
+)
+
+// blobVerifier checks the detached signature of a downloaded blob against a set of trusted public keys.
+// The signature is computed over the SHA-256 digest of the blob content, using either
+// RSA PKCS#1 v1.5 or ECDSA (ASN.1 encoded).
+type blobVerifier struct {
+	keys []crypto.PublicKey
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// loadTrustedKeys reads every *.pem file in the dir as a PKIX public key
+func loadTrustedKeys(dir string) (*blobVerifier, error) {
+	files, err := filepath.Glob(path.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	v := &blobVerifier{}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM data found in %s", f)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse public key %s: %v", f, err)
+		}
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+			v.keys = append(v.keys, key)
+		default:
+			return nil, fmt.Errorf("unsupported public key type in %s", f)
+		}
+		log.Debugf("loaded trusted key %s", f)
+	}
+	if len(v.keys) == 0 {
+		return nil, fmt.Errorf("no trusted keys found in %s", dir)
+	}
+	return v, nil
+}
+
+// verify returns nil if the base64 encoded signature of the file matches one of the trusted keys.
+// digest is the SHA-256 of the file, computed while downloading it.
+func (v *blobVerifier) verify(digest []byte, signature string) error {
+	if signature == "" {
+		return ErrNoSignature
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("malformed blob signature: %v", err)
+	}
+
+	for _, key := range v.keys {
+		switch k := key.(type) {
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, sig) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			var esig ecdsaSignature
+			if _, err := asn1.Unmarshal(sig, &esig); err == nil && ecdsa.Verify(k, digest, esig.R, esig.S) {
+				return nil
+			}
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// move a blob that failed verification out of the way, so that it can never be served
+func quarantineFile(fileName string) (string, error) {
+	dir := path.Join(bundlePath, quarantineDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	dest := path.Join(dir, path.Base(fileName))
+	if err := os.Rename(fileName, dest); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+// purgeQuarantine removes the oldest quarantined files but keep, and returns how many were removed
+func purgeQuarantine(keep int) int {
+	files, err := ioutil.ReadDir(path.Join(bundlePath, quarantineDir))
+	if err != nil || len(files) <= keep {
+		return 0
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+	removed := 0
+	for _, f := range files[keep:] {
+		if err := os.Remove(path.Join(bundlePath, quarantineDir, f.Name())); err != nil {
+			log.Warnf("Unable to remove quarantined file %s: %v", f.Name(), err)
+			continue
+		}
+		removed++
+	}
+	return removed
+}
+
+type verificationError struct {
+	blobId string
+	err    error
+}
+
+func (e *verificationError) Error() string {
+	return fmt.Sprintf("Verification failed. blobId=%s err=%v", e.blobId, e.err)
+}
@@ -0,0 +1,141 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayConfDeploy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/apid/apid-core/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+var _ = Describe("verify", func() {
+	var keyDir string
+	var ecKey *ecdsa.PrivateKey
+	var rsaKey *rsa.PrivateKey
+
+	var _ = BeforeEach(func() {
+		var err error
+		keyDir, err = ioutil.TempDir(tmpDir, "keys")
+		Expect(err).Should(Succeed())
+		ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).Should(Succeed())
+		rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).Should(Succeed())
+		writeTestPublicKey(path.Join(keyDir, "ec.pem"), &ecKey.PublicKey)
+		writeTestPublicKey(path.Join(keyDir, "rsa.pem"), &rsaKey.PublicKey)
+	})
+
+	var _ = AfterEach(func() {
+		os.RemoveAll(keyDir)
+	})
+
+	It("should load all trusted keys", func() {
+		v, err := loadTrustedKeys(keyDir)
+		Expect(err).Should(Succeed())
+		Expect(len(v.keys)).Should(Equal(2))
+	})
+
+	It("should fail if no trusted keys", func() {
+		emptyDir, err := ioutil.TempDir(tmpDir, "keys")
+		Expect(err).Should(Succeed())
+		defer os.RemoveAll(emptyDir)
+		_, err = loadTrustedKeys(emptyDir)
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("should verify signatures of trusted keys", func() {
+		v, err := loadTrustedKeys(keyDir)
+		Expect(err).Should(Succeed())
+		content := []byte(util.GenerateUUID())
+		digest := sha256.Sum256(content)
+
+		// ecdsa
+		Expect(v.verify(digest[:], signTestBlob(ecKey, content))).Should(Succeed())
+
+		// rsa
+		sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+		Expect(err).Should(Succeed())
+		Expect(v.verify(digest[:], base64.StdEncoding.EncodeToString(sig))).Should(Succeed())
+	})
+
+	It("should reject missing, tampered or untrusted signatures", func() {
+		v, err := loadTrustedKeys(keyDir)
+		Expect(err).Should(Succeed())
+		content := []byte(util.GenerateUUID())
+		digest := sha256.Sum256(content)
+
+		Expect(v.verify(digest[:], "")).Should(Equal(ErrNoSignature))
+		Expect(v.verify(digest[:], "not base64!")).ShouldNot(Succeed())
+		Expect(v.verify(digest[:], signTestBlob(ecKey, []byte("tampered")))).Should(Equal(ErrInvalidSignature))
+
+		untrusted, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).Should(Succeed())
+		Expect(v.verify(digest[:], signTestBlob(untrusted, content))).Should(Equal(ErrInvalidSignature))
+	})
+
+	It("should keep the newest quarantined files only", func() {
+		Expect(os.RemoveAll(path.Join(bundlePath, quarantineDir))).Should(Succeed())
+		var quarantined []string
+		for i := 0; i < 4; i++ {
+			dest, err := quarantineFile(writeTestBlob([]byte(util.GenerateUUID())))
+			Expect(err).Should(Succeed())
+			modTime := time.Now().Add(time.Duration(i-4) * time.Minute)
+			Expect(os.Chtimes(dest, modTime, modTime)).Should(Succeed())
+			quarantined = append(quarantined, dest)
+		}
+		Expect(purgeQuarantine(2)).Should(Equal(2))
+		for i, file := range quarantined {
+			_, err := os.Stat(file)
+			Expect(os.IsNotExist(err)).Should(Equal(i < 2))
+		}
+		Expect(purgeQuarantine(2)).Should(BeZero())
+	})
+})
+
+func writeTestPublicKey(file string, key interface{}) {
+	b, err := x509.MarshalPKIXPublicKey(key)
+	Expect(err).Should(Succeed())
+	err = ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b}), 0600)
+	Expect(err).Should(Succeed())
+}
+
+func writeTestBlob(content []byte) string {
+	f, err := ioutil.TempFile(tmpDir, "blob")
+	Expect(err).Should(Succeed())
+	defer f.Close()
+	_, err = f.Write(content)
+	Expect(err).Should(Succeed())
+	return f.Name()
+}
+
+func signTestBlob(key *ecdsa.PrivateKey, content []byte) string {
+	digest := sha256.Sum256(content)
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	Expect(err).Should(Succeed())
+	return base64.StdEncoding.EncodeToString(sig)
+}